@@ -0,0 +1,3377 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/testgrid/util/clock"
+	"github.com/GoogleCloudPlatform/testgrid/util/queue"
+	"github.com/golang/protobuf/proto"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+var (
+	// ErrClosed is returned by sends and Next once the queue is closed, see Close.
+	ErrClosed = errors.New("queue closed")
+	// ErrNotInitialized is returned by sends and Next before Init or Add gave the queue items.
+	ErrNotInitialized = errors.New("queue not initialized")
+)
+
+// Named items have a unique name, such as test groups and dashboards.
+type Named interface {
+	GetName() string
+}
+
+// ItemQueue can send items to receivers at a specific frequency.
+//
+// Items are keyed by their GetName(), unless KeyFunc keys them otherwise.
+// Also contains the ability to modify the next time to send items.
+// Call Init() first: until then the queue reports no items, methods changing an item
+// report it is not found, and sends and Next return ErrNotInitialized right away.
+// Exported methods are safe to call concurrently.
+type ItemQueue[T Named] struct {
+	queue.Queue
+
+	// BackoffBase delays retrying an item after its first failed Ack,
+	// doubling after each consecutive failure. Zero retries right away.
+	BackoffBase time.Duration
+	// BackoffMax caps the retry delay when non-zero.
+	BackoffMax time.Duration
+	// SendRetries lets Send and SendFair retry scheduling items this many times
+	// in a row after the underlying queue fails with an error other than the
+	// context expiring, such as from a limiter, waiting SendRetryBackoff before
+	// the first retry and doubling it after each one. The count starts over once
+	// an item is scheduled. Zero returns the first error, which is the default.
+	SendRetries      int
+	SendRetryBackoff time.Duration
+	// SendErrors receives each error the underlying queue fails with as it happens,
+	// other than the context expiring, such as before Send or SendFair retries.
+	// Drops errors rather than waiting while nothing receives them. Send still
+	// returns the last error once it gives up. Reports nothing when nil.
+	SendErrors chan<- error
+	// MaxFailures of an item in a row before SendAckWithDeadLetters stops retrying it.
+	MaxFailures int
+	// ResumeKeepsSchedule stops Resume from sending an item right away,
+	// leaving it at the time it was scheduled before it was paused.
+	ResumeKeepsSchedule bool
+	// KeyFunc derives the key of each item when set, such as to namespace groups of
+	// several tenants which may share a name, rather than keying items by GetName.
+	// Every method taking or returning the name of an item uses its key instead.
+	// Set before calling Init.
+	KeyFunc func(item T) string
+	// ShouldSchedule skips items it rejects when set, so Init and Add leave them out
+	// of the rotation until a later Init or Add accepts them.
+	ShouldSchedule func(item T) bool
+	// FrequencyFunc derives how often to send each item from its config when set,
+	// such as less often for groups showing many days of results. Init and Add apply
+	// it like SetFrequency, replacing any earlier override. When it returns zero,
+	// Send reschedules the item at the frequency passed to it instead.
+	FrequencyFunc func(item T) time.Duration
+	// ClassFunc derives the class of each item when set, such as the dashboard
+	// showing a group, and Init and Add apply it like SetClass. Send then takes
+	// turns between classes whenever items of several of them are ready, so a
+	// dashboard with many groups cannot starve one with a few: while items of
+	// N classes stay ready, each class is sent at least once every N sends.
+	ClassFunc func(item T) string
+	// FreshFunc reports whether the results of an item are still fresh when set,
+	// such as when its config allows them to be this stale. Sends reschedule
+	// fresh items without sending them, like an unchanged fingerprint.
+	FreshFunc func(item T) bool
+	// Adaptive adjusts how often to send each item with a fingerprint when set,
+	// see SetFingerprint and AdaptiveFrequency.
+	Adaptive *AdaptiveFrequency
+	// LateTolerance of sending an item after it is ready, beyond which metrics count it
+	// as late rather than on time, see SetMetrics.
+	LateTolerance time.Duration
+	// WaitSamples bounds how many wait times of sent items, from when each was ready
+	// until it was sent, WaitPercentiles samples them from. Zero records none.
+	WaitSamples int
+	// HistorySize bounds how many of its latest emits History keeps for each item.
+	// Zero keeps none.
+	HistorySize int
+	// DeadlineFraction of the frequency of each item SendWithIDs gives receivers to
+	// update it, see Emit.Deadline, such as 0.5 to finish within half of it. Zero gives
+	// them the whole frequency.
+	DeadlineFraction float64
+	// GateRetry delays sending an item again after its gate was closed, see SetGate.
+	// Defaults to a minute.
+	GateRetry time.Duration
+	// HeartbeatInterval makes SendWithIDs emit a heartbeat whenever it sent nothing
+	// for this long, see Emit.Heartbeat, so receivers can tell an idle queue from a
+	// stalled one. Zero disables heartbeats.
+	HeartbeatInterval time.Duration
+	// PokeWindow coalesces every Poke of an item within this long of the first one,
+	// so a burst of them only sends the item once. Zero disables coalescing.
+	PokeWindow time.Duration
+	// PullFrequency reschedules items returned by Next, which removes them when zero
+	// unless ZeroFrequency is queue.RepeatAtZero.
+	PullFrequency time.Duration
+	// CopyOnEmit sends receivers a deep copy of each proto item, such as a test group,
+	// so they may change what they receive. Otherwise every receiver shares the item
+	// the queue holds, which they must not change: doing so changes what later sends
+	// and Status report. Off by default, which saves copying every item sent.
+	CopyOnEmit bool
+	// Buffer up to this many items a send took off the queue but has not yet sent
+	// to receivers, so bursts of ready items are not held up by each receive.
+	// Buffered items already count as sent by Status, and any not yet received
+	// when a send stops are lost until they are ready again. Defaults to unbuffered.
+	Buffer int
+	// FlushTimeout bounds a final pass Send makes once its context expires, sending
+	// receivers whichever items are overdue by then, such as one last refresh while
+	// shutting down gracefully. Items it cannot send in time are left scheduled, and
+	// like SendGraceful, Send puts back any item it took but could not send before
+	// the context expired. Zero returns right away, which is the default.
+	FlushTimeout time.Duration
+
+	items    map[string]T
+	loader   func(name string) T // of items stored as their names alone, see InitLazy
+	view     atomic.Value        // of items for read paths, see publish
+	failures map[string]int
+	dead     map[string]bool
+	added    map[string]time.Time
+	lastSent map[string]time.Time
+	counts   map[string]uint64
+	lastAny  time.Time // when any item was last sent
+	emits    uint64    // number of items SendWithIDs emitted
+	gen      uint64    // number of times Init or Update replaced the items, see Generation
+	poked    map[string]time.Time
+	deadline map[string]time.Time
+	gates    map[string]func(context.Context) (bool, error)
+	leases   map[string]time.Time // when each lease expires, see Lease
+	hours    map[string]activeHours
+	removing map[string]*removal // of items RemoveAfter is removing
+	labels   map[string]map[string]string
+	inflight map[string]context.CancelFunc // of the context of the last emit of each item, see Emit.Context
+	prints   map[string]*fingerprint
+	drained  chan struct{} // closed by the next Drain
+	jitter   time.Duration // of Send, see WithJitter
+	metrics  *QueueMetrics
+	observer Observer
+	watches  map[*ScheduleWatch]bool
+	running  map[*context.CancelFunc]bool // of every send and Next, see Close
+	slots    chan struct{}                // of deliveries not yet acked, see SetMaxInFlight
+	closed   bool
+	tracer   Tracer
+	log      logrus.FieldLogger
+	clock    clock.Clock
+	lock     sync.RWMutex
+
+	threshold     int             // of overdue items, see SetDepthThreshold
+	onThreshold   func(depth int) // called once the threshold is exceeded
+	overThreshold bool            // whether the threshold is currently exceeded
+
+	waits  []time.Duration // sampled from every wait, see WaitSamples
+	waited uint64          // number of waits sampled from
+
+	history map[string]*emitHistory // of each item, see HistorySize
+}
+
+// InitE (or reinit) the queue like Init, unless an item is nil, has an empty name
+// or has the same name as another item.
+//
+// Leaves the queue unchanged when returning an error, so servers can reject a bad config.
+func (q *ItemQueue[T]) InitE(log logrus.FieldLogger, items []T, when time.Time) error {
+	if err := checkItems(items, q.key); err != nil {
+		return err
+	}
+	q.Init(log, items, when)
+	return nil
+}
+
+// InitNow (or reinit) the queue like Init, so that every item is ready to send now.
+//
+// Unlike Init, also makes existing items ready now. When created WithJitter,
+// delays each item by a random duration up to the jitter so they are not all
+// sent at once. SetLimiter also paces how quickly Send sends them.
+func (q *ItemQueue[T]) InitNow(log logrus.FieldLogger, items []T) {
+	q.lock.RLock()
+	now := q.now()
+	jitter := q.jitter
+	q.lock.RUnlock()
+	reinit := q.reinit(log, now)
+	q.update(items, func(names []string) {
+		reinit(names)
+		q.Queue.RescheduleAll(now)
+		if jitter > 0 {
+			q.Queue.JitterAll(jitter)
+		}
+	})
+}
+
+// InitValidated (or reinit) the queue like InitE, skipping nil items and items with an empty name.
+//
+// Returns an error describing each skipped item, and leaves the queue unchanged
+// when returning an error because multiple items have the same name.
+func (q *ItemQueue[T]) InitValidated(log logrus.FieldLogger, items []T, when time.Time) ([]error, error) {
+	valid, problems := validItems(items)
+	if err := checkItems(valid, q.key); err != nil {
+		return problems, err
+	}
+	q.Init(log, valid, when)
+	return problems, nil
+}
+
+// validItems returns the items with a name, and an error describing each other item.
+func validItems[T Named](items []T) ([]T, []error) {
+	valid := make([]T, 0, len(items))
+	var problems []error
+	for i, item := range items {
+		if isNil(item) {
+			problems = append(problems, fmt.Errorf("item %d: nil", i))
+			continue
+		}
+		if strings.TrimSpace(item.GetName()) == "" {
+			problems = append(problems, fmt.Errorf("item %d: empty name %q", i, item.GetName()))
+			continue
+		}
+		valid = append(valid, item)
+	}
+	return valid, problems
+}
+
+// InitFiltered (or reinit) the queue like Init, with only the items filter accepts.
+//
+// Keeps partitioning a config, for example across shards, in one place.
+func (q *ItemQueue[T]) InitFiltered(log logrus.FieldLogger, items []T, when time.Time, filter func(T) bool) {
+	q.Init(log, filterItems(items, filter), when)
+}
+
+// filterItems returns the items filter accepts, skipping nil items.
+func filterItems[T Named](items []T, filter func(T) bool) []T {
+	out := make([]T, 0, len(items))
+	for _, item := range items {
+		if !isNil(item) && filter(item) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// MatchName returns a filter accepting items whose name matches re.
+func MatchName[T Named](re *regexp.Regexp) func(T) bool {
+	return func(item T) bool {
+		return re.MatchString(item.GetName())
+	}
+}
+
+// checkItems returns an error identifying the first item which is nil,
+// has an empty name or has the same key as an earlier item.
+func checkItems[T Named](items []T, key func(T) string) error {
+	names := make(map[string]bool, len(items))
+	for i, item := range items {
+		if isNil(item) {
+			return fmt.Errorf("item %d: nil", i)
+		}
+		if name := item.GetName(); strings.TrimSpace(name) == "" {
+			return fmt.Errorf("item %d: empty name %q", i, name)
+		}
+		name := key(item)
+		if names[name] {
+			return fmt.Errorf("duplicate name: %q", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// key returns the key of the item, see KeyFunc.
+func (q *ItemQueue[T]) key(item T) string {
+	if q.KeyFunc != nil {
+		return q.KeyFunc(item)
+	}
+	return item.GetName()
+}
+
+// isNil reports whether the item is nil, including a nil pointer such as a *configpb.TestGroup.
+func isNil[T Named](item T) bool {
+	v := reflect.ValueOf(item)
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	}
+	return false
+}
+
+// Init (or reinit) the queue with the specified items, which should be updated at frequency.
+//
+// Skips any nil item rather than scheduling it, and resets EmitCounts.
+// Safe to call while sending: each send sees either the old or the new items
+// along with their schedule, never a mix, so it never skips an item in both.
+func (q *ItemQueue[T]) Init(log logrus.FieldLogger, items []T, when time.Time) {
+	q.update(items, q.reinit(log, when))
+}
+
+// InitMap (or reinit) the queue like Init, with items keyed by their names.
+//
+// Saves building a slice of items from a map only for Init to index them by name
+// again. Takes ownership of items, which the caller must not use afterwards, and
+// whose keys must be the names of their items, or their keys when KeyFunc is set.
+func (q *ItemQueue[T]) InitMap(log logrus.FieldLogger, items map[string]T, when time.Time) {
+	names := make([]string, 0, len(items))
+	for name, item := range items {
+		if isNil(item) || q.ShouldSchedule != nil && !q.ShouldSchedule(item) {
+			delete(items, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	q.replace(items, names, q.reinit(log, when))
+}
+
+// InitLazy (or reinit) the queue like Init with only the names of items, loading each
+// item with load when it is sent rather than holding every item in memory, such as
+// when the caller already keeps thousands of test groups in its own config store.
+//
+// Status, StatusOf, Peek and every send load items the same way, skipping any item
+// load returns nil for like a removed one. Other methods report such items as nil.
+// Items added later with Add or Update are held in memory as usual, until the next Init.
+func (q *ItemQueue[T]) InitLazy(log logrus.FieldLogger, names []string, when time.Time, load func(name string) T) {
+	items := make(map[string]T, len(names))
+	for _, name := range names {
+		var zero T
+		items[name] = zero
+	}
+	reinit := q.reinit(log, when)
+	q.replace(items, names, func(names []string) {
+		reinit(names)
+		q.loader = load
+	})
+}
+
+// load the item of the given name when the queue only holds its name, see InitLazy,
+// returning false when there is no such item.
+func (q *ItemQueue[T]) load(name string, item T) (T, bool) {
+	q.lock.RLock()
+	load := q.loader
+	q.lock.RUnlock()
+	if load == nil || !isNil(item) {
+		return item, true
+	}
+	item = load(name)
+	return item, !isNil(item)
+}
+
+// reinit returns a function reinitializing the underlying queue with names, see Init.
+func (q *ItemQueue[T]) reinit(log logrus.FieldLogger, when time.Time) func(names []string) {
+	return func(names []string) {
+		q.Queue.Init(log, names, when)
+		q.loader = nil
+		q.counts = nil
+		q.waits = nil
+		q.waited = 0
+		q.history = nil
+	}
+}
+
+// Update the queue to items after Init, in a single critical section.
+//
+// Keeps when each existing item is next sent, schedules new items at when
+// and removes items which are no longer specified. Init does the same,
+// whereas Update keeps logging like the last Init.
+func (q *ItemQueue[T]) Update(items []T, when time.Time) {
+	q.update(items, func(names []string) {
+		q.Queue.Update(names, when)
+	})
+}
+
+// update the queue to items, calling update with their names while holding the lock.
+func (q *ItemQueue[T]) update(items []T, update func(names []string)) {
+	items = q.scheduled(items)
+	n := len(items)
+	found := make(map[string]T, n)
+	names := make([]string, n)
+
+	for i, item := range items {
+		name := q.key(item)
+		names[i] = name
+		found[name] = item
+	}
+	q.replace(found, names, update)
+}
+
+// replace the items with found, calling update with their names while holding the lock.
+func (q *ItemQueue[T]) replace(found map[string]T, names []string, update func(names []string)) {
+	n := len(found)
+	q.lock.Lock()
+	update(names)
+	if len(q.watches) > 0 {
+		for name := range q.items {
+			if _, ok := found[name]; !ok {
+				q.notify(Removed, name, time.Time{})
+			}
+		}
+		for _, name := range names {
+			if _, ok := q.items[name]; !ok {
+				when, _ := q.Queue.When(name)
+				q.notify(Added, name, when)
+			}
+		}
+	}
+	q.items = found
+	q.gen++
+	for _, item := range found {
+		q.derive(item)
+	}
+	if q.added == nil {
+		q.added = make(map[string]time.Time, n)
+	}
+	now := q.now()
+	for name := range found {
+		if _, ok := q.added[name]; !ok {
+			q.added[name] = now
+		}
+	}
+	for name := range q.added {
+		if _, ok := found[name]; !ok {
+			delete(q.added, name)
+			delete(q.lastSent, name)
+		}
+	}
+	for name := range q.poked {
+		if _, ok := found[name]; !ok {
+			delete(q.poked, name)
+		}
+	}
+	for name := range q.deadline {
+		if _, ok := found[name]; !ok {
+			delete(q.deadline, name)
+		}
+	}
+	for name := range q.prints {
+		if _, ok := found[name]; !ok {
+			delete(q.prints, name)
+		}
+	}
+	for name := range q.gates {
+		if _, ok := found[name]; !ok {
+			delete(q.gates, name)
+		}
+	}
+	for name := range q.leases {
+		if _, ok := found[name]; !ok {
+			delete(q.leases, name)
+		}
+	}
+	for name := range q.hours {
+		if _, ok := found[name]; !ok {
+			delete(q.hours, name)
+		}
+	}
+	for name := range q.labels {
+		if _, ok := found[name]; !ok {
+			delete(q.labels, name)
+		}
+	}
+	for name, r := range q.removing {
+		if _, ok := found[name]; !ok {
+			close(r.cancel)
+			delete(q.removing, name)
+			continue
+		}
+		q.keep(name, found)
+	}
+	for name := range q.history {
+		if _, ok := found[name]; !ok {
+			delete(q.history, name)
+		}
+	}
+	for name := range q.inflight {
+		if _, ok := found[name]; !ok {
+			q.cancelEmit(name)
+		}
+	}
+	for name := range q.failures {
+		if _, ok := found[name]; !ok {
+			delete(q.failures, name)
+		}
+	}
+	for name := range q.dead {
+		if _, ok := found[name]; !ok {
+			delete(q.dead, name)
+		}
+	}
+	for name := range q.counts {
+		if _, ok := found[name]; !ok {
+			delete(q.counts, name)
+		}
+	}
+	q.publish()
+	q.lock.Unlock()
+}
+
+// publish a copy of the items for Status and StatusOf to read without the lock.
+//
+// Caller must hold the lock, and call it after changing which items are in the queue.
+func (q *ItemQueue[T]) publish() {
+	view := make(map[string]T, len(q.items))
+	for name, item := range q.items {
+		view[name] = item
+	}
+	q.view.Store(view)
+}
+
+// published returns the items as of the last publish.
+func (q *ItemQueue[T]) published() map[string]T {
+	view, _ := q.view.Load().(map[string]T)
+	return view
+}
+
+// scheduled returns the items accepted by ShouldSchedule, skipping nil items.
+func (q *ItemQueue[T]) scheduled(items []T) []T {
+	if q.ShouldSchedule != nil {
+		return filterItems(items, q.ShouldSchedule)
+	}
+	for _, item := range items {
+		if isNil(item) {
+			return filterItems(items, func(T) bool { return true })
+		}
+	}
+	return items
+}
+
+// Add (or replace) a single item, which will next be sent at when.
+//
+// Leaves the schedule of every other item unchanged. Replacing an existing
+// item only changes when it is next sent like Fix: moving it earlier when
+// that is sooner, and only moving it later if later is set.
+//
+// Removes the item instead when ShouldSchedule rejects it, and ignores a nil item.
+func (q *ItemQueue[T]) Add(item T, when time.Time, later bool) {
+	if isNil(item) {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.publish()
+	q.add(item, when, later)
+}
+
+// add a single item like Add.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) add(item T, when time.Time, later bool) {
+	if q.ShouldSchedule != nil && !q.ShouldSchedule(item) {
+		q.remove(q.key(item))
+		return
+	}
+	if q.items == nil {
+		q.items = map[string]T{}
+	}
+	name := q.key(item)
+	_, exists := q.items[name]
+	q.items[name] = item
+	if _, ok := q.removing[name]; ok {
+		q.keep(name, q.items)
+	}
+	if _, ok := q.added[name]; !ok {
+		if q.added == nil {
+			q.added = map[string]time.Time{}
+		}
+		q.added[name] = q.now()
+	}
+	if q.dead[name] {
+		delete(q.dead, name)
+		delete(q.failures, name)
+	}
+	q.Queue.Add(name, when, later)
+	q.derive(item)
+	if !exists && len(q.watches) > 0 {
+		when, _ := q.Queue.When(name)
+		q.notify(Added, name, when)
+	}
+}
+
+// Merge the items of other into the queue, along with when each one is next sent,
+// such as to combine sharded queues back into one.
+//
+// Leaves other unchanged. Adds each item like Add, so an item in both queues keeps the
+// earlier of the two times unless later is set, which takes the time from other instead.
+// Items other is not scheduling, such as those held until acked, are ready right away.
+func (q *ItemQueue[T]) Merge(other *ItemQueue[T], later bool) {
+	if other == nil || other == q {
+		return
+	}
+	// Lock both queues in the order of their addresses, so concurrent merges
+	// in opposite directions do not deadlock.
+	first, second := &q.lock, &other.lock
+	if reflect.ValueOf(other).Pointer() < reflect.ValueOf(q).Pointer() {
+		first, second = second, first
+	}
+	first.Lock()
+	defer first.Unlock()
+	second.Lock()
+	defer second.Unlock()
+	defer q.publish()
+
+	current := other.Queue.Current()
+	now := q.now()
+	for name, item := range other.items {
+		when, ok := current[name]
+		if !ok {
+			when = now
+		}
+		q.add(item, when, later)
+	}
+}
+
+// derive the frequency and class of the item with FrequencyFunc and ClassFunc when set.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) derive(item T) {
+	if q.ClassFunc != nil {
+		q.Queue.SetClass(q.key(item), q.ClassFunc(item))
+	}
+	if q.FrequencyFunc == nil {
+		return
+	}
+	frequency := q.FrequencyFunc(item)
+	if frequency < 0 {
+		frequency = 0
+	}
+	q.Queue.SetFrequency(q.key(item), frequency)
+}
+
+// UpdateGroup replaces the stored item with the same name, which is sent from then on.
+//
+// Unlike Add, leaves when the item is next sent unchanged. Also derives its
+// frequency and class again when FrequencyFunc and ClassFunc are set. Returns an error if the item
+// is nil or not in the queue.
+func (q *ItemQueue[T]) UpdateGroup(item T) error {
+	if isNil(item) {
+		return errors.New("nil item")
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.publish()
+	name := q.key(item)
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	q.items[name] = item
+	q.derive(item)
+	return nil
+}
+
+// Remove a single item, leaving all other items unchanged.
+func (q *ItemQueue[T]) Remove(name string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.publish()
+	return q.remove(name)
+}
+
+// removal of an item after a grace period, see RemoveAfter.
+type removal struct {
+	until  time.Time
+	paused bool          // whether the item was paused before
+	cancel chan struct{} // closed once the item is kept or removed
+}
+
+// RemoveAfter stops sending the named item right away, and removes it once grace elapses,
+// such as while reloading a config which may briefly leave out a group.
+//
+// Init, Update or Add keeping the item during the grace period cancels its removal,
+// so it is sent again on its earlier schedule. StatusOf reports the item as draining
+// until then. A non-positive grace, or a closed queue, removes the item right away
+// like Remove.
+func (q *ItemQueue[T]) RemoveAfter(name string, grace time.Duration) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.publish()
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	if grace <= 0 || q.closed {
+		return q.remove(name)
+	}
+	paused := q.Queue.Paused(name)
+	if r, ok := q.removing[name]; ok {
+		paused = r.paused
+		close(r.cancel)
+	}
+	if err := q.Queue.SetPaused(name, true); err != nil {
+		return err
+	}
+	r := &removal{until: q.now().Add(grace), paused: paused, cancel: make(chan struct{})}
+	if q.removing == nil {
+		q.removing = map[string]*removal{}
+	}
+	q.removing[name] = r
+	clk := q.clock
+	if clk == nil {
+		clk = clock.Real{}
+	}
+	timer := clk.NewTimer(grace)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-r.cancel:
+		case <-timer.C():
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			if q.removing[name] == r {
+				q.remove(name)
+				q.publish()
+			}
+		}
+	}()
+	return nil
+}
+
+// keep the named item RemoveAfter is removing when found has it, resuming it unless
+// it was paused before.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) keep(name string, found map[string]T) {
+	if _, ok := found[name]; !ok {
+		return
+	}
+	r := q.removing[name]
+	close(r.cancel)
+	delete(q.removing, name)
+	if !r.paused {
+		q.Queue.SetPaused(name, false)
+	}
+}
+
+// RemoveWhere removes every item pred accepts in a single critical section, returning how many.
+//
+// Like Remove, a send skips any removed item it already took off the queue.
+func (q *ItemQueue[T]) RemoveWhere(pred func(T) bool) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.publish()
+	var n int
+	for name, item := range q.items {
+		if !pred(item) {
+			continue
+		}
+		q.remove(name)
+		n++
+	}
+	return n
+}
+
+// remove the named item.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) remove(name string) error {
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	delete(q.items, name)
+	q.notify(Removed, name, time.Time{})
+	delete(q.failures, name)
+	delete(q.dead, name)
+	delete(q.added, name)
+	delete(q.lastSent, name)
+	delete(q.poked, name)
+	delete(q.deadline, name)
+	delete(q.prints, name)
+	delete(q.gates, name)
+	delete(q.leases, name)
+	delete(q.hours, name)
+	delete(q.labels, name)
+	delete(q.history, name)
+	if r, ok := q.removing[name]; ok {
+		close(r.cancel)
+		delete(q.removing, name)
+	}
+	delete(q.counts, name)
+	q.cancelEmit(name)
+	return q.Queue.Remove(name)
+}
+
+// cancelEmit cancels the context of the last emit of the named item, see Emit.Context.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) cancelEmit(name string) {
+	if cancel, ok := q.inflight[name]; ok {
+		cancel()
+		delete(q.inflight, name)
+	}
+}
+
+// EvictStale removes every item not sent successfully within ttl, returning their sorted names.
+//
+// Send and SendFair successfully send an item when a receiver takes it,
+// whereas SendAck only does when the receiver acks it without an error.
+// An item which was never sent is stale once it was added more than ttl ago.
+func (q *ItemQueue[T]) EvictStale(ttl time.Duration) []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.publish()
+	cutoff := q.now().Add(-ttl)
+	var evicted []string
+	for name := range q.items {
+		when, ok := q.lastSent[name]
+		if !ok {
+			when = q.added[name]
+		}
+		if !when.Before(cutoff) {
+			continue
+		}
+		evicted = append(evicted, name)
+	}
+	sort.Strings(evicted)
+	for _, name := range evicted {
+		q.remove(name)
+	}
+	return evicted
+}
+
+// EmitCounts returns how many times each item was sent to a receiver since Init,
+// such as to find items sent far more often than expected.
+//
+// Removing an item forgets its count, whereas adding or updating items leaves
+// the count of every other item unchanged.
+func (q *ItemQueue[T]) EmitCounts() map[string]uint64 {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	counts := make(map[string]uint64, len(q.counts))
+	for name, n := range q.counts {
+		counts[name] = n
+	}
+	return counts
+}
+
+// count an emit of the named item, see EmitCounts.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) count(name string) {
+	if _, ok := q.items[name]; !ok {
+		return
+	}
+	if q.counts == nil {
+		q.counts = map[string]uint64{}
+	}
+	q.counts[name]++
+}
+
+// sample the wait of an item sent, keeping a uniform sample of at most WaitSamples waits.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) sample(wait time.Duration) {
+	if q.WaitSamples <= 0 {
+		return
+	}
+	q.waited++
+	if len(q.waits) < q.WaitSamples {
+		q.waits = append(q.waits, wait)
+		return
+	}
+	if i := rand.Int63n(int64(q.waited)); i < int64(len(q.waits)) {
+		q.waits[i] = wait
+	}
+}
+
+// EmitEvent is an emit of an item History keeps.
+type EmitEvent struct {
+	// When the item was sent.
+	When time.Time
+	// Trigger is why the item was sent.
+	Trigger queue.Trigger
+	// Wait from when the item was ready until it was sent.
+	Wait time.Duration
+}
+
+// emitHistory keeps the latest emits of an item in a ring.
+type emitHistory struct {
+	events []EmitEvent
+	next   int // index of the oldest event once the ring is full
+}
+
+// record the emit of the item the queue scheduled at now, see HistorySize.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) record(who queue.Scheduled, now time.Time) {
+	if q.HistorySize <= 0 {
+		return
+	}
+	if _, ok := q.items[who.Name]; !ok {
+		return
+	}
+	h, ok := q.history[who.Name]
+	if !ok {
+		if q.history == nil {
+			q.history = map[string]*emitHistory{}
+		}
+		h = &emitHistory{}
+		q.history[who.Name] = h
+	}
+	event := EmitEvent{When: now, Trigger: who.Trigger, Wait: now.Sub(who.When)}
+	if len(h.events) < q.HistorySize {
+		h.events = append(h.events, event)
+		return
+	}
+	if h.next >= len(h.events) {
+		h.next = 0
+	}
+	h.events[h.next] = event
+	h.next++
+}
+
+// History returns the latest emits of the named item, oldest first, at most HistorySize of them.
+//
+// Returns nothing for an item never sent since it was added or Init.
+func (q *ItemQueue[T]) History(name string) []EmitEvent {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	h, ok := q.history[name]
+	if !ok {
+		return nil
+	}
+	events := make([]EmitEvent, 0, len(h.events))
+	events = append(events, h.events[h.next:]...)
+	return append(events, h.events[:h.next]...)
+}
+
+// WaitPercentiles returns the wait of sent items at each percentile in ps, such as 0.5
+// for the median, from when each was ready until it was sent, see WaitSamples.
+//
+// Returns zero for each percentile when no waits were sampled since Init.
+func (q *ItemQueue[T]) WaitPercentiles(ps ...float64) []time.Duration {
+	q.lock.RLock()
+	waits := append([]time.Duration(nil), q.waits...)
+	q.lock.RUnlock()
+	sort.Slice(waits, func(i, j int) bool {
+		return waits[i] < waits[j]
+	})
+	got := make([]time.Duration, len(ps))
+	if len(waits) == 0 {
+		return got
+	}
+	for i, p := range ps {
+		n := int(math.Ceil(p*float64(len(waits)))) - 1
+		switch {
+		case n < 0:
+			n = 0
+		case n >= len(waits):
+			n = len(waits) - 1
+		}
+		got[i] = waits[n]
+	}
+	return got
+}
+
+// LastSent returns when the named item was last sent successfully, if ever.
+//
+// See EvictStale for what sending an item successfully means.
+func (q *ItemQueue[T]) LastSent(name string) (time.Time, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	when, ok := q.lastSent[name]
+	return when, ok
+}
+
+// Healthy returns an error when an item has been ready for longer than maxSilence,
+// yet nothing was sent successfully during that time.
+//
+// An empty queue, or one where nothing is ready yet, is idle and healthy.
+func (q *ItemQueue[T]) Healthy(maxSilence time.Duration) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	_, name, when := q.Queue.Status()
+	if name == nil {
+		return nil
+	}
+	now := q.now()
+	if now.Sub(when) <= maxSilence || now.Sub(q.lastAny) <= maxSilence {
+		return nil
+	}
+	return fmt.Errorf("%s ready for %s, but nothing sent in %s", *name, now.Sub(when), maxSilence)
+}
+
+// sent records that the named item was sent successfully.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) sent(name string, when time.Time) {
+	if when.After(q.lastAny) {
+		q.lastAny = when
+	}
+	if _, ok := q.items[name]; !ok {
+		return
+	}
+	if q.lastSent == nil {
+		q.lastSent = map[string]time.Time{}
+	}
+	q.lastSent[name] = when
+	q.notify(Sent, name, when)
+	if fp, ok := q.prints[name]; ok && fp.taken != nil {
+		fp.sent = fp.taken
+		fp.taken = nil
+	}
+}
+
+// fingerprint of an item's underlying data, see SetFingerprint.
+type fingerprint struct {
+	fn    func() (string, error)
+	sent  *string // of the item when it was last sent successfully
+	taken *string // of the item when it was last taken off the queue
+}
+
+// SetFingerprint skips sending the named item while fn returns the same fingerprint
+// as when it was last sent successfully, such as a hash of the results it reads.
+//
+// Send calls fn each time the item is ready, and reschedules the item without
+// sending it when the fingerprint is unchanged. Sends the item when fn returns
+// an error. A nil fn sends the item whenever it is ready.
+func (q *ItemQueue[T]) SetFingerprint(name string, fn func() (string, error)) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	if fn == nil {
+		delete(q.prints, name)
+		return nil
+	}
+	if q.prints == nil {
+		q.prints = map[string]*fingerprint{}
+	}
+	q.prints[name] = &fingerprint{fn: fn}
+	return nil
+}
+
+// AdaptiveFrequency sends items whose fingerprint keeps changing more often, and
+// those whose fingerprint stays the same less often, see ItemQueue.Adaptive.
+//
+// Each time a send takes an item off the queue after it was sent before, it divides
+// how often to send the item by Factor when the fingerprint changed since, and
+// multiplies it by Factor otherwise, keeping the result between Floor and Ceiling.
+// Applies the result like SetFrequency, starting from how often the item was sent.
+type AdaptiveFrequency struct {
+	Floor   time.Duration
+	Ceiling time.Duration // unbounded when zero
+	Factor  float64       // defaults to 2
+}
+
+// adapt how often to send the item the queue scheduled to whether its fingerprint changed.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) adapt(who queue.Scheduled, changed bool) {
+	policy := q.Adaptive
+	if policy == nil {
+		return
+	}
+	every := q.Queue.Frequency(who.Name, 0)
+	if every <= 0 && !who.Next.IsZero() && !who.Taken.IsZero() {
+		every = who.Next.Sub(who.Taken)
+	}
+	if every <= 0 {
+		every = policy.Floor
+	}
+	factor := policy.Factor
+	if factor <= 1 {
+		factor = 2
+	}
+	if changed {
+		every = time.Duration(float64(every) / factor)
+	} else {
+		every = time.Duration(float64(every) * factor)
+	}
+	if every < policy.Floor {
+		every = policy.Floor
+	}
+	if policy.Ceiling > 0 && every > policy.Ceiling {
+		every = policy.Ceiling
+	}
+	if every > 0 {
+		q.Queue.SetFrequency(who.Name, every)
+	}
+}
+
+// unchanged reports whether the fingerprint of the item the queue scheduled matches when it was last sent.
+//
+// Adapts how often to send the item when it was sent before, see Adaptive.
+func (q *ItemQueue[T]) unchanged(who queue.Scheduled) bool {
+	name := who.Name
+	q.lock.RLock()
+	fp, ok := q.prints[name]
+	log := q.log
+	q.lock.RUnlock()
+	if !ok {
+		return false
+	}
+	current, err := fp.fn()
+	if err != nil {
+		if log != nil {
+			log.WithError(err).WithField("name", name).Warning("Failed to fingerprint item")
+		}
+		return false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if fp.sent != nil {
+		same := *fp.sent == current
+		q.adapt(who, !same)
+		if same {
+			return true
+		}
+	}
+	fp.taken = &current
+	return false
+}
+
+// SetGate checks gate before sending the named item each time it is ready, such as
+// whether a bucket it reads exists yet, so receivers are not sent work they would reject.
+//
+// Sends call gate with their context. When it returns false they send the item
+// again GateRetry later rather than sending it now. When it returns an error they
+// log it and send the item anyway. A nil gate sends the item whenever it is ready.
+func (q *ItemQueue[T]) SetGate(name string, gate func(context.Context) (bool, error)) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	if gate == nil {
+		delete(q.gates, name)
+		return nil
+	}
+	if q.gates == nil {
+		q.gates = map[string]func(context.Context) (bool, error){}
+	}
+	q.gates[name] = gate
+	return nil
+}
+
+// gated reports whether the gate of the named item is closed, in which case
+// it reschedules the item GateRetry from now, see SetGate.
+func (q *ItemQueue[T]) gated(ctx context.Context, name string) bool {
+	q.lock.RLock()
+	gate, ok := q.gates[name]
+	log := q.log
+	q.lock.RUnlock()
+	if !ok {
+		return false
+	}
+	open, err := gate(ctx)
+	if err != nil {
+		if log != nil {
+			log.WithError(err).WithField("name", name).Warning("Failed to check gate, sending item")
+		}
+		return false
+	}
+	if open {
+		return false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[name]; !ok {
+		return true
+	}
+	retry := q.GateRetry
+	if retry <= 0 {
+		retry = time.Minute
+	}
+	when := q.now().Add(retry)
+	if err := q.Queue.Release(name, when); err != nil {
+		q.Queue.Fix(name, when, true)
+	}
+	q.notify(Rescheduled, name, when)
+	if log != nil {
+		log.WithField("name", name).WithField("next", when).Debug("Gate closed, rescheduled item")
+	}
+	return true
+}
+
+// Lease the named item for d, such as after a receiver claims it, so sends skip it
+// until the lease expires even when it becomes ready or is poked sooner.
+//
+// Sends that take a leased item send it again once the lease expires instead.
+// A later Lease replaces the lease, and a non-positive d ends it.
+func (q *ItemQueue[T]) Lease(name string, d time.Duration) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	if d <= 0 {
+		delete(q.leases, name)
+		return nil
+	}
+	if q.leases == nil {
+		q.leases = map[string]time.Time{}
+	}
+	q.leases[name] = q.now().Add(d)
+	return nil
+}
+
+// leased reports whether the named item is under an unexpired lease, in which case
+// it reschedules the item for when the lease expires, see Lease.
+func (q *ItemQueue[T]) leased(name string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	until, ok := q.leases[name]
+	if !ok {
+		return false
+	}
+	if !q.now().Before(until) {
+		delete(q.leases, name)
+		return false
+	}
+	if err := q.Queue.Release(name, until); err != nil {
+		q.Queue.Fix(name, until, true)
+	}
+	q.notify(Rescheduled, name, until)
+	if q.log != nil {
+		q.log.WithField("name", name).WithField("next", until).Debug("Leased, rescheduled item")
+	}
+	return true
+}
+
+// activeHours of an item each day, see SetActiveHours.
+type activeHours struct {
+	tz         *time.Location
+	start, end time.Duration // since midnight
+}
+
+// next returns when the window is next open at or after now.
+func (h activeHours) next(now time.Time) time.Time {
+	local := now.In(h.tz)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, h.tz)
+	since := local.Sub(midnight)
+	switch {
+	case h.start == h.end:
+		return now
+	case h.start < h.end && since >= h.start && since < h.end:
+		return now
+	case h.start > h.end && (since >= h.start || since < h.end):
+		return now
+	case since < h.start:
+		return midnight.Add(h.start)
+	}
+	return midnight.AddDate(0, 0, 1).Add(h.start)
+}
+
+// SetActiveHours only sends the named item from start until end after midnight each day in tz,
+// such as during the working hours of the team reading a dashboard. A nil tz is UTC.
+//
+// Sends that take the item outside its window send it again once the window next opens
+// instead. A window ending before it starts spans midnight, and one ending when it starts
+// never closes. Zero start and end clear the window.
+func (q *ItemQueue[T]) SetActiveHours(name string, tz *time.Location, start, end time.Duration) error {
+	if start < 0 || start > 24*time.Hour || end < 0 || end > 24*time.Hour {
+		return fmt.Errorf("active hours %v to %v not within a day", start, end)
+	}
+	if tz == nil {
+		tz = time.UTC
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	if start == 0 && end == 0 {
+		delete(q.hours, name)
+		return nil
+	}
+	if q.hours == nil {
+		q.hours = map[string]activeHours{}
+	}
+	q.hours[name] = activeHours{tz: tz, start: start, end: end}
+	return nil
+}
+
+// inactive reports whether the named item is outside its active hours, in which case
+// it reschedules the item for when they next start, see SetActiveHours.
+func (q *ItemQueue[T]) inactive(name string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	hours, ok := q.hours[name]
+	if !ok {
+		return false
+	}
+	now := q.now()
+	when := hours.next(now)
+	if !when.After(now) {
+		return false
+	}
+	if err := q.Queue.Release(name, when); err != nil {
+		q.Queue.Fix(name, when, true)
+	}
+	q.notify(Rescheduled, name, when)
+	if q.log != nil {
+		q.log.WithField("name", name).WithField("next", when).Debug("Outside active hours, rescheduled item")
+	}
+	return true
+}
+
+// SetDeadline removes the named item instead of sending it once it becomes ready after deadline.
+//
+// A zero deadline sends the item whenever it is ready.
+func (q *ItemQueue[T]) SetDeadline(name string, deadline time.Time) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	if deadline.IsZero() {
+		delete(q.deadline, name)
+		return nil
+	}
+	if q.deadline == nil {
+		q.deadline = map[string]time.Time{}
+	}
+	q.deadline[name] = deadline
+	return nil
+}
+
+// expire removes the named item when the current time is past its deadline.
+func (q *ItemQueue[T]) expire(name string) bool {
+	q.lock.Lock()
+	deadline, ok := q.deadline[name]
+	if !ok || !q.now().After(deadline) {
+		q.lock.Unlock()
+		return false
+	}
+	q.remove(name)
+	obs := q.observer
+	mets := q.metrics
+	log := q.log
+	q.lock.Unlock()
+	if log != nil {
+		log.WithField("name", name).WithField("deadline", deadline).Info("Removed item past its deadline")
+	}
+	mets.expired()
+	if o, ok := obs.(DeadlineObserver); ok {
+		o.OnExpire(name, deadline)
+	} else if obs != nil {
+		obs.OnSkip(name)
+	}
+	return true
+}
+
+// SetCron reschedules the named item at the times of a standard cron spec, such as "0 * * * *" for hourly,
+// rather than frequency after it is sent. An empty spec uses frequency again.
+//
+// Returns an error for a missing item or an invalid spec, leaving the item unchanged.
+func (q *ItemQueue[T]) SetCron(name, spec string) error {
+	if spec == "" {
+		return q.Queue.SetSchedule(name, nil)
+	}
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("parse %q: %w", spec, err)
+	}
+	return q.Queue.SetSchedule(name, sched)
+}
+
+// Poke the named item, so that it is sent as soon as possible.
+//
+// Does nothing when the item was already poked within PokeWindow.
+// Sends an item awaiting acknowledgment once it is acknowledged instead,
+// see SendAck, so a poke never sends an item twice at once.
+// Also returns a dead-lettered item to the rotation.
+func (q *ItemQueue[T]) Poke(name string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	now := q.now()
+	if !q.dead[name] {
+		if when, ok := q.poked[name]; ok && q.PokeWindow > 0 && now.Sub(when) < q.PokeWindow {
+			return nil
+		}
+		if err := q.Queue.Poke(name); err != nil {
+			return err
+		}
+		q.setPoked(name, now)
+		when, _ := q.Queue.When(name)
+		q.notify(Rescheduled, name, when)
+		return nil
+	}
+	delete(q.dead, name)
+	delete(q.failures, name)
+	q.setPoked(name, now)
+	if err := q.Queue.Release(name, now); err != nil {
+		return err
+	}
+	q.notify(Rescheduled, name, now)
+	return nil
+}
+
+// setPoked records when the named item was poked, when coalescing pokes.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) setPoked(name string, when time.Time) {
+	if q.PokeWindow <= 0 {
+		return
+	}
+	if q.poked == nil {
+		q.poked = map[string]time.Time{}
+	}
+	q.poked[name] = when
+}
+
+// Reschedule the named item to next be sent at when, either earlier or later.
+//
+// Unlike Poke, which only sends an item sooner, this can also delay an item.
+func (q *ItemQueue[T]) Reschedule(name string, when time.Time) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	if err := q.Queue.Fix(name, when, true); err != nil {
+		return err
+	}
+	q.notify(Rescheduled, name, when)
+	return nil
+}
+
+// Pause sending the named item until it is resumed.
+//
+// The item remains in the queue and is still reported by Status and Schedule.
+// Cancels the context of its last emit, see Emit.Context.
+func (q *ItemQueue[T]) Pause(name string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	q.cancelEmit(name)
+	return q.Queue.SetPaused(name, true)
+}
+
+// Resume sending the named item, as soon as possible unless ResumeKeepsSchedule is set.
+func (q *ItemQueue[T]) Resume(name string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	if err := q.Queue.SetPaused(name, false); err != nil {
+		return err
+	}
+	if q.ResumeKeepsSchedule {
+		return nil
+	}
+	return q.Queue.Fix(name, q.now(), false)
+}
+
+// SetClock changes the clock used to tell time, which defaults to the system clock.
+//
+// Also changes the clock of the underlying queue, so tests can step a fake.Clock
+// to observe rescheduling rather than waiting for each frequency.
+func (q *ItemQueue[T]) SetClock(c clock.Clock) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.clock = c
+	q.Queue.SetClock(c)
+}
+
+// now returns the current time according to the clock.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) now() time.Time {
+	if q.clock == nil {
+		return time.Now()
+	}
+	return q.clock.Now()
+}
+
+// backoff returns how long to wait before retrying an item after consecutive failures.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) backoff(failures int) time.Duration {
+	return exponential(q.BackoffBase, q.BackoffMax, failures)
+}
+
+// exponential returns base doubled after each of n-1 failures, capped at max when non-zero.
+func exponential(base, max time.Duration, n int) time.Duration {
+	delay := base
+	for i := 1; i < n && delay > 0; i++ {
+		if max > 0 && delay >= max || delay > math.MaxInt64/2 {
+			break
+		}
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// ack reschedules the named item after a receiver acknowledges it.
+//
+// Returns when the item is next sent, or true when the item failed too many
+// times and was dead-lettered instead, which only happens when dead is set.
+func (q *ItemQueue[T]) ack(name string, frequency time.Duration, err error, dead bool) (time.Time, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	when := q.now()
+	if err == nil {
+		q.sent(name, when)
+		delete(q.failures, name)
+		when = q.Queue.NextAfter(name, when, frequency)
+		q.Queue.Release(name, when)
+		return q.released(name, when), false
+	}
+	if q.failures == nil {
+		q.failures = map[string]int{}
+	}
+	q.failures[name]++
+	if dead && q.MaxFailures > 0 && q.failures[name] >= q.MaxFailures {
+		if q.dead == nil {
+			q.dead = map[string]bool{}
+		}
+		q.dead[name] = true
+		return time.Time{}, true
+	}
+	when = when.Add(q.backoff(q.failures[name]))
+	q.Queue.Release(name, when)
+	return q.released(name, when), false
+}
+
+// released returns when the named item is next sent after releasing it at when,
+// which is sooner when it was poked while awaiting acknowledgment.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) released(name string, when time.Time) time.Time {
+	if next, ok := q.Queue.When(name); ok {
+		return next
+	}
+	return when
+}
+
+// Observer is notified of what the queue sends.
+//
+// The queue calls the observer without holding its lock,
+// so the observer may call back into the queue.
+type Observer interface {
+	// OnSend is called once an item is sent to a receiver at the specified time.
+	OnSend(name string, at time.Time)
+	// OnReschedule is called once the item is rescheduled to next be sent at the specified time.
+	OnReschedule(name string, next time.Time)
+	// OnSkip is called when the queue skips sending an item which was removed.
+	OnSkip(name string)
+}
+
+// DeadlineObserver is an Observer which is also notified of items removed by SetDeadline.
+type DeadlineObserver interface {
+	Observer
+	// OnExpire is called instead of OnSkip when the queue removes an item ready after its deadline.
+	OnExpire(name string, deadline time.Time)
+}
+
+// SetMaxInFlight limits SendAck to n deliveries which receivers have not yet acked,
+// or removes the limit when n is not positive.
+//
+// Unlike SetLimiter, which paces how often items are sent, this bounds how many
+// items receivers process concurrently: SendAck waits for an Ack before sending
+// another item, or for the context to expire. Deliveries sent before the limit
+// changes count against the limit they were sent with.
+func (q *ItemQueue[T]) SetMaxInFlight(n int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if n <= 0 {
+		q.slots = nil
+		return
+	}
+	q.slots = make(chan struct{}, n)
+}
+
+// SetReadyLess orders items which are ready at the same priority by less, or by
+// the default order again when nil, such as by when each was last sent or by a
+// field of their config.
+//
+// Never reorders items which are not yet ready. Less must be a strict weak
+// ordering: items where neither is less than the other keep their default order,
+// see queue.Queue.SetReadyLess. Must not call the queue.
+func (q *ItemQueue[T]) SetReadyLess(less func(a, b T) bool) {
+	if less == nil {
+		q.Queue.SetReadyLess(nil)
+		return
+	}
+	q.Queue.SetReadyLess(func(a, b string) bool {
+		items := q.published() // without the lock, which the queue may be waiting for
+		x, xok := items[a]
+		y, yok := items[b]
+		return xok && yok && less(x, y)
+	})
+}
+
+// SetObserver notifies o of what Send does, or stops notifying when nil.
+func (q *ItemQueue[T]) SetObserver(o Observer) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.observer = o
+}
+
+// Tracer starts a span as sends deliver each item, such as an adapter for an OpenTelemetry trace.Tracer.
+type Tracer interface {
+	// Start a span for delivering the named item while the queue has depth items,
+	// returning a context containing the span.
+	Start(ctx context.Context, name string, depth int) (context.Context, Span)
+}
+
+// Span is started by a Tracer.
+type Span interface {
+	// End the span, once the item is handed to a receiver or acked.
+	End()
+}
+
+// SetTracer starts a span for each item sends deliver, or stops tracing when nil.
+func (q *ItemQueue[T]) SetTracer(t Tracer) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.tracer = t
+}
+
+// trace starts a span for delivering the item the queue scheduled, returning its context and how to end it.
+func (q *ItemQueue[T]) trace(ctx context.Context, who queue.Scheduled) (context.Context, func()) {
+	q.lock.RLock()
+	tracer := q.tracer
+	q.lock.RUnlock()
+	if tracer == nil {
+		return ctx, func() {}
+	}
+	ctx, span := tracer.Start(ctx, who.Name, who.Depth)
+	return ctx, span.End
+}
+
+// SetLimiter makes sends wait for limiter before sending each item, smoothing the overall rate.
+//
+// Items stay at their current time while waiting. A nil limiter removes the limit.
+func (q *ItemQueue[T]) SetLimiter(limiter *rate.Limiter) {
+	if limiter == nil {
+		q.Queue.SetLimiter(nil)
+		return
+	}
+	q.Queue.SetLimiter(limiter)
+}
+
+// SetRamp makes sends start at start items per second once they begin, increasing the rate
+// linearly to target over d and holding it there, such as to warm up a backend which has
+// just started before sending it everything due. Replaces any limiter, see SetLimiter.
+//
+// The ramp begins when a send first waits for it, so calling SetRamp again starts over.
+func (q *ItemQueue[T]) SetRamp(start, target float64, d time.Duration) {
+	q.lock.RLock()
+	clk := q.clock
+	q.lock.RUnlock()
+	q.Queue.SetLimiter(queue.NewRamp(clk, start, target, d))
+}
+
+// SetMetrics reports what Send does to the specified metrics, or stops reporting when nil.
+func (q *ItemQueue[T]) SetMetrics(mets *QueueMetrics) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.metrics = mets
+}
+
+// SetDepthThreshold calls cb once more than n items are overdue, with how many are.
+//
+// Overdue items are ready but not yet sent, so exceeding the threshold means
+// receivers are not keeping up. Sends check the backlog each time they take an
+// item, calling cb when it rises above n, and then only again once it falls
+// back to n or below first. A nil cb stops calling.
+// Also reports the backlog to the Overdue metric, see SetMetrics.
+func (q *ItemQueue[T]) SetDepthThreshold(n int, cb func(depth int)) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.threshold = n
+	q.onThreshold = cb
+	q.overThreshold = false
+}
+
+// backlog reports how many items are overdue to metrics and to any depth threshold.
+func (q *ItemQueue[T]) backlog() {
+	q.lock.Lock()
+	cb, mets := q.onThreshold, q.metrics
+	if cb == nil && mets == nil {
+		q.lock.Unlock()
+		return
+	}
+	n := q.Queue.Overdue()
+	over := n > q.threshold
+	crossed := over && !q.overThreshold
+	q.overThreshold = over
+	q.lock.Unlock()
+	mets.overdue(n)
+	if crossed && cb != nil {
+		cb(n)
+	}
+}
+
+// Status of the queue: depth, next item and when the next item is ready.
+//
+// Reads without waiting for Send and other writers, so it may briefly miss
+// an item added or removed concurrently.
+func (q *ItemQueue[T]) Status() (int, T, time.Time) {
+	var item T
+	n, who, when := q.Queue.Status()
+	if who != nil {
+		item, _ = q.load(*who, q.published()[*who])
+	}
+	return n, item, when
+}
+
+// HeadStatus of the queue: depth, name of the next item and when it is ready, like Status.
+//
+// Reports an empty name when the queue is empty. Reads the depth and next
+// item together, so they are consistent with each other.
+func (q *ItemQueue[T]) HeadStatus() (int, string, time.Time) {
+	n, who, when := q.Queue.Status()
+	if who == nil {
+		return n, "", when
+	}
+	return n, *who, when
+}
+
+// QueueReader is a read-only view of a queue, such as a TestGroupQueue, for consumers
+// which only observe the schedule and should not change it.
+type QueueReader[T Named] interface {
+	Status() (int, T, time.Time)
+	StatusOf(name string) (T, ItemStatus, bool)
+	Len() int
+	Schedule() []GroupSchedule
+}
+
+// StatusReporter is a queue whose status MultiStatus aggregates, such as a
+// TestGroupQueue or DashboardQueue.
+type StatusReporter interface {
+	HeadStatus() (int, string, time.Time)
+}
+
+// QueueStatus of one of the queues MultiStatus aggregates.
+type QueueStatus struct {
+	Queue string
+	Depth int
+	// Next names the next item, or is empty when the queue is empty.
+	Next string
+	When time.Time
+}
+
+// MultiStatus returns the status of every queue by its name, sorted by name,
+// such as for a debug page showing several queues of a server.
+//
+// Reads each queue in turn, so their statuses need not be from the same instant.
+func MultiStatus(queues map[string]StatusReporter) []QueueStatus {
+	statuses := make([]QueueStatus, 0, len(queues))
+	for name, q := range queues {
+		depth, next, when := q.HeadStatus()
+		statuses = append(statuses, QueueStatus{Queue: name, Depth: depth, Next: next, When: when})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Queue < statuses[j].Queue
+	})
+	return statuses
+}
+
+// HeadReady returns the next item, as Status does, and whether it is ready by the queue's clock, see SetClock.
+//
+// Returns a nil item and false when the queue is empty.
+func (q *ItemQueue[T]) HeadReady() (T, bool) {
+	_, item, when := q.Status()
+	if isNil(item) {
+		return item, false
+	}
+	q.lock.RLock()
+	now := q.now()
+	q.lock.RUnlock()
+	return item, !when.After(now)
+}
+
+// ItemStatus of an item, see StatusOf.
+type ItemStatus struct {
+	// When the item is next ready.
+	When time.Time
+	// Trigger is why the item was last sent, such as on schedule or because it was poked,
+	// when Triggered is set.
+	Trigger queue.Trigger
+	// Triggered is set once the item was sent.
+	Triggered bool
+	// Draining is set while RemoveAfter is removing the item, which it does at RemoveAt.
+	Draining bool
+	RemoveAt time.Time
+}
+
+// StatusOf the named item: the item, its status and whether it is in the queue.
+//
+// Like Status, may briefly miss an item added or removed concurrently.
+func (q *ItemQueue[T]) StatusOf(name string) (T, ItemStatus, bool) {
+	var item T
+	when, ok := q.Queue.When(name)
+	if !ok {
+		return item, ItemStatus{When: when}, false
+	}
+	item, ok = q.published()[name]
+	if !ok {
+		return item, ItemStatus{}, false
+	}
+	item, _ = q.load(name, item)
+	st := ItemStatus{When: when}
+	st.Trigger, st.Triggered = q.Queue.LastTrigger(name)
+	q.lock.RLock()
+	if r, ok := q.removing[name]; ok {
+		st.Draining, st.RemoveAt = true, r.until
+	}
+	q.lock.RUnlock()
+	return item, st, true
+}
+
+// GroupSchedule describes when the named item is next sent.
+type GroupSchedule struct {
+	Name string
+	When time.Time
+	// LastSent is when the item was last sent successfully, or zero if never.
+	LastSent time.Time
+	// Generation of the queue the item was in, see Snapshot, or zero when unknown.
+	Generation uint64
+	// Labels of the item, see SetLabels, or nil when it has none.
+	Labels map[string]string
+}
+
+// Schedule returns when each item is next sent, in no particular order.
+func (q *ItemQueue[T]) Schedule() []GroupSchedule {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	current := q.Queue.Current()
+	schedule := make([]GroupSchedule, 0, len(current))
+	for name, when := range current {
+		if _, ok := q.items[name]; !ok {
+			continue
+		}
+		schedule = append(schedule, GroupSchedule{Name: name, When: when, LastSent: q.lastSent[name], Labels: q.labelsOf(name)})
+	}
+	return schedule
+}
+
+// ScheduleWithLabels returns when each item whose labels match every one of sel
+// is next sent, in no particular order, such as the groups of a single team.
+//
+// An empty sel matches every item, like Schedule.
+func (q *ItemQueue[T]) ScheduleWithLabels(sel map[string]string) []GroupSchedule {
+	schedule := q.Schedule()
+	matched := schedule[:0]
+	for _, gs := range schedule {
+		if matches(gs.Labels, sel) {
+			matched = append(matched, gs)
+		}
+	}
+	return matched
+}
+
+// matches returns true when labels has every label of sel.
+func matches(labels, sel map[string]string) bool {
+	for k, v := range sel {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SetLabels of the named item, such as its team or release, replacing any earlier ones,
+// so ScheduleWithLabels can select it. Empty labels clear them.
+//
+// Labels are kept while Init or Update keep the item, and dropped once it is removed.
+func (q *ItemQueue[T]) SetLabels(name string, labels map[string]string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
+	}
+	if len(labels) == 0 {
+		delete(q.labels, name)
+		return nil
+	}
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	if q.labels == nil {
+		q.labels = map[string]map[string]string{}
+	}
+	q.labels[name] = copied
+	return nil
+}
+
+// Labels of the named item, see SetLabels, or nil when it has none.
+func (q *ItemQueue[T]) Labels(name string) map[string]string {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.labelsOf(name)
+}
+
+// labelsOf returns a copy of the labels of the named item.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) labelsOf(name string) map[string]string {
+	labels, ok := q.labels[name]
+	if !ok {
+		return nil
+	}
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+// Peek returns up to the next n items in the order they are scheduled.
+//
+// Leaves the queue unchanged, see queue.Queue.Peek.
+func (q *ItemQueue[T]) Peek(n int) []T {
+	names := q.Queue.Peek(n)
+	items := q.published()
+	var found []T
+	for _, name := range names {
+		item, ok := items[name]
+		if !ok {
+			continue
+		}
+		if item, ok = q.load(name, item); ok {
+			found = append(found, item)
+		}
+	}
+	return found
+}
+
+// WithinWindow returns when each item ready within d of now is next sent, in the order they
+// are scheduled, including any items already ready.
+//
+// Leaves the queue unchanged like Peek, but bounded by time rather than count.
+func (q *ItemQueue[T]) WithinWindow(d time.Duration) []GroupSchedule {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	end := q.now().Add(d)
+	var schedule []GroupSchedule
+	for name, when := range q.Queue.Current() {
+		if _, ok := q.items[name]; !ok || when.After(end) {
+			continue
+		}
+		schedule = append(schedule, GroupSchedule{Name: name, When: when, LastSent: q.lastSent[name]})
+	}
+	sort.Slice(schedule, func(i, j int) bool {
+		if !schedule[i].When.Equal(schedule[j].When) {
+			return schedule[i].When.Before(schedule[j].When)
+		}
+		return schedule[i].Name < schedule[j].Name
+	})
+	return schedule
+}
+
+// Generation counts how many times Init or Update changed which items the queue contains,
+// starting at one after the first Init.
+func (q *ItemQueue[T]) Generation() uint64 {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.gen
+}
+
+// Snapshot returns when each item is next sent, sorted by name, along with the Generation.
+//
+// Pass the snapshot to Restore to preserve the schedule, which rejects it once
+// the queue is reinitialized since. Persist the snapshot and clear its generation
+// to restore it after a restart instead, since each queue counts its own.
+func (q *ItemQueue[T]) Snapshot() []GroupSchedule {
+	q.lock.RLock()
+	gen := q.gen
+	q.lock.RUnlock()
+	snapshot := q.Schedule()
+	for i := range snapshot {
+		snapshot[i].Generation = gen
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Name < snapshot[j].Name
+	})
+	return snapshot
+}
+
+// Reset the queue to empty, removing every item along with everything tracked about it,
+// such as how many times each was sent, so the queue is ready for a fresh Init.
+//
+// Like Drain, a running send skips any item it already took off the queue but has not
+// yet sent, and then waits for items to be added again. Keeps settings, metrics and
+// watches, and counts as a new Generation. EmitIDs keep increasing across resets.
+func (q *ItemQueue[T]) Reset() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.publish()
+	for name := range q.items {
+		q.remove(name)
+	}
+	if q.drained != nil {
+		close(q.drained)
+		q.drained = nil
+	}
+	q.gen++
+	q.counts = nil
+	q.lastAny = time.Time{}
+	q.overThreshold = false
+	q.waits = nil
+	q.waited = 0
+	q.history = nil
+}
+
+// Drain removes every item from the queue, returning when each one was next going to be sent, sorted by name.
+//
+// Unlike Snapshot, leaves the queue empty so Send emits nothing more until
+// items are added again. A running Send skips any drained item it already
+// took off the queue but has not yet sent, so no item is both drained and sent.
+// Pass the result to Restore in another process to hand off the schedule,
+// which is why it leaves the Generation of each item unknown.
+func (q *ItemQueue[T]) Drain() []GroupSchedule {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.publish()
+	current := q.Queue.Current()
+	drained := make([]GroupSchedule, 0, len(current))
+	for name, when := range current {
+		if _, ok := q.items[name]; !ok {
+			continue
+		}
+		drained = append(drained, GroupSchedule{Name: name, When: when, LastSent: q.lastSent[name]})
+	}
+	for name := range q.items {
+		q.remove(name)
+	}
+	if q.drained != nil {
+		close(q.drained)
+		q.drained = nil
+	}
+	sort.Slice(drained, func(i, j int) bool {
+		return drained[i].Name < drained[j].Name
+	})
+	return drained
+}
+
+// draining returns a channel closed by the next Drain.
+func (q *ItemQueue[T]) draining() <-chan struct{} {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.drained == nil {
+		q.drained = make(chan struct{})
+	}
+	return q.drained
+}
+
+// Restore the schedule of each item in a snapshot, after calling Init.
+//
+// Ignores items in the snapshot which are not in the queue, and leaves
+// items missing from the snapshot at the time they were added.
+// Returns an error rather than restoring anything when an item has a known
+// Generation other than the current one, so a stale snapshot is never applied.
+func (q *ItemQueue[T]) Restore(snapshot []GroupSchedule) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, gs := range snapshot {
+		if gs.Generation != 0 && gs.Generation != q.gen {
+			return fmt.Errorf("%q: stale generation %d, currently %d", gs.Name, gs.Generation, q.gen)
+		}
+	}
+	whens := make(map[string]time.Time, len(snapshot))
+	for _, gs := range snapshot {
+		if _, ok := q.items[gs.Name]; !ok {
+			continue
+		}
+		whens[gs.Name] = gs.When
+	}
+	q.Queue.FixAll(whens, true)
+	return nil
+}
+
+// Send items to receivers until the context expires.
+//
+// Pops items off the queue when frequency is zero, unless ZeroFrequency is
+// queue.RepeatAtZero, which sends them again as soon as possible instead.
+// Otherwise reschedules the item after the specified frequency has elapsed,
+// or after the item's own frequency when overridden with SetFrequency.
+//
+// Any number of goroutines may receive from receivers concurrently.
+// Each item is sent to exactly one of them, and is rescheduled when Send
+// takes it off the queue, not once the receiver finishes processing it.
+// Returns an error naming the item being sent if receivers is closed,
+// and an error right away if receivers is nil.
+// Delays rescheduled items like SendWithJitter when created WithJitter.
+// Sends overdue items once more before returning when FlushTimeout is set.
+func (q *ItemQueue[T]) Send(ctx context.Context, receivers chan<- T, frequency time.Duration) error {
+	q.lock.RLock()
+	jitter := q.jitter
+	q.lock.RUnlock()
+	return q.SendWithJitter(ctx, receivers, frequency, jitter)
+}
+
+// SendWithJitter sends items to receivers until the context expires.
+//
+// Behaves like Send, except it delays each rescheduled item by a random
+// duration in [0, jitter). A zero jitter is identical to Send.
+func (q *ItemQueue[T]) SendWithJitter(ctx context.Context, receivers chan<- T, frequency, jitter time.Duration) error {
+	q.lock.RLock()
+	flushing := q.FlushTimeout > 0
+	q.lock.RUnlock()
+	if !flushing {
+		return q.sendItems(ctx, receivers, sendItemsOptions[T]{}, func(ctx context.Context, ch chan<- queue.Scheduled) error {
+			return q.Queue.SendScheduled(ctx, ch, frequency, jitter)
+		})
+	}
+	// Put back items taken but not sent when the context expires, so the flush sends them.
+	err := q.sendItems(ctx, receivers, sendItemsOptions[T]{graceful: true}, func(ctx context.Context, ch chan<- queue.Scheduled) error {
+		return q.Queue.SendGraceful(ctx, ch, frequency, jitter)
+	})
+	if receivers != nil && ctx.Err() != nil {
+		q.flush(receivers, frequency)
+	}
+	return err
+}
+
+// flush sends receivers every overdue item until none are left or FlushTimeout
+// elapses, putting back the item it was sending when it runs out of time.
+func (q *ItemQueue[T]) flush(receivers chan<- T, frequency time.Duration) {
+	q.lock.RLock()
+	timeout := q.FlushTimeout
+	q.lock.RUnlock()
+	if timeout <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for ctx.Err() == nil {
+		who, ok := q.Queue.TryNext(frequency)
+		if !ok {
+			return
+		}
+		item, ok := q.take(ctx, *who, nil)
+		if !ok {
+			continue
+		}
+		var sent bool
+		err := guard(who.Name, func() {
+			select {
+			case <-ctx.Done():
+			case receivers <- item:
+				sent = true
+			}
+		})
+		if err != nil || !sent {
+			// Push it back when taking it popped it, see queue.PopAtZero.
+			if err := q.Queue.Release(who.Name, who.When); err != nil {
+				q.Queue.Fix(who.Name, who.When, false)
+			}
+			return
+		}
+		q.delivered(*who, nil)
+	}
+}
+
+// SendGraceful sends items to receivers like Send until the context expires,
+// then calls flush when set with a Snapshot of the queue, and returns.
+//
+// Unlike Send, it does not skip items it took off the queue but could not
+// send before the context expired. Instead it puts them back at the time
+// they were scheduled, so the next send sends them first.
+func (q *ItemQueue[T]) SendGraceful(ctx context.Context, receivers chan<- T, frequency time.Duration, flush func([]GroupSchedule)) error {
+	err := q.sendItems(ctx, receivers, sendItemsOptions[T]{graceful: true}, func(ctx context.Context, ch chan<- queue.Scheduled) error {
+		return q.Queue.SendGraceful(ctx, ch, frequency, 0)
+	})
+	if flush != nil {
+		flush(q.Snapshot())
+	}
+	return err
+}
+
+// SendWithStats behaves like Send, additionally recording what it sends to stats.
+//
+// Stats may be read while Send is running.
+func (q *ItemQueue[T]) SendWithStats(ctx context.Context, receivers chan<- T, frequency time.Duration, stats *SendStats) error {
+	return q.sendItems(ctx, receivers, sendItemsOptions[T]{stats: stats}, func(ctx context.Context, ch chan<- queue.Scheduled) error {
+		return q.Queue.SendScheduled(ctx, ch, frequency, 0)
+	})
+}
+
+// DropPolicy controls what a send does when no receiver is ready for an item.
+type DropPolicy int
+
+const (
+	// Block waits for a receiver, or for the context to expire.
+	Block DropPolicy = iota
+	// DropNewest skips sending the item, leaving it at the time the send rescheduled it.
+	DropNewest
+	// DropAndReschedule skips sending the item and reschedules it frequency after the drop,
+	// even when the item has its own frequency.
+	DropAndReschedule
+)
+
+// SendWithPolicy behaves like SendWithStats, except policy decides what to do
+// when no receiver is ready for an item.
+//
+// Stats counts any dropped items, and may be nil.
+func (q *ItemQueue[T]) SendWithPolicy(ctx context.Context, receivers chan<- T, frequency time.Duration, policy DropPolicy, stats *SendStats) error {
+	opts := sendItemsOptions[T]{
+		stats:     stats,
+		policy:    policy,
+		frequency: frequency,
+	}
+	return q.sendItems(ctx, receivers, opts, func(ctx context.Context, ch chan<- queue.Scheduled) error {
+		return q.Queue.SendScheduled(ctx, ch, frequency, 0)
+	})
+}
+
+// Next blocks until an item is ready, then returns it.
+//
+// Reschedules the item PullFrequency later, skipping removed items like Send.
+// May be called repeatedly, but not while a Send is running on the same queue.
+func (q *ItemQueue[T]) Next(ctx context.Context) (T, error) {
+	ctx, release, err := q.open(ctx)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	defer release()
+	for {
+		who, err := q.Queue.Next(ctx, q.PullFrequency)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		item, ok := q.take(ctx, *who, nil)
+		if !ok {
+			continue
+		}
+		q.delivered(*who, nil)
+		return item, nil
+	}
+}
+
+// NextBatch blocks until an item is ready, then returns up to n distinct items ready by then,
+// for receivers that pipeline their work.
+//
+// Returns fewer than n items rather than waiting for more to be ready, and
+// at most one when n is not positive. Otherwise behaves like Next.
+func (q *ItemQueue[T]) NextBatch(ctx context.Context, n int) ([]T, error) {
+	ctx, release, err := q.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	for {
+		whos, err := q.Queue.NextBatch(ctx, q.PullFrequency, n)
+		if err != nil {
+			return nil, err
+		}
+		batch := make([]T, 0, len(whos))
+		for _, who := range whos {
+			item, ok := q.take(ctx, who, nil)
+			if !ok {
+				continue
+			}
+			q.delivered(who, nil)
+			batch = append(batch, item)
+		}
+		if len(batch) > 0 {
+			return batch, nil
+		}
+	}
+}
+
+// TryNext returns the next ready item like Next, or false right away when no item is ready
+// or the queue is closed.
+//
+// Reschedules the item PullFrequency later and skips removed items like Next,
+// without waiting, so consumers can pull items from their own select loop.
+func (q *ItemQueue[T]) TryNext() (T, bool) {
+	var zero T
+	q.lock.RLock()
+	closed := q.closed
+	q.lock.RUnlock()
+	if closed {
+		return zero, false
+	}
+	for {
+		who, ok := q.Queue.TryNext(q.PullFrequency)
+		if !ok {
+			return zero, false
+		}
+		item, ok := q.take(context.Background(), *who, nil)
+		if !ok {
+			continue
+		}
+		q.delivered(*who, nil)
+		return item, true
+	}
+}
+
+// SendOnce sends every item in the queue to receivers exactly once, in the order they
+// are scheduled, then returns.
+//
+// Sends each item right away, ignoring when it is scheduled, unless wait is set,
+// which waits until the item is ready by the queue clock first. Leaves the schedule
+// unchanged, skipping items removed before their turn. Returns when the context
+// expires before sending every item, and an error right away if receivers is nil.
+func (q *ItemQueue[T]) SendOnce(ctx context.Context, receivers chan<- T, wait bool) error {
+	if receivers == nil {
+		return errors.New("nil receivers")
+	}
+	ctx, release, err := q.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	q.lock.RLock()
+	clk := q.clock
+	q.lock.RUnlock()
+	if clk == nil {
+		clk = clock.Real{}
+	}
+	pass := q.Schedule()
+	sort.Slice(pass, func(i, j int) bool {
+		if !pass[i].When.Equal(pass[j].When) {
+			return pass[i].When.Before(pass[j].When)
+		}
+		return pass[i].Name < pass[j].Name
+	})
+	for _, gs := range pass {
+		if d := gs.When.Sub(clk.Now()); wait && d > 0 {
+			timer := clk.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C():
+			}
+		}
+		q.lock.RLock()
+		item, ok := q.items[gs.Name]
+		q.lock.RUnlock()
+		if ok {
+			item, ok = q.load(gs.Name, item)
+		}
+		if !ok {
+			q.skipped(gs.Name)
+			continue
+		}
+		item = q.copied(item)
+		var sent bool
+		err := guard(gs.Name, func() {
+			select {
+			case <-ctx.Done():
+			case receivers <- item:
+				sent = true
+			}
+		})
+		switch {
+		case err != nil:
+			return q.failed(err)
+		case !sent:
+			return ctx.Err()
+		}
+		q.delivered(queue.Scheduled{Name: gs.Name, When: gs.When}, nil)
+	}
+	return nil
+}
+
+// Emit of an item by SendWithIDs.
+type Emit[T Named] struct {
+	Item T
+	// EmitID is unique to this emit and larger than that of any earlier emit by the queue,
+	// so receivers can correlate their logs with each scheduling cycle.
+	EmitID uint64
+	// When the item was scheduled to be sent.
+	When time.Time
+	// Attempt counts this send of the item, starting at one, and after one
+	// more each time SendAck sends it again after a failed Ack.
+	Attempt int
+	// Poked is set when the item is sent because it was poked, see Poke.
+	Poked bool
+	// Trigger is why the item was sent, such as on schedule or because it was poked,
+	// see StatusOf.
+	Trigger queue.Trigger
+	// FirstEmit is set the first time the item is sent since Init, or since a later
+	// Init, Update or Add reintroduced it after it was removed, see EmitCounts.
+	FirstEmit bool
+	// Deadline by which receivers should finish updating the item, so updates take no
+	// longer than the item is sent every: When plus its frequency, see DeadlineFraction.
+	// Zero when the item has no frequency.
+	Deadline time.Time
+	// Heartbeat is set when nothing was sent for HeartbeatInterval, in which case
+	// the emit has no Item or EmitID, When is when it was emitted, and nothing is rescheduled.
+	Heartbeat bool
+	// Context of processing the item, so receivers can stop work the queue no longer wants.
+	// It is cancelled once the item is removed or paused, once the next emit of the item
+	// replaces it, or once SendWithIDs returns, whichever happens first. Heartbeats carry
+	// the context of SendWithIDs.
+	Context context.Context
+}
+
+// SendWithIDs sends each item along with a new EmitID and how it was scheduled to receivers
+// until the context expires, so receivers need not track the context of each emit themselves.
+//
+// Behaves like Send otherwise, including rescheduling each item frequency later.
+func (q *ItemQueue[T]) SendWithIDs(ctx context.Context, receivers chan<- Emit[T], frequency time.Duration) error {
+	if receivers == nil {
+		return errors.New("nil receivers")
+	}
+	ctx, release, err := q.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ch, stop := schedule(ctx, q.Buffer, func(ctx context.Context, ch chan<- queue.Scheduled) error {
+		return q.Queue.SendScheduled(ctx, ch, frequency, 0)
+	})
+	defer stop()
+
+	q.lock.RLock()
+	interval := q.HeartbeatInterval
+	q.lock.RUnlock()
+	for {
+		who, ok, idle := q.await(ch, interval)
+		if idle {
+			q.lock.RLock()
+			now := q.now()
+			q.lock.RUnlock()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case receivers <- Emit[T]{When: now, Heartbeat: true, Context: ctx}:
+			}
+			continue
+		}
+		if !ok {
+			break
+		}
+		drained := q.draining()
+		item, ok := q.take(ctx, who, nil)
+		if !ok {
+			continue
+		}
+		q.lock.Lock()
+		q.emits++
+		emitCtx, cancel := context.WithCancel(ctx)
+		q.cancelEmit(who.Name)
+		if q.inflight == nil {
+			q.inflight = map[string]context.CancelFunc{}
+		}
+		q.inflight[who.Name] = cancel
+		emit := Emit[T]{
+			Item:      item,
+			EmitID:    q.emits,
+			When:      who.When,
+			Attempt:   q.failures[who.Name] + 1,
+			Poked:     who.Poked,
+			Trigger:   who.Trigger,
+			FirstEmit: q.counts[who.Name] == 0,
+			Deadline:  q.deadlineOf(who, frequency),
+			Context:   emitCtx,
+		}
+		q.lock.Unlock()
+		_, end := q.trace(ctx, who)
+		select {
+		case <-ctx.Done():
+			end()
+			return ctx.Err()
+		case <-drained:
+			end()
+			cancel()
+			q.skipped(who.Name)
+			continue
+		case receivers <- emit:
+		}
+		end()
+		q.delivered(who, nil)
+	}
+	return q.failed(stop())
+}
+
+// deadlineOf returns the deadline of the item the queue scheduled, see Emit.Deadline.
+//
+// Caller must hold the lock.
+func (q *ItemQueue[T]) deadlineOf(who queue.Scheduled, frequency time.Duration) time.Time {
+	every := q.Queue.Frequency(who.Name, frequency)
+	if every <= 0 {
+		return time.Time{}
+	}
+	if q.DeadlineFraction > 0 {
+		every = time.Duration(float64(every) * q.DeadlineFraction)
+	}
+	return who.When.Add(every)
+}
+
+// await receives what ch schedules next, unless nothing arrives within interval
+// when it is positive, which reports idle instead, see HeartbeatInterval.
+func (q *ItemQueue[T]) await(ch <-chan queue.Scheduled, interval time.Duration) (queue.Scheduled, bool, bool) {
+	if interval <= 0 {
+		who, ok := <-ch
+		return who, ok, false
+	}
+	q.lock.RLock()
+	clk := q.clock
+	q.lock.RUnlock()
+	if clk == nil {
+		clk = clock.Real{}
+	}
+	timer := clk.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case who, ok := <-ch:
+		return who, ok, false
+	case <-timer.C():
+		return queue.Scheduled{}, false, true
+	}
+}
+
+// SendBatch sends every item ready at the same time to receivers as one batch, until the context expires.
+//
+// Sends at most maxBatch items in each batch when positive, rescheduling
+// each one frequency later like Send. Receivers own each batch they get.
+func (q *ItemQueue[T]) SendBatch(ctx context.Context, receivers chan<- []T, frequency time.Duration, maxBatch int) error {
+	if receivers == nil {
+		return errors.New("nil receivers")
+	}
+	ctx, release, err := q.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ch, stop := schedule(ctx, q.Buffer, func(ctx context.Context, ch chan<- []queue.Scheduled) error {
+		return q.Queue.SendBatch(ctx, ch, frequency, maxBatch)
+	})
+	defer stop()
+
+	for whos := range ch {
+		drained := q.draining()
+		batch := make([]T, 0, len(whos))
+		var sent []queue.Scheduled
+		for _, who := range whos {
+			item, ok := q.take(ctx, who, nil)
+			if !ok {
+				continue
+			}
+			batch = append(batch, item)
+			sent = append(sent, who)
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		ends := make([]func(), 0, len(sent))
+		for _, who := range sent {
+			_, end := q.trace(ctx, who)
+			ends = append(ends, end)
+		}
+		var skipped bool
+		select {
+		case <-ctx.Done():
+		case <-drained:
+			skipped = true
+		case receivers <- batch:
+		}
+		for _, end := range ends {
+			end()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if skipped {
+			for _, who := range sent {
+				q.skipped(who.Name)
+			}
+			continue
+		}
+		for _, who := range sent {
+			q.delivered(who, nil)
+		}
+	}
+	return q.failed(stop())
+}
+
+// SendSharded sends items to receivers until the context expires.
+//
+// Behaves like Send, except it always sends each item to the same one
+// of receivers, chosen by ShardIndex of its name.
+func (q *ItemQueue[T]) SendSharded(ctx context.Context, receivers []chan<- T, frequency time.Duration) error {
+	if len(receivers) == 0 {
+		return errors.New("no receivers")
+	}
+	for i, out := range receivers {
+		if out == nil {
+			return fmt.Errorf("receiver %d: nil", i)
+		}
+	}
+	opts := sendItemsOptions[T]{
+		route: func(item T) (chan<- T, bool) {
+			return receivers[ShardIndex(q.key(item), len(receivers))], true
+		},
+	}
+	return q.sendItems(ctx, nil, opts, func(ctx context.Context, ch chan<- queue.Scheduled) error {
+		return q.Queue.SendScheduled(ctx, ch, frequency, 0)
+	})
+}
+
+// SendBroadcast sends every item to each of receivers until the context expires,
+// so independent consumers each receive every item.
+//
+// Only reschedules an item frequency after sending it once at least quorum of
+// the receivers took it, or all of them when quorum is not positive.
+// Applies policy to each receiver when it is not ready: Block waits for it,
+// whereas DropNewest and DropAndReschedule skip it. An item which fewer than
+// quorum receivers took is dropped and rescheduled frequency later.
+//
+// Every receiver gets the same item unless CopyOnEmit is set, in which case
+// each gets its own copy. Otherwise receivers must not modify the item.
+func (q *ItemQueue[T]) SendBroadcast(ctx context.Context, receivers []chan<- T, frequency time.Duration, quorum int, policy DropPolicy) error {
+	if len(receivers) == 0 {
+		return errors.New("no receivers")
+	}
+	for i, out := range receivers {
+		if out == nil {
+			return fmt.Errorf("receiver %d: nil", i)
+		}
+	}
+	if quorum <= 0 || quorum > len(receivers) {
+		quorum = len(receivers)
+	}
+	ctx, release, err := q.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ch, stop := q.holding(ctx)
+	defer stop()
+
+	for who := range ch {
+		drained := q.draining()
+		item, ok := q.take(ctx, who, nil)
+		if !ok {
+			q.unhold(who.Name, frequency)
+			continue
+		}
+		_, end := q.trace(ctx, who)
+		var accepted int
+		for i, out := range receivers {
+			item := item
+			if i > 0 {
+				item = q.copied(item) // when CopyOnEmit is set
+			}
+			var sent bool
+			err := guard(who.Name, func() {
+				if policy == Block {
+					select {
+					case <-ctx.Done():
+					case <-drained:
+					case out <- item:
+						sent = true
+					}
+					return
+				}
+				select {
+				case out <- item:
+					sent = true
+				default:
+				}
+			})
+			if err != nil {
+				end()
+				return q.failed(err)
+			}
+			if sent {
+				accepted++
+			}
+		}
+		end()
+		if err := ctx.Err(); err != nil && accepted < quorum {
+			q.Queue.Release(who.Name, who.When) // so the next send sends it first
+			return err
+		}
+		if accepted >= quorum {
+			q.delivered(who, nil)
+		} else {
+			q.lock.RLock()
+			mets := q.metrics
+			q.lock.RUnlock()
+			mets.dropped()
+		}
+		q.unhold(who.Name, frequency)
+	}
+	return q.failed(stop())
+}
+
+// SendRouted sends items to receivers until the context expires.
+//
+// Behaves like Send, except it sends each item to the receivers of routes
+// named by classify. Sends items without any route to fallback
+// instead, or skips them when fallback is nil.
+func (q *ItemQueue[T]) SendRouted(ctx context.Context, classify func(T) string, routes map[string]chan<- T, fallback chan<- T, frequency time.Duration) error {
+	for name, out := range routes {
+		if out == nil {
+			return fmt.Errorf("route %q: nil receivers", name)
+		}
+	}
+	opts := sendItemsOptions[T]{
+		route: func(item T) (chan<- T, bool) {
+			if ch, ok := routes[classify(item)]; ok {
+				return ch, true
+			}
+			return fallback, fallback != nil
+		},
+	}
+	return q.sendItems(ctx, nil, opts, func(ctx context.Context, ch chan<- queue.Scheduled) error {
+		return q.Queue.SendScheduled(ctx, ch, frequency, 0)
+	})
+}
+
+// ShardIndex returns which of n shards owns the named item.
+//
+// Hashes the name, so the result is stable across processes and restarts.
+func ShardIndex(name string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(n))
+}
+
+// SendStats summarizes what SendWithStats sent.
+//
+// Safe to read concurrently with the send that updates it.
+type SendStats struct {
+	sent     int64
+	dropped  int64
+	skipped  int64
+	maxDepth int64
+
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+// Dropped returns the total number of items dropped because no receiver was ready.
+func (s *SendStats) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Skipped returns the total number of items skipped because they were removed
+// after the queue scheduled them, but before they were sent.
+func (s *SendStats) Skipped() int64 {
+	return atomic.LoadInt64(&s.skipped)
+}
+
+// Sent returns the total number of items sent.
+func (s *SendStats) Sent() int64 {
+	return atomic.LoadInt64(&s.sent)
+}
+
+// MaxDepth returns the deepest the queue was after taking an item off it to send.
+func (s *SendStats) MaxDepth() int {
+	return int(atomic.LoadInt64(&s.maxDepth))
+}
+
+// Counts returns how many times each item was sent, by name.
+func (s *SendStats) Counts() map[string]int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	counts := make(map[string]int64, len(s.counts))
+	for name, n := range s.counts {
+		counts[name] = n
+	}
+	return counts
+}
+
+// record sending the named item when the queue has depth items.
+func (s *SendStats) record(name string, depth int) {
+	atomic.AddInt64(&s.sent, 1)
+	for d := int64(depth); ; {
+		max := atomic.LoadInt64(&s.maxDepth)
+		if d <= max || atomic.CompareAndSwapInt64(&s.maxDepth, max, d) {
+			break
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.counts == nil {
+		s.counts = map[string]int64{}
+	}
+	s.counts[name]++
+}
+
+// SendFair sends items to receivers until the context expires.
+//
+// Behaves like Send, except it ignores priority: whenever several items
+// are ready it sends the most overdue one first, which bounds how stale
+// any item can become under a backlog.
+func (q *ItemQueue[T]) SendFair(ctx context.Context, receivers chan<- T, frequency time.Duration) error {
+	return q.sendItems(ctx, receivers, sendItemsOptions[T]{}, func(ctx context.Context, ch chan<- queue.Scheduled) error {
+		return q.Queue.SendFair(ctx, ch, frequency, 0)
+	})
+}
+
+// sendItemsOptions control how sendItems delivers items.
+type sendItemsOptions[T Named] struct {
+	stats     *SendStats // record what is sent when set
+	policy    DropPolicy
+	frequency time.Duration // reschedule dropped items this far ahead
+	// route chooses the receivers of each item instead when set, skipping items without any.
+	route func(T) (chan<- T, bool)
+	// graceful puts back any item the context expired before sending, see SendGraceful.
+	graceful bool
+}
+
+// sendItems sends the item of each name send schedules to receivers, using opts.
+//
+// Returns an error naming the item rather than panicking when a receiver channel is closed,
+// and right away rather than blocking forever when receivers is nil without a route.
+func (q *ItemQueue[T]) sendItems(ctx context.Context, receivers chan<- T, opts sendItemsOptions[T], send func(context.Context, chan<- queue.Scheduled) error) error {
+	if receivers == nil && opts.route == nil {
+		return errors.New("nil receivers")
+	}
+	ctx, release, err := q.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	var taken uint64
+	ch, stop := schedule(ctx, q.Buffer, func(ctx context.Context, ch chan<- queue.Scheduled) error {
+		return q.retry(ctx, &taken, func() error { return send(ctx, ch) })
+	})
+	defer stop()
+
+	for who := range ch {
+		atomic.AddUint64(&taken, 1)
+		drained := q.draining()
+		item, ok := q.take(ctx, who, opts.stats)
+		if !ok {
+			continue
+		}
+		out := receivers
+		if opts.route != nil {
+			if out, ok = opts.route(item); !ok {
+				q.skipped(who.Name)
+				continue
+			}
+		}
+		_, end := q.trace(ctx, who)
+		var sent bool
+		err := guard(who.Name, func() {
+			if opts.policy == Block {
+				select {
+				case <-ctx.Done():
+				case <-drained:
+				case out <- item:
+					sent = true
+				}
+				return
+			}
+			select {
+			case out <- item:
+				sent = true
+			default:
+			}
+		})
+		end()
+		switch {
+		case err != nil:
+			return q.failed(err)
+		case sent:
+			q.delivered(who, opts.stats)
+		case opts.policy != Block:
+			q.drop(who.Name, opts)
+		case ctx.Err() != nil:
+			if opts.graceful {
+				q.Queue.Fix(who.Name, who.When, false)
+				stop() // until send puts back any item it took
+			}
+			return ctx.Err()
+		default:
+			q.skipped(who.Name)
+		}
+	}
+	return q.failed(stop())
+}
+
+// Close the queue, stopping every running send and Next as if their context expired,
+// and closing every watch, see WatchSchedule.
+//
+// Later sends and Next return ErrClosed right away, and later watches are already
+// closed. Items RemoveAfter is removing are removed right away.
+// Does nothing once the queue is closed.
+func (q *ItemQueue[T]) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for cancel := range q.running {
+		(*cancel)()
+	}
+	q.running = nil
+	if len(q.removing) > 0 {
+		for name := range q.removing {
+			q.remove(name)
+		}
+		q.publish()
+	}
+	for w := range q.watches {
+		delete(q.watches, w)
+		close(w.events)
+	}
+}
+
+// open returns a context which also expires once the queue is closed, along with a
+// function releasing it, or else ErrClosed when the queue is already closed, or
+// ErrNotInitialized before it was initialized.
+func (q *ItemQueue[T]) open(ctx context.Context) (context.Context, func(), error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return nil, nil, ErrClosed
+	}
+	if q.items == nil {
+		return nil, nil, ErrNotInitialized
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if q.running == nil {
+		q.running = map[*context.CancelFunc]bool{}
+	}
+	q.running[&cancel] = true
+	return ctx, func() {
+		q.lock.Lock()
+		delete(q.running, &cancel)
+		q.lock.Unlock()
+		cancel()
+	}, nil
+}
+
+// schedule runs send in a new goroutine, returning the channel it schedules items on,
+// which is closed once send returns.
+//
+// Calling stop cancels send and waits for it to return, returning its error, so
+// the goroutine never outlives a caller that defers stop. Later calls return the same error.
+func schedule[S any](ctx context.Context, buffer int, send func(context.Context, chan<- S) error) (<-chan S, func() error) {
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan S, buffer)
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		err = send(ctx, ch)
+		close(ch)
+	}()
+	return ch, func() error {
+		cancel()
+		<-done
+		return err
+	}
+}
+
+// holding sends held items like schedule does with SendHolding, see SendAck.
+//
+// Stopping it also releases any items it took but never handed over,
+// so the next send sends them first.
+func (q *ItemQueue[T]) holding(ctx context.Context) (<-chan queue.Scheduled, func() error) {
+	ch, stop := schedule(ctx, q.Buffer, q.Queue.SendHolding)
+	return ch, func() error {
+		err := stop()
+		for who := range ch {
+			q.Queue.Release(who.Name, who.When)
+		}
+		return err
+	}
+}
+
+// retry send after it fails with an error other than the context expiring, see SendRetries.
+//
+// Starts counting retries over once taken changes, which counts the items send scheduled.
+func (q *ItemQueue[T]) retry(ctx context.Context, taken *uint64, send func() error) error {
+	q.lock.RLock()
+	retries, base, errs := q.SendRetries, q.SendRetryBackoff, q.SendErrors
+	q.lock.RUnlock()
+	var failures int
+	var last uint64
+	for {
+		err := send()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case errs <- err:
+		default:
+		}
+		if n := atomic.LoadUint64(taken); n != last {
+			last = n
+			failures = 0
+		}
+		failures++
+		if failures > retries {
+			return err
+		}
+		q.lock.RLock()
+		log := q.log
+		clk := q.clock
+		q.lock.RUnlock()
+		delay := exponential(base, 0, failures)
+		if log != nil {
+			log.WithError(err).WithField("delay", delay).Warning("Retrying send")
+		}
+		if clk == nil {
+			clk = clock.Real{}
+		}
+		timer := clk.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C():
+		}
+	}
+}
+
+// guard calls send, returning an error naming the item when send panics,
+// such as by sending it to a closed channel.
+func guard(name string, send func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("send %q: %v", name, r)
+		}
+	}()
+	send()
+	return nil
+}
+
+// SetLogger logs what sends do to log, with the name of each item as a field.
+//
+// Logs skips and reschedules at debug level, and errors as warnings.
+// Logs nothing by default, or when log is nil.
+func (q *ItemQueue[T]) SetLogger(log logrus.FieldLogger) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.log = log
+}
+
+// failed logs err unless it is nil or the context expired, then returns it
+// wrapped, so callers can still match it with errors.Is and errors.As.
+//
+// Returns the context error as is.
+func (q *ItemQueue[T]) failed(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	q.lock.RLock()
+	log := q.log
+	q.lock.RUnlock()
+	if log != nil {
+		log.WithError(err).Warning("Failed to send items")
+	}
+	return fmt.Errorf("queue send: %w", err)
+}
+
+// take returns the item of a name the queue scheduled, unless it was removed, expired,
+// unchanged since it was last sent, still fresh or its gate is closed, see SetGate.
+//
+// Notifies any observer that the item was rescheduled or skipped,
+// and reports the backlog, see SetDepthThreshold, along with how far the queue drifted
+// behind taking it, see QueueMetrics.Drift. Counts removed items to stats when set.
+func (q *ItemQueue[T]) take(ctx context.Context, who queue.Scheduled, stats *SendStats) (T, bool) {
+	q.lock.RLock()
+	obs := q.observer
+	log := q.log
+	if !who.Next.IsZero() {
+		q.notify(Rescheduled, who.Name, who.Next)
+	}
+	q.lock.RUnlock()
+	if !who.Next.IsZero() {
+		if log != nil {
+			log.WithField("name", who.Name).WithField("next", who.Next).Debug("Rescheduled item")
+		}
+		if obs != nil {
+			obs.OnReschedule(who.Name, who.Next)
+		}
+	}
+	q.backlog()
+	q.lock.RLock()
+	item, ok := q.items[who.Name]
+	mets := q.metrics
+	fresh := q.FreshFunc
+	q.lock.RUnlock()
+	if !who.Taken.IsZero() {
+		mets.drifted(who.Taken.Sub(who.When))
+	}
+	if ok {
+		item, ok = q.load(who.Name, item)
+	}
+	if !ok {
+		mets.skipped()
+		if stats != nil {
+			atomic.AddInt64(&stats.skipped, 1)
+		}
+		q.skipped(who.Name)
+		return item, false
+	}
+	if q.expire(who.Name) {
+		var zero T
+		return zero, false
+	}
+	if q.unchanged(who) {
+		mets.unchanged()
+		q.skipped(who.Name)
+		var zero T
+		return zero, false
+	}
+	if fresh != nil && fresh(item) {
+		mets.fresh()
+		q.skipped(who.Name)
+		var zero T
+		return zero, false
+	}
+	if q.leased(who.Name) || q.inactive(who.Name) {
+		q.skipped(who.Name)
+		var zero T
+		return zero, false
+	}
+	if q.gated(ctx, who.Name) {
+		q.skipped(who.Name)
+		var zero T
+		return zero, false
+	}
+	return q.copied(item), true
+}
+
+// copied returns a deep copy of a proto item when CopyOnEmit is set, or else the item itself.
+func (q *ItemQueue[T]) copied(item T) T {
+	q.lock.RLock()
+	copying := q.CopyOnEmit
+	q.lock.RUnlock()
+	if !copying {
+		return item
+	}
+	if m, ok := any(item).(proto.Message); ok {
+		if c, ok := proto.Clone(m).(T); ok {
+			return c
+		}
+	}
+	return item
+}
+
+// unhold reschedules the named item frequency later, after a send holding items skipped it,
+// such as when it is unchanged, see SetFingerprint, or fresh, see FreshFunc. Does nothing once the item was removed.
+func (q *ItemQueue[T]) unhold(name string, frequency time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[name]; !ok {
+		return
+	}
+	when := q.Queue.NextAfter(name, q.now(), frequency)
+	if err := q.Queue.Release(name, when); err == nil {
+		q.notify(Rescheduled, name, when)
+	}
+}
+
+// skipped notifies any observer that the named item was not sent.
+func (q *ItemQueue[T]) skipped(name string) {
+	q.lock.RLock()
+	obs := q.observer
+	log := q.log
+	q.lock.RUnlock()
+	if log != nil {
+		log.WithField("name", name).Debug("Skipped item")
+	}
+	if obs != nil {
+		obs.OnSkip(name)
+	}
+}
+
+// delivered records sending the item the queue scheduled, including to stats when set.
+func (q *ItemQueue[T]) delivered(who queue.Scheduled, stats *SendStats) {
+	q.lock.Lock()
+	now := q.now()
+	q.count(who.Name)
+	q.sent(who.Name, now)
+	q.sample(now.Sub(who.When))
+	q.record(who, now)
+	obs := q.observer
+	mets := q.metrics
+	tolerance := q.LateTolerance
+	q.lock.Unlock()
+	if obs != nil {
+		obs.OnSend(who.Name, now)
+	}
+	if mets != nil {
+		mets.sent(who.Depth, now.Sub(who.When), tolerance)
+	}
+	if stats != nil {
+		stats.record(who.Name, who.Depth)
+	}
+}
+
+// drop the named item rather than waiting for a receiver, as opts.policy directs.
+func (q *ItemQueue[T]) drop(name string, opts sendItemsOptions[T]) {
+	q.lock.RLock()
+	mets := q.metrics
+	now := q.now()
+	q.lock.RUnlock()
+	if opts.policy == DropAndReschedule {
+		q.Queue.Fix(name, now.Add(opts.frequency), false)
+	}
+	mets.dropped()
+	if opts.stats != nil {
+		atomic.AddInt64(&opts.stats.dropped, 1)
+	}
+}
+
+// Delivery of an item sent by SendAck, which the receiver must Ack.
+type Delivery[T Named] struct {
+	Item T
+	// When the item was scheduled to be sent.
+	When time.Time
+	// Context contains any span SetTracer started for the delivery,
+	// so the receiver can continue the trace. The span ends on Ack.
+	Context context.Context
+
+	once sync.Once
+	ack  func(error)
+}
+
+// Ack reports the receiver finished processing the item, and reschedules it.
+//
+// A nil error reschedules the item after its frequency elapses,
+// and resets its consecutive failures. Otherwise retries the item with
+// exponential backoff, see BackoffBase and BackoffMax.
+// Only the first call has any effect.
+func (d *Delivery[T]) Ack(err error) {
+	d.once.Do(func() { d.ack(err) })
+}
+
+// SendAck sends items to receivers until the context expires.
+//
+// Unlike Send, items are not rescheduled when taken off the queue.
+// Instead each item is held until the receiver calls Ack on its delivery,
+// so an item is never sent again while a receiver is still processing it.
+// An item that is never acked is not sent again until it is re-added.
+func (q *ItemQueue[T]) SendAck(ctx context.Context, receivers chan<- *Delivery[T], frequency time.Duration) error {
+	return q.SendAckWithDeadLetters(ctx, receivers, nil, frequency)
+}
+
+// SendAckWithDeadLetters behaves like SendAck, except for items that fail
+// MaxFailures times in a row.
+//
+// Rather than retrying these items, Ack sends them to deadLetters and
+// removes them from the rotation until they are reintroduced by Poke or Add.
+// Ack blocks until the dead letter is received or the context expires.
+// A nil deadLetters or zero MaxFailures is identical to SendAck.
+func (q *ItemQueue[T]) SendAckWithDeadLetters(ctx context.Context, receivers chan<- *Delivery[T], deadLetters chan<- T, frequency time.Duration) error {
+	if receivers == nil {
+		return errors.New("nil receivers")
+	}
+	ctx, release, err := q.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ch, stop := q.holding(ctx)
+	defer stop()
+
+	for who := range ch {
+		drained := q.draining()
+		item, ok := q.take(ctx, who, nil)
+		if !ok {
+			q.unhold(who.Name, frequency)
+			continue
+		}
+		q.lock.RLock()
+		mets := q.metrics
+		obs := q.observer
+		slots := q.slots
+		q.lock.RUnlock()
+		if slots != nil {
+			select {
+			case <-ctx.Done():
+				q.Queue.Release(who.Name, who.When) // so the next send sends it first
+				return ctx.Err()
+			case <-drained:
+				q.skipped(who.Name)
+				continue
+			case slots <- struct{}{}:
+			}
+		}
+		free := func() {
+			if slots != nil {
+				<-slots
+			}
+		}
+		name := who.Name
+		spanCtx, end := q.trace(ctx, who)
+		d := Delivery[T]{
+			Item:    item,
+			When:    who.When,
+			Context: spanCtx,
+			ack: func(err error) {
+				defer end()
+				defer free()
+				next, dead := q.ack(name, frequency, err, deadLetters != nil)
+				if !dead {
+					if obs != nil {
+						obs.OnReschedule(name, next)
+					}
+					return
+				}
+				select {
+				case <-ctx.Done():
+				case deadLetters <- item:
+				}
+			},
+		}
+		select {
+		case <-ctx.Done():
+			end()
+			free()
+			q.Queue.Release(who.Name, who.When) // so the next send sends it first
+			return ctx.Err()
+		case <-drained:
+			end()
+			free()
+			q.skipped(who.Name)
+			continue
+		case receivers <- &d:
+		}
+		q.lock.Lock()
+		q.count(name)
+		q.sample(q.now().Sub(who.When))
+		q.record(who, q.now())
+		q.lock.Unlock()
+		if obs != nil {
+			q.lock.RLock()
+			now := q.now()
+			q.lock.RUnlock()
+			obs.OnSend(who.Name, now)
+		}
+		if mets != nil {
+			q.lock.RLock()
+			now := q.now()
+			tolerance := q.LateTolerance
+			q.lock.RUnlock()
+			depth, _, _ := q.Queue.Status()
+			mets.sent(depth, now.Sub(who.When), tolerance)
+		}
+	}
+	return q.failed(stop())
+}
@@ -17,34 +17,51 @@ limitations under the License.
 package config
 
 import (
-	"context"
 	"sync"
 	"time"
 
 	"bitbucket.org/creachadair/stringset"
 	configpb "github.com/GoogleCloudPlatform/testgrid/pb/config"
-	"github.com/GoogleCloudPlatform/testgrid/util/queue"
+	"github.com/GoogleCloudPlatform/testgrid/util/clock"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
-// DashboardQueue sends dashboard names at a specific frequency.
+// DashboardQueue can send dashboards to receivers at a specific frequency.
+//
+// See ItemQueue, which keys each dashboard by its name.
+// Also contains the ability to fix dashboards by the test groups of their tabs.
+// Call Init() first, see ItemQueue.
+// Exported methods are safe to call concurrently.
 type DashboardQueue struct {
-	queue.Queue
-	dashboards map[string]*configpb.Dashboard
-	groups     map[string]*stringset.Set
+	ItemQueue[*configpb.Dashboard]
+	groups map[string]*stringset.Set
 
 	lock sync.RWMutex
 }
 
 // Init (or reinit) the queue with the specified configuration.
+//
+// Skips any nil dashboard rather than scheduling it.
 func (q *DashboardQueue) Init(log logrus.FieldLogger, dashboards []*configpb.Dashboard, when time.Time) {
-	n := len(dashboards)
-	names := make([]string, n)
-	namedDashboards := make(map[string]*configpb.Dashboard, n)
-	groups := make(map[string]*stringset.Set, n)
-	for i, d := range dashboards {
-		name := d.Name
-		names[i] = name
+	q.update(dashboards, func(dashboards []*configpb.Dashboard) {
+		q.ItemQueue.Init(log, dashboards, when)
+	})
+}
+
+// Update the queue to the specified configuration after Init, see ItemQueue.Update.
+func (q *DashboardQueue) Update(dashboards []*configpb.Dashboard, when time.Time) {
+	q.update(dashboards, func(dashboards []*configpb.Dashboard) {
+		q.ItemQueue.Update(dashboards, when)
+	})
+}
+
+// update the queue to dashboards, calling update with the ones to schedule while holding the lock.
+func (q *DashboardQueue) update(dashboards []*configpb.Dashboard, update func([]*configpb.Dashboard)) {
+	dashboards = q.scheduled(dashboards)
+	groups := make(map[string]*stringset.Set, len(dashboards))
+	for _, d := range dashboards {
+		name := q.key(d)
 		for _, tab := range d.DashboardTab {
 			if groups[tab.TestGroupName] == nil {
 				ns := stringset.New()
@@ -54,12 +71,51 @@ func (q *DashboardQueue) Init(log logrus.FieldLogger, dashboards []*configpb.Das
 		}
 	}
 	q.lock.Lock()
-	q.Queue.Init(log, names, when)
-	q.dashboards = namedDashboards
+	update(dashboards)
 	q.groups = groups
 	q.lock.Unlock()
 }
 
+// Reset the queue to empty like ItemQueue.Reset, forgetting the test groups of every dashboard.
+func (q *DashboardQueue) Reset() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.ItemQueue.Reset()
+	q.groups = nil
+}
+
+// InitE (or reinit) the queue like Init, unless a dashboard is nil, has an empty name
+// or has the same name as another dashboard.
+func (q *DashboardQueue) InitE(log logrus.FieldLogger, dashboards []*configpb.Dashboard, when time.Time) error {
+	if err := checkItems(dashboards, q.key); err != nil {
+		return err
+	}
+	q.Init(log, dashboards, when)
+	return nil
+}
+
+// InitValidated (or reinit) the queue like InitE, skipping nil dashboards and dashboards with an empty name.
+func (q *DashboardQueue) InitValidated(log logrus.FieldLogger, dashboards []*configpb.Dashboard, when time.Time) ([]error, error) {
+	valid, problems := validItems(dashboards)
+	if err := checkItems(valid, q.key); err != nil {
+		return problems, err
+	}
+	q.Init(log, valid, when)
+	return problems, nil
+}
+
+// InitFiltered (or reinit) the queue like Init, with only the dashboards filter accepts.
+func (q *DashboardQueue) InitFiltered(log logrus.FieldLogger, dashboards []*configpb.Dashboard, when time.Time, filter func(*configpb.Dashboard) bool) {
+	q.Init(log, filterItems(dashboards, filter), when)
+}
+
+// InitFromConfig (or reinit) the queue like Init with the dashboards of cfg.
+//
+// A nil cfg empties the queue.
+func (q *DashboardQueue) InitFromConfig(log logrus.FieldLogger, cfg *configpb.Configuration, when time.Time) {
+	q.Init(log, cfg.GetDashboards(), when)
+}
+
 // FixTestGroups will fix all the dashboards associated with the groups.
 func (q *DashboardQueue) FixTestGroups(when time.Time, later bool, groups ...string) error {
 	q.lock.RLock()
@@ -79,70 +135,91 @@ func (q *DashboardQueue) FixTestGroups(when time.Time, later bool, groups ...str
 
 // TestGroupQueue can send test groups to receivers at a specific frequency.
 //
-// Also contains the ability to modify the next time to send groups.
-// First call must be to Init().
-// Exported methods are safe to call concurrently.
-type TestGroupQueue struct {
-	queue.Queue
-	groups map[string]*configpb.TestGroup
-	lock   sync.RWMutex
-}
-
-// Init (or reinit) the queue with the specified groups, which should be updated at frequency.
-func (q *TestGroupQueue) Init(log logrus.FieldLogger, testGroups []*configpb.TestGroup, when time.Time) {
-	n := len(testGroups)
-	groups := make(map[string]*configpb.TestGroup, n)
-	names := make([]string, n)
-
-	for i, tg := range testGroups {
-		name := tg.Name
-		names[i] = name
-		groups[name] = tg
+// See ItemQueue, which keys each group by its name.
+type TestGroupQueue = ItemQueue[*configpb.TestGroup]
+
+// InitFromConfig (or reinit) the queue like Init with the test groups of cfg,
+// or the dashboards of cfg for a queue of dashboards.
+//
+// A nil cfg empties the queue.
+func (q *ItemQueue[T]) InitFromConfig(log logrus.FieldLogger, cfg *configpb.Configuration, when time.Time) {
+	items, ok := any(cfg.GetTestGroups()).([]T)
+	if !ok {
+		items, _ = any(cfg.GetDashboards()).([]T)
 	}
+	q.Init(log, items, when)
+}
 
-	q.lock.Lock()
-	q.Queue.Init(log, names, when)
-	q.groups = groups
-	q.lock.Unlock()
+// Option configures a queue created by NewTestGroupQueue.
+type Option func(*TestGroupQueue)
+
+// NewTestGroupQueue returns a queue configured by opts, which still requires Init.
+//
+// The zero value is also usable, configured with the setters each option calls.
+func NewTestGroupQueue(opts ...Option) *TestGroupQueue {
+	var q TestGroupQueue
+	for _, opt := range opts {
+		opt(&q)
+	}
+	return &q
 }
 
-// Status of the queue: depth, next item and when the next item is ready.
-func (q *TestGroupQueue) Status() (int, *configpb.TestGroup, time.Time) {
-	q.lock.RLock()
-	defer q.lock.RUnlock()
-	var tg *configpb.TestGroup
-	var when time.Time
-	n, who, when := q.Queue.Status()
-	if who != nil {
-		tg = q.groups[*who]
+// WithClock configures the queue to tell the time with c, see SetClock.
+func WithClock(c clock.Clock) Option {
+	return func(q *TestGroupQueue) {
+		q.SetClock(c)
+	}
+}
+
+// WithLimiter configures the queue to take items at most as fast as limiter allows, see SetLimiter.
+func WithLimiter(limiter *rate.Limiter) Option {
+	return func(q *TestGroupQueue) {
+		q.SetLimiter(limiter)
+	}
+}
+
+// WithJitter configures Send to delay each rescheduled item by up to jitter, see SendWithJitter.
+func WithJitter(jitter time.Duration) Option {
+	return func(q *TestGroupQueue) {
+		q.lock.Lock()
+		q.jitter = jitter
+		q.lock.Unlock()
 	}
-	return n, tg, when
 }
 
-// Send test groups to receivers until the context expires.
+// WithLogger configures the queue to log what sends do, see SetLogger.
+func WithLogger(log logrus.FieldLogger) Option {
+	return func(q *TestGroupQueue) {
+		q.SetLogger(log)
+	}
+}
+
+// WithObserver configures the queue to notify o of what sends do, see SetObserver.
+func WithObserver(o Observer) Option {
+	return func(q *TestGroupQueue) {
+		q.SetObserver(o)
+	}
+}
+
+// ResultSourceKind classifies a group by where its results come from, for SendRouted.
 //
-// Pops items off the queue when frequency is zero.
-// Otherwise reschedules the item after the specified frequency has elapsed.
-func (q *TestGroupQueue) Send(ctx context.Context, receivers chan<- *configpb.TestGroup, frequency time.Duration) error {
-	ch := make(chan string)
-	var err error
-	go func() {
-		err = q.Queue.Send(ctx, ch, frequency)
-		close(ch)
-	}()
-
-	for who := range ch {
-		q.lock.RLock()
-		tg := q.groups[who]
-		q.lock.RUnlock()
-		if tg == nil {
-			continue
-		}
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case receivers <- tg:
+// Returns "gcs" for groups with a GCS result source, otherwise an empty string.
+func ResultSourceKind(tg *configpb.TestGroup) string {
+	if tg.GetResultSource().GetGcsConfig() != nil {
+		return "gcs"
+	}
+	return ""
+}
+
+// ConsumedGroups returns a ShouldSchedule filter accepting the groups some dashboard tab in cfg consumes.
+func ConsumedGroups(cfg *configpb.Configuration) func(*configpb.TestGroup) bool {
+	consumed := map[string]bool{}
+	for _, d := range cfg.GetDashboards() {
+		for _, tab := range d.DashboardTab {
+			consumed[tab.TestGroupName] = true
 		}
 	}
-	return err
+	return func(tg *configpb.TestGroup) bool {
+		return consumed[tg.GetName()]
+	}
 }
@@ -0,0 +1,87 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// QueueDebug is the JSON shape DebugHandler serves.
+//
+// Fields are only ever added, so operators and scripts can rely on them.
+type QueueDebug struct {
+	// Depth is the number of items in the queue.
+	Depth int `json:"depth"`
+	// Head is the item scheduled soonest, omitted when the queue is empty.
+	Head string `json:"head,omitempty"`
+	// Items describes each item, sorted by when they are next sent, then name.
+	Items []QueueDebugItem `json:"items"`
+}
+
+// QueueDebugItem describes the schedule of one item in QueueDebug.
+type QueueDebugItem struct {
+	Name string `json:"name"`
+	// Next is when the item is next sent.
+	Next time.Time `json:"next"`
+	// LastSent is when the item was last sent successfully, omitted if never.
+	LastSent *time.Time `json:"last_sent,omitempty"`
+}
+
+// Debug returns a consistent description of the queue's schedule.
+func (q *ItemQueue[T]) Debug() QueueDebug {
+	schedule := q.Schedule()
+	sort.Slice(schedule, func(i, j int) bool {
+		if !schedule[i].When.Equal(schedule[j].When) {
+			return schedule[i].When.Before(schedule[j].When)
+		}
+		return schedule[i].Name < schedule[j].Name
+	})
+	debug := QueueDebug{
+		Depth: len(schedule),
+		Items: make([]QueueDebugItem, 0, len(schedule)),
+	}
+	for _, gs := range schedule {
+		item := QueueDebugItem{Name: gs.Name, Next: gs.When}
+		if !gs.LastSent.IsZero() {
+			lastSent := gs.LastSent
+			item.LastSent = &lastSent
+		}
+		debug.Items = append(debug.Items, item)
+	}
+	if len(schedule) > 0 {
+		debug.Head = schedule[0].Name
+	}
+	return debug
+}
+
+// DebugHandler serves the queue's Debug description as JSON, for example at /debug/testgroups.
+//
+// Only holds the read lock while copying the schedule, so it never blocks sending for long.
+func (q *ItemQueue[T]) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, err := json.MarshalIndent(q.Debug(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf)
+	})
+}
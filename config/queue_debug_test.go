@@ -0,0 +1,92 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	configpb "github.com/GoogleCloudPlatform/testgrid/pb/config"
+	"github.com/GoogleCloudPlatform/testgrid/util/clock/fake"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDebugHandler(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.PullFrequency = time.Hour
+	q.Init(logrus.WithField("test", "TestDebugHandler"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.Reschedule("there", now.Add(time.Minute))
+	if _, err := q.Next(context.Background()); err != nil {
+		t.Fatalf("Next() got unexpected error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	q.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/testgroups", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("DebugHandler() got status %d, wanted %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("DebugHandler() got content type %q, wanted application/json", got)
+	}
+	var got QueueDebug
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal() got unexpected error: %v", err)
+	}
+	sent := now
+	want := QueueDebug{
+		Depth: 2,
+		Head:  "there",
+		Items: []QueueDebugItem{
+			{
+				Name: "there",
+				Next: now.Add(time.Minute),
+			},
+			{
+				Name:     "hi",
+				Next:     now.Add(time.Hour),
+				LastSent: &sent,
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("DebugHandler() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestDebugEmpty(t *testing.T) {
+	var q TestGroupQueue
+	q.Init(logrus.WithField("test", "TestDebugEmpty"), nil, time.Now())
+	rec := httptest.NewRecorder()
+	q.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/testgroups", nil))
+	if got, want := rec.Body.String(), "{\n  \"depth\": 0,\n  \"items\": []\n}"; got != want {
+		t.Errorf("DebugHandler() got %q, wanted %q", got, want)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// QueueMetrics contains prometheus collectors describing what a TestGroupQueue sends.
+//
+// Register the collectors with a registry, then attach them with SetMetrics.
+type QueueMetrics struct {
+	Depth prometheus.Gauge
+	Wait  prometheus.Histogram
+	Sent  prometheus.Counter
+	// Dropped counts items skipped because no receiver was ready.
+	Dropped prometheus.Counter
+	// Expired counts items removed for being ready after their deadline.
+	Expired prometheus.Counter
+	// Overdue is the number of items ready to send but not yet sent.
+	Overdue prometheus.Gauge
+	// Skipped counts items removed after the queue scheduled them, but before they were sent.
+	Skipped prometheus.Counter
+	// Unchanged counts items rescheduled without sending them, see SetFingerprint.
+	Unchanged prometheus.Counter
+	// Fresh counts items rescheduled without sending them because their results were fresh, see FreshFunc.
+	Fresh prometheus.Counter
+	// OnTime counts items sent within the LateTolerance of their queue after they were ready.
+	OnTime prometheus.Counter
+	// Late counts items sent more than the LateTolerance of their queue after they were ready.
+	Late prometheus.Counter
+	// Drift between items becoming ready and the queue taking them off to send, over the
+	// last ten minutes. Unlike Wait, ends once the queue takes an item rather than once a
+	// receiver does, so sustained drift means the queue itself is falling behind.
+	Drift prometheus.Summary
+}
+
+// NewQueueMetrics creates unregistered collectors, whose names start with prefix.
+func NewQueueMetrics(prefix string) *QueueMetrics {
+	return &QueueMetrics{
+		Depth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: prefix + "_queue_depth",
+			Help: "Number of test groups in the queue",
+		}),
+		Wait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    prefix + "_queue_wait_seconds",
+			Help:    "Seconds between a test group becoming ready and being sent",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 16),
+		}),
+		Sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prefix + "_queue_sent",
+			Help: "Number of test groups sent",
+		}),
+		Dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prefix + "_queue_dropped",
+			Help: "Number of test groups dropped because no receiver was ready",
+		}),
+		Expired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prefix + "_queue_expired",
+			Help: "Number of test groups removed for being ready after their deadline",
+		}),
+		Overdue: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: prefix + "_queue_overdue",
+			Help: "Number of test groups ready to send but not yet sent",
+		}),
+		Skipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prefix + "_queue_skipped",
+			Help: "Number of test groups removed before they were sent",
+		}),
+		Unchanged: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prefix + "_queue_unchanged",
+			Help: "Number of test groups rescheduled without sending them because they were unchanged",
+		}),
+		Fresh: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prefix + "_queue_fresh",
+			Help: "Number of test groups rescheduled without sending them because their results were fresh",
+		}),
+		OnTime: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prefix + "_queue_on_time",
+			Help: "Number of test groups sent within the tolerance of becoming ready",
+		}),
+		Late: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prefix + "_queue_late",
+			Help: "Number of test groups sent later than the tolerance of becoming ready",
+		}),
+		Drift: prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:       prefix + "_queue_drift_seconds",
+			Help:       "Seconds between a test group becoming ready and the queue taking it to send",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+			MaxAge:     10 * time.Minute,
+		}),
+	}
+}
+
+// Collectors returns every collector, for registering with a registry.
+func (m *QueueMetrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.Depth, m.Wait, m.Sent, m.Dropped, m.Expired, m.Overdue, m.Skipped, m.Unchanged, m.Fresh, m.OnTime, m.Late, m.Drift}
+}
+
+// sent records an item sent wait after it was ready, which is late beyond tolerance.
+func (m *QueueMetrics) sent(depth int, wait, tolerance time.Duration) {
+	if m == nil {
+		return
+	}
+	m.Depth.Set(float64(depth))
+	if wait < 0 {
+		wait = 0
+	}
+	m.Wait.Observe(wait.Seconds())
+	m.Sent.Inc()
+	if wait > tolerance {
+		m.Late.Inc()
+	} else {
+		m.OnTime.Inc()
+	}
+}
+
+// drifted records the queue taking an item drift after it was ready.
+func (m *QueueMetrics) drifted(drift time.Duration) {
+	if m == nil {
+		return
+	}
+	if drift < 0 {
+		drift = 0
+	}
+	m.Drift.Observe(drift.Seconds())
+}
+
+func (m *QueueMetrics) dropped() {
+	if m == nil {
+		return
+	}
+	m.Dropped.Inc()
+}
+
+func (m *QueueMetrics) expired() {
+	if m == nil {
+		return
+	}
+	m.Expired.Inc()
+}
+
+func (m *QueueMetrics) skipped() {
+	if m == nil {
+		return
+	}
+	m.Skipped.Inc()
+}
+
+func (m *QueueMetrics) overdue(n int) {
+	if m == nil {
+		return
+	}
+	m.Overdue.Set(float64(n))
+}
+
+func (m *QueueMetrics) unchanged() {
+	if m == nil {
+		return
+	}
+	m.Unchanged.Inc()
+}
+
+func (m *QueueMetrics) fresh() {
+	if m == nil {
+		return
+	}
+	m.Fresh.Inc()
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	configpb "github.com/GoogleCloudPlatform/testgrid/pb/config"
+	"github.com/GoogleCloudPlatform/testgrid/util/clock/fake"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+func TestQueueMetrics(t *testing.T) {
+	log := logrus.WithField("test", "TestQueueMetrics")
+	mets := NewQueueMetrics("test")
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(mets.Collectors()...)
+
+	now := time.Now()
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.SetMetrics(mets)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now.Add(-time.Minute))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	<-ch
+	<-ch
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	if got := testutil.ToFloat64(mets.Sent); got != 2 {
+		t.Errorf("Sent got %v, wanted 2", got)
+	}
+	if got := testutil.ToFloat64(mets.Depth); got != 2 {
+		t.Errorf("Depth got %v, wanted 2", got)
+	}
+	var m dto.Metric
+	if err := mets.Wait.Write(&m); err != nil {
+		t.Fatalf("Write() got unexpected error: %v", err)
+	}
+	h := m.GetHistogram()
+	if got := h.GetSampleCount(); got != 2 {
+		t.Errorf("Wait got %d samples, wanted 2", got)
+	}
+	if got := h.GetSampleSum(); got != 2*time.Minute.Seconds() {
+		t.Errorf("Wait got sum %v, wanted 120 seconds", got)
+	}
+	if n, err := testutil.GatherAndCount(reg); err != nil || n != 12 {
+		t.Errorf("GatherAndCount() got %d, %v, wanted 12 metrics", n, err)
+	}
+}
+
+func TestQueueMetricsLate(t *testing.T) {
+	now := time.Now()
+	mets := NewQueueMetrics("test")
+	q := TestGroupQueue{LateTolerance: 30 * time.Second}
+	q.SetClock(fake.NewClock(now))
+	q.SetMetrics(mets)
+	q.Init(logrus.WithField("test", "TestQueueMetricsLate"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+		{
+			Name: "world",
+		},
+	}, now)
+	// A backlog leaves hi and there ready well before they are sent.
+	q.Fix("hi", now.Add(-time.Minute), false)
+	q.Fix("there", now.Add(-time.Minute), false)
+	q.Fix("world", now.Add(-10*time.Second), false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	for i := 0; i < 3; i++ {
+		<-ch
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	if got := testutil.ToFloat64(mets.Late); got != 2 {
+		t.Errorf("Late got %v, wanted 2", got)
+	}
+	if got := testutil.ToFloat64(mets.OnTime); got != 1 {
+		t.Errorf("OnTime got %v, wanted 1", got)
+	}
+}
+
+func TestQueueMetricsDrift(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	mets := NewQueueMetrics("test")
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.SetMetrics(mets)
+	q.Init(logrus.WithField("test", "TestQueueMetricsDrift"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+		{
+			Name: "world",
+		},
+	}, now)
+	drift := func() float64 {
+		t.Helper()
+		var m dto.Metric
+		if err := mets.Drift.Write(&m); err != nil {
+			t.Fatalf("Write() got unexpected error: %v", err)
+		}
+		return m.GetSummary().GetSampleSum()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	for i := 0; i < 3; i++ {
+		<-ch
+	}
+	if got := drift(); got != 0 {
+		t.Errorf("Drift got sum %v without falling behind, wanted 0", got)
+	}
+
+	// A stalled queue takes every group a minute after it is ready.
+	clk.BlockUntil(1)
+	q.PauseAll()
+	clk.Advance(time.Hour + time.Minute)
+	q.ResumeAll(true)
+	for i := 0; i < 3; i++ {
+		<-ch
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if got, want := drift(), 3*time.Minute.Seconds(); got != want {
+		t.Errorf("Drift got sum %v after falling behind, wanted %v", got, want)
+	}
+}
+
+func TestQueueMetricsNil(t *testing.T) {
+	var mets *QueueMetrics
+	mets.sent(1, time.Second, 0) // must not panic
+	mets.dropped()
+	mets.expired()
+	mets.overdue(1)
+	mets.skipped()
+	mets.drifted(time.Second)
+}
@@ -18,13 +18,25 @@ package config
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	configpb "github.com/GoogleCloudPlatform/testgrid/pb/config"
+	"github.com/GoogleCloudPlatform/testgrid/util/clock/fake"
+	"github.com/GoogleCloudPlatform/testgrid/util/queue"
 	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/time/rate"
 	"google.golang.org/protobuf/testing/protocmp"
 )
 
@@ -102,6 +114,116 @@ func TestStatus(t *testing.T) {
 	}
 }
 
+func TestSchedule(t *testing.T) {
+	now := time.Now()
+	log := logrus.WithField("test", "TestSchedule")
+	cases := []struct {
+		name string
+		q    *TestGroupQueue
+
+		want []GroupSchedule
+	}{
+		{
+			name: "empty",
+			q:    &TestGroupQueue{},
+			want: []GroupSchedule{},
+		},
+		{
+			name: "multi",
+			q: func() *TestGroupQueue {
+				var q TestGroupQueue
+				q.Init(log, []*configpb.TestGroup{
+					{
+						Name: "hi",
+					},
+					{
+						Name: "middle",
+					},
+					{
+						Name: "there",
+					},
+				}, now)
+				q.Fix("middle", now.Add(-time.Minute), true)
+				q.Fix("there", now.Add(time.Minute), true)
+				return &q
+			}(),
+			want: []GroupSchedule{
+				{
+					Name: "hi",
+					When: now,
+				},
+				{
+					Name: "middle",
+					When: now.Add(-time.Minute),
+				},
+				{
+					Name: "there",
+					When: now.Add(time.Minute),
+				},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.q.Schedule()
+			sort.Slice(got, func(i, j int) bool {
+				return got[i].Name < got[j].Name
+			})
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Schedule() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestScheduleWhileSending(t *testing.T) {
+	log := logrus.WithField("test", "TestScheduleWhileSending")
+	var q TestGroupQueue
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Microsecond)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			if got := len(q.Schedule()); got < 2 || got > 3 {
+				t.Errorf("Schedule() got %d groups, wanted 2 or 3", got)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		<-ch
+		if i%2 == 0 {
+			q.Add(&configpb.TestGroup{Name: "extra"}, time.Now().Add(time.Hour), false)
+		} else if err := q.Remove("extra"); err != nil {
+			t.Errorf("Remove() got unexpected error: %v", err)
+		}
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	wg.Wait()
+}
+
 func TestSend(t *testing.T) {
 	log := logrus.WithField("test", "TestSend")
 	cases := []struct {
@@ -365,6 +487,64 @@ func TestSend(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "override loop",
+			q: func() *TestGroupQueue {
+				var q TestGroupQueue
+				q.Init(log, []*configpb.TestGroup{
+					{
+						Name: "hi",
+					},
+					{
+						Name: "there",
+					},
+				}, time.Now())
+				q.SetFrequency("hi", time.Hour)
+				return &q
+			}(),
+			receivers: func(ctx context.Context, _ *testing.T) (context.Context, chan<- *configpb.TestGroup, func() []*configpb.TestGroup) {
+				ch := make(chan *configpb.TestGroup)
+				var wg sync.WaitGroup
+				wg.Add(1)
+				var got []*configpb.TestGroup
+				ctx, cancel := context.WithCancel(ctx)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case tg := <-ch:
+							got = append(got, tg)
+							if len(got) == 4 {
+								cancel()
+							}
+						case <-ctx.Done():
+							cancel()
+							return
+						}
+					}
+				}()
+
+				return ctx, ch, func() []*configpb.TestGroup {
+					wg.Wait()
+					return got
+				}
+			},
+			freq: time.Microsecond,
+			want: []*configpb.TestGroup{
+				{
+					Name: "hi",
+				},
+				{
+					Name: "there",
+				},
+				{
+					Name: "there",
+				},
+				{
+					Name: "there",
+				},
+			},
+		},
 	}
 
 	for _, tc := range cases {
@@ -384,3 +564,6114 @@ func TestSend(t *testing.T) {
 		})
 	}
 }
+
+func TestSendSlowReceiver(t *testing.T) {
+	log := logrus.WithField("test", "TestSendSlowReceiver")
+	var q TestGroupQueue
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := make(chan *configpb.TestGroup)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var got int
+		for {
+			select {
+			case <-ch:
+				got++
+				if got == 3 {
+					cancel()
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := q.Send(ctx, ch, time.Microsecond); err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	wg.Wait()
+}
+
+func TestPoke(t *testing.T) {
+	log := logrus.WithField("test", "TestPoke")
+	cases := []struct {
+		name    string
+		running bool
+	}{
+		{
+			name: "before send",
+		},
+		{
+			name:    "during send",
+			running: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q TestGroupQueue
+			q.Init(log, []*configpb.TestGroup{
+				{
+					Name: "hi",
+				},
+				{
+					Name: "there",
+				},
+			}, time.Now().Add(time.Hour))
+
+			if err := q.Poke("missing"); err == nil {
+				t.Error("Poke() of a missing group failed to return an error")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			ch := make(chan *configpb.TestGroup)
+			errCh := make(chan error, 1)
+			send := func() {
+				go func() {
+					errCh <- q.Send(ctx, ch, time.Hour)
+				}()
+			}
+
+			if tc.running {
+				send()
+				time.Sleep(10 * time.Millisecond) // let Send start sleeping
+			}
+			if err := q.Poke("there"); err != nil {
+				t.Fatalf("Poke() got unexpected error: %v", err)
+			}
+			if !tc.running {
+				send()
+			}
+
+			select {
+			case tg := <-ch:
+				if diff := cmp.Diff(&configpb.TestGroup{Name: "there"}, tg, protocmp.Transform()); diff != "" {
+					t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+				}
+			case <-ctx.Done():
+				t.Error("Send() failed to send the poked group")
+			}
+			cancel()
+			if err := <-errCh; err != ctx.Err() {
+				t.Errorf("Send() returned unexpected error: want %v, got %v", ctx.Err(), err)
+			}
+		})
+	}
+}
+
+func TestAdd(t *testing.T) {
+	log := logrus.WithField("test", "TestAdd")
+	now := time.Now()
+	var q TestGroupQueue
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now.Add(time.Hour))
+
+	// Replace a group without rescheduling it.
+	q.Add(&configpb.TestGroup{Name: "there", DaysOfResults: 7}, now.Add(2*time.Hour), false)
+	if got := q.Queue.Current()["there"]; !got.Equal(now.Add(time.Hour)) {
+		t.Errorf("Add() rescheduled the replaced group to %v, wanted %v", got, now.Add(time.Hour))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+
+	receive := func(want *configpb.TestGroup) {
+		t.Helper()
+		select {
+		case tg := <-ch:
+			if diff := cmp.Diff(want, tg, protocmp.Transform()); diff != "" {
+				t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+			}
+		case <-ctx.Done():
+			t.Errorf("Send() failed to send %v", want)
+		}
+	}
+
+	q.Add(&configpb.TestGroup{Name: "new"}, now, false)
+	receive(&configpb.TestGroup{Name: "new"})
+
+	q.Add(&configpb.TestGroup{Name: "hi", DaysOfResults: 3}, now, false)
+	receive(&configpb.TestGroup{Name: "hi", DaysOfResults: 3})
+
+	if depth, _, _ := q.Status(); depth != 3 {
+		t.Errorf("Status() got depth %d, wanted 3", depth)
+	}
+	cancel()
+	if err := <-errCh; err != ctx.Err() {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", ctx.Err(), err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	log := logrus.WithField("test", "TestRemove")
+	now := time.Now()
+	var q TestGroupQueue
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now.Add(time.Hour))
+	q.Fix("hi", now, false)
+
+	if err := q.Remove("missing"); err == nil {
+		t.Error("Remove() of a missing group failed to return an error")
+	}
+	if err := q.Remove("hi"); err != nil {
+		t.Fatalf("Remove() got unexpected error: %v", err)
+	}
+
+	depth, next, when := q.Status()
+	if depth != 1 {
+		t.Errorf("Status() got depth %d, wanted 1", depth)
+	}
+	if diff := cmp.Diff(&configpb.TestGroup{Name: "there"}, next, protocmp.Transform()); diff != "" {
+		t.Errorf("Status() got unexpected next diff (-want +got):\n%s", diff)
+	}
+	if want := now.Add(time.Hour); !when.Equal(want) {
+		t.Errorf("Status() wanted when %v, got %v", want, when)
+	}
+}
+
+func TestRemoveWhere(t *testing.T) {
+	now := time.Now()
+	var q TestGroupQueue
+	q.Init(logrus.WithField("test", "TestRemoveWhere"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "staging-hi",
+		},
+		{
+			Name: "staging-there",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+
+	got := q.RemoveWhere(func(tg *configpb.TestGroup) bool {
+		return strings.HasPrefix(tg.Name, "staging-")
+	})
+	if got != 2 {
+		t.Errorf("RemoveWhere() got %d, wanted 2", got)
+	}
+	if depth, _, _ := q.Status(); depth != 2 {
+		t.Errorf("Status() got depth %d, wanted 2", depth)
+	}
+	var names []string
+	for _, gs := range q.Snapshot() {
+		names = append(names, gs.Name)
+	}
+	if diff := cmp.Diff([]string{"hi", "there"}, names); diff != "" {
+		t.Errorf("Snapshot() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if _, _, ok := q.StatusOf("staging-hi"); ok {
+		t.Error("StatusOf(staging-hi) found a removed group")
+	}
+}
+
+func TestSendClock(t *testing.T) {
+	log := logrus.WithField("test", "TestSendClock")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}, now.Add(time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+
+	for i := 0; i < 3; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(time.Hour)
+		if diff := cmp.Diff(&configpb.TestGroup{Name: "hi"}, <-ch, protocmp.Transform()); diff != "" {
+			t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+		}
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if _, _, when := q.Status(); !when.Equal(now.Add(4 * time.Hour)) {
+		t.Errorf("Status() got when %v, wanted %v", when, now.Add(4*time.Hour))
+	}
+}
+
+func TestSendConcurrentReceivers(t *testing.T) {
+	log := logrus.WithField("test", "TestSendConcurrentReceivers")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	var groups []*configpb.TestGroup
+	for i := 0; i < 20; i++ {
+		groups = append(groups, &configpb.TestGroup{Name: fmt.Sprintf("group-%d", i)})
+	}
+	q.Init(log, groups, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+
+	const workers = 4
+	var lock sync.Mutex
+	got := map[string]int{}
+	var received sync.WaitGroup
+	received.Add(len(groups))
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case tg := <-ch:
+					lock.Lock()
+					got[tg.Name]++
+					lock.Unlock()
+					time.Sleep(time.Millisecond) // slow receiver
+					received.Done()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	received.Wait()
+	// Every group is rescheduled an hour out, leaving Send waiting.
+	clk.BlockUntil(1)
+	for _, sched := range q.Schedule() {
+		if want := now.Add(time.Hour); !sched.When.Equal(want) {
+			t.Errorf("Send() rescheduled %s to %v, wanted %v", sched.Name, sched.When, want)
+		}
+	}
+	cancel()
+	wg.Wait()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	for _, tg := range groups {
+		if n := got[tg.Name]; n != 1 {
+			t.Errorf("Send() sent %s %d times, wanted once", tg.Name, n)
+		}
+	}
+}
+
+func TestSendAck(t *testing.T) {
+	log := logrus.WithField("test", "TestSendAck")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *Delivery[*configpb.TestGroup])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendAck(ctx, ch, time.Hour)
+	}()
+
+	d := <-ch
+	if diff := cmp.Diff(&configpb.TestGroup{Name: "hi"}, d.Item, protocmp.Transform()); diff != "" {
+		t.Errorf("SendAck() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if n, _, _ := q.Status(); n != 0 {
+		t.Errorf("Status() got depth %d before Ack(), wanted 0", n)
+	}
+
+	clk.Advance(time.Minute)
+	d.Ack(nil)
+	d.Ack(errors.New("ignored"))
+	if n, _, when := q.Status(); n != 1 || !when.Equal(now.Add(time.Minute+time.Hour)) {
+		t.Errorf("Status() after Ack(nil) got %d, %v, wanted 1, %v", n, when, now.Add(time.Minute+time.Hour))
+	}
+
+	clk.Advance(time.Hour)
+	d = <-ch
+	d.Ack(errors.New("failed"))
+	if _, _, when := q.Status(); !when.Equal(clk.Now()) {
+		t.Errorf("Status() after failed Ack() got %v, wanted %v", when, clk.Now())
+	}
+	<-ch // retried right away
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendAck() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSendAckCancel(t *testing.T) {
+	now := time.Now()
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSendAckCancel"), []*configpb.TestGroup{{Name: "hi"}}, now)
+
+	// Cancel while waiting for a receiver.
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan *Delivery[*configpb.TestGroup])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendAck(ctx, ch, time.Hour)
+	}()
+	for n, _, _ := q.Status(); n != 0; n, _, _ = q.Status() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendAck() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if n, _, when := q.Status(); n != 1 || !when.Equal(now) {
+		t.Errorf("Status() after cancel got %d, %v, wanted 1, %v", n, when, now)
+	}
+
+	// The next send sends it.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		errCh <- q.SendAck(ctx, ch, time.Hour)
+	}()
+	d := <-ch
+	if d.Item.Name != "hi" || !d.When.Equal(now) {
+		t.Errorf("SendAck() after cancel got %s at %v, wanted hi at %v", d.Item.Name, d.When, now)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendAck() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSendBroadcastCancel(t *testing.T) {
+	now := time.Now()
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSendBroadcastCancel"), []*configpb.TestGroup{{Name: "hi"}}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendBroadcast(ctx, []chan<- *configpb.TestGroup{ch}, time.Hour, 0, Block)
+	}()
+	for n, _, _ := q.Status(); n != 0; n, _, _ = q.Status() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendBroadcast() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if n, _, when := q.Status(); n != 1 || !when.Equal(now) {
+		t.Errorf("Status() after cancel got %d, %v, wanted 1, %v", n, when, now)
+	}
+}
+
+func TestSendAckPoke(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSendAckPoke"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *Delivery[*configpb.TestGroup])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendAck(ctx, ch, time.Hour)
+	}()
+
+	d := <-ch
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := q.Poke("hi"); err != nil {
+				t.Errorf("Poke() got unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	select {
+	case got := <-ch:
+		t.Fatalf("SendAck() sent %q again before Ack()", got.Item.Name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Advance(time.Minute)
+	d.Ack(nil)
+	if _, _, when := q.Status(); !when.Equal(clk.Now()) {
+		t.Errorf("Status() after Ack() of poked item got %v, wanted %v", when, clk.Now())
+	}
+	d = <-ch // once for both pokes
+	d.Ack(nil)
+	if _, _, when := q.Status(); !when.Equal(clk.Now().Add(time.Hour)) {
+		t.Errorf("Status() after second Ack() got %v, wanted %v", when, clk.Now().Add(time.Hour))
+	}
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendAck() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSetMaxInFlight(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSetMaxInFlight"), []*configpb.TestGroup{
+		{
+			Name: "a",
+		},
+		{
+			Name: "b",
+		},
+		{
+			Name: "c",
+		},
+		{
+			Name: "d",
+		},
+	}, now)
+	q.SetMaxInFlight(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *Delivery[*configpb.TestGroup])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendAck(ctx, ch, time.Hour)
+	}()
+
+	first := <-ch
+	<-ch
+	select {
+	case d := <-ch:
+		t.Fatalf("SendAck() sent %q with 2 deliveries in flight", d.Item.Name)
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Ack(nil)
+	if d := <-ch; d.Item.Name != "c" {
+		t.Errorf("SendAck() got %q after Ack(), wanted c", d.Item.Name)
+	}
+
+	// Stops waiting for an Ack once the context expires.
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendAck() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSetMaxInFlightCancel(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name     string
+		received int // deliveries received before cancelling
+		want     string
+	}{
+		{
+			name: "waiting for a receiver",
+			want: "a",
+		},
+		{
+			name:     "waiting for a slot",
+			received: 1,
+			want:     "b",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q TestGroupQueue
+			q.SetClock(fake.NewClock(now.Add(time.Minute)))
+			q.Init(logrus.WithField("test", "TestSetMaxInFlightCancel"), []*configpb.TestGroup{{Name: "a"}, {Name: "b"}, {Name: "c"}}, now)
+			q.Queue.Fix("b", now.Add(time.Second), true)
+			q.Queue.Fix("c", now.Add(2*time.Second), true)
+			q.SetMaxInFlight(1)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			ch := make(chan *Delivery[*configpb.TestGroup])
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- q.SendAck(ctx, ch, time.Hour)
+			}()
+			var acks []*Delivery[*configpb.TestGroup]
+			for i := 0; i < tc.received; i++ {
+				acks = append(acks, <-ch)
+			}
+			// Wait until the next item is waiting, and the one after it is taken, then cancel.
+			for n, _, _ := q.Status(); n != 1-tc.received; n, _, _ = q.Status() {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			if err := <-errCh; err != context.Canceled {
+				t.Errorf("SendAck() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+			if n, _, _ := q.Status(); n != 3-tc.received {
+				t.Errorf("Status() after cancel got depth %d, wanted %d", n, 3-tc.received)
+			}
+			for _, d := range acks {
+				d.Ack(nil)
+			}
+
+			// The next send sends it first.
+			ctx, cancel = context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				errCh <- q.SendAck(ctx, ch, time.Hour)
+			}()
+			if d := <-ch; d.Item.Name != tc.want {
+				t.Errorf("SendAck() after cancel got %q, wanted %q", d.Item.Name, tc.want)
+			}
+			cancel()
+			if err := <-errCh; err != context.Canceled {
+				t.Errorf("SendAck() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+		})
+	}
+}
+
+func TestSendAckBackoff(t *testing.T) {
+	log := logrus.WithField("test", "TestSendAckBackoff")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	q := TestGroupQueue{
+		BackoffBase: time.Minute,
+		BackoffMax:  3 * time.Minute,
+	}
+	q.SetClock(clk)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *Delivery[*configpb.TestGroup])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendAck(ctx, ch, time.Hour)
+	}()
+
+	receive := func() *Delivery[*configpb.TestGroup] {
+		_, _, when := q.Status()
+		clk.Set(when)
+		return <-ch
+	}
+
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		receive().Ack(errors.New("failed"))
+		if _, _, when := q.Status(); when.Sub(clk.Now()) != want {
+			t.Errorf("%d: failed Ack() delayed retry by %v, wanted %v", i, when.Sub(clk.Now()), want)
+		}
+	}
+
+	receive().Ack(nil)
+	if _, _, when := q.Status(); when.Sub(clk.Now()) != time.Hour {
+		t.Errorf("Ack(nil) rescheduled after %v, wanted %v", when.Sub(clk.Now()), time.Hour)
+	}
+	receive().Ack(errors.New("failed again"))
+	if _, _, when := q.Status(); when.Sub(clk.Now()) != time.Minute {
+		t.Errorf("failed Ack() after success delayed retry by %v, wanted %v", when.Sub(clk.Now()), time.Minute)
+	}
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendAck() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		name     string
+		base     time.Duration
+		max      time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{
+			name:     "zero base",
+			failures: 3,
+		},
+		{
+			name:     "first",
+			base:     time.Second,
+			failures: 1,
+			want:     time.Second,
+		},
+		{
+			name:     "doubles",
+			base:     time.Second,
+			failures: 4,
+			want:     8 * time.Second,
+		},
+		{
+			name:     "capped",
+			base:     time.Second,
+			max:      5 * time.Second,
+			failures: 4,
+			want:     5 * time.Second,
+		},
+		{
+			name:     "uncapped",
+			base:     time.Second,
+			failures: 1000,
+			want:     time.Second << 33,
+		},
+		{
+			name:     "many",
+			base:     time.Second,
+			max:      time.Hour,
+			failures: 1000,
+			want:     time.Hour,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := TestGroupQueue{BackoffBase: tc.base, BackoffMax: tc.max}
+			if got := q.backoff(tc.failures); got != tc.want {
+				t.Errorf("backoff(%d) got %v, wanted %v", tc.failures, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSendAckWithDeadLetters(t *testing.T) {
+	log := logrus.WithField("test", "TestSendAckWithDeadLetters")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	q := TestGroupQueue{MaxFailures: 2}
+	q.SetClock(clk)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *Delivery[*configpb.TestGroup])
+	dead := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendAckWithDeadLetters(ctx, ch, dead, time.Hour)
+	}()
+
+	(<-ch).Ack(errors.New("first"))
+	d := <-ch
+	go d.Ack(errors.New("second"))
+	if diff := cmp.Diff(&configpb.TestGroup{Name: "hi"}, <-dead, protocmp.Transform()); diff != "" {
+		t.Errorf("SendAckWithDeadLetters() got unexpected dead letter diff (-want +got):\n%s", diff)
+	}
+	if n, _, _ := q.Status(); n != 0 {
+		t.Errorf("Status() got depth %d after dead letter, wanted 0", n)
+	}
+
+	if err := q.Poke("hi"); err != nil {
+		t.Errorf("Poke() got unexpected error: %v", err)
+	}
+	(<-ch).Ack(errors.New("first again"))
+	(<-ch).Ack(nil)
+	if _, _, when := q.Status(); !when.Equal(now.Add(time.Hour)) {
+		t.Errorf("Status() after Poke() got %v, wanted %v", when, now.Add(time.Hour))
+	}
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendAckWithDeadLetters() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSendAckWithoutDeadLetters(t *testing.T) {
+	log := logrus.WithField("test", "TestSendAckWithoutDeadLetters")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	q := TestGroupQueue{MaxFailures: 1}
+	q.SetClock(clk)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *Delivery[*configpb.TestGroup])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendAck(ctx, ch, time.Hour)
+	}()
+
+	for i := 0; i < 3; i++ {
+		(<-ch).Ack(errors.New("failed")) // retried without a dead letter channel
+	}
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendAck() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestDrain"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "middle",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.Fix("middle", now.Add(time.Minute), true)
+	q.Fix("there", now.Add(time.Hour), true)
+
+	want := []GroupSchedule{
+		{
+			Name: "hi",
+			When: now,
+		},
+		{
+			Name: "middle",
+			When: now.Add(time.Minute),
+		},
+		{
+			Name: "there",
+			When: now.Add(time.Hour),
+		},
+	}
+	if diff := cmp.Diff(want, q.Drain()); diff != "" {
+		t.Errorf("Drain() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if depth, _, _ := q.Status(); depth != 0 {
+		t.Errorf("Drain() left depth %d, wanted 0", depth)
+	}
+	if got := q.Drain(); len(got) != 0 {
+		t.Errorf("Drain() of an empty queue got %v", got)
+	}
+}
+
+// drainObserver reports what the queue reschedules and skips.
+type drainObserver struct {
+	rescheduled chan string
+	skipped     chan string
+}
+
+func (o *drainObserver) OnSend(string, time.Time) {}
+
+func (o *drainObserver) OnReschedule(name string, _ time.Time) {
+	o.rescheduled <- name
+}
+
+func (o *drainObserver) OnSkip(name string) {
+	o.skipped <- name
+}
+
+func TestDrainWhileSending(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestDrainWhileSending"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.Fix("there", now.Add(-time.Minute), true)
+	obs := &drainObserver{
+		rescheduled: make(chan string, 2),
+		skipped:     make(chan string, 2),
+	}
+	q.SetObserver(obs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+
+	if got := (<-ch).Name; got != "there" {
+		t.Fatalf("Send() got %q first, wanted there", got)
+	}
+	<-obs.rescheduled // there
+	if got := <-obs.rescheduled; got != "hi" {
+		t.Fatalf("Send() rescheduled %q, wanted hi", got)
+	}
+
+	want := []GroupSchedule{
+		{
+			Name: "hi",
+			When: now.Add(time.Hour),
+		},
+		{
+			Name:     "there",
+			When:     now.Add(time.Hour),
+			LastSent: now,
+		},
+	}
+	if diff := cmp.Diff(want, q.Drain()); diff != "" {
+		t.Errorf("Drain() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if got := <-obs.skipped; got != "hi" {
+		t.Errorf("Send() skipped %q, wanted hi", got)
+	}
+	select {
+	case tg := <-ch:
+		t.Errorf("Send() sent %q after Drain()", tg.Name)
+	default:
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestInitWhileSending(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	groups := func() []*configpb.TestGroup {
+		return []*configpb.TestGroup{
+			{
+				Name: "hi",
+			},
+			{
+				Name: "there",
+			},
+		}
+	}
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	mets := NewQueueMetrics("test")
+	q.SetMetrics(mets)
+	log := logrus.WithField("test", "TestInitWhileSending")
+	q.Init(log, groups(), now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	for i := 0; i < 200; i++ {
+		q.Init(log, groups(), now)
+		q.InitNow(log, groups())
+		if tg := <-ch; tg == nil {
+			t.Fatal("Send() sent a nil group")
+		}
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if got := testutil.ToFloat64(mets.Skipped); got != 0 {
+		t.Errorf("Skipped got %v, wanted 0", got)
+	}
+}
+
+func TestSendGraceful(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSendGraceful"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	obs := &drainObserver{
+		rescheduled: make(chan string, 2),
+		skipped:     make(chan string, 2),
+	}
+	q.SetObserver(obs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	var flushed []GroupSchedule
+	go func() {
+		errCh <- q.SendGraceful(ctx, ch, time.Hour, func(snapshot []GroupSchedule) {
+			flushed = snapshot
+		})
+	}()
+
+	// Cancel while Send waits to emit hi, which nothing receives.
+	<-obs.rescheduled
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendGraceful() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	want := []GroupSchedule{
+		{
+			Name:       "hi",
+			When:       now,
+			Generation: 1,
+		},
+		{
+			Name:       "there",
+			When:       now,
+			Generation: 1,
+		},
+	}
+	if diff := cmp.Diff(want, flushed); diff != "" {
+		t.Errorf("SendGraceful() flushed unexpected diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, q.Snapshot()); diff != "" {
+		t.Errorf("Snapshot() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSendClosedReceivers(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSendClosedReceivers"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+
+	<-ch
+	close(ch)
+	q.Fix("hi", now, false)
+
+	err := <-errCh
+	if err == nil {
+		t.Fatal("Send() to closed receivers failed to return an error")
+	}
+	if !strings.Contains(err.Error(), `"hi"`) {
+		t.Errorf("Send() returned error %q, which does not name the group", err)
+	}
+}
+
+func TestSendNilReceivers(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSendNilReceivers"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}, now)
+
+	ctx := context.Background()
+	cases := []struct {
+		name string
+		send func() error
+		want string
+	}{
+		{
+			name: "Send",
+			send: func() error { return q.Send(ctx, nil, time.Hour) },
+			want: "nil receivers",
+		},
+		{
+			name: "SendWithIDs",
+			send: func() error { return q.SendWithIDs(ctx, nil, time.Hour) },
+			want: "nil receivers",
+		},
+		{
+			name: "SendBatch",
+			send: func() error { return q.SendBatch(ctx, nil, time.Hour, 0) },
+			want: "nil receivers",
+		},
+		{
+			name: "SendAck",
+			send: func() error { return q.SendAck(ctx, nil, time.Hour) },
+			want: "nil receivers",
+		},
+		{
+			name: "SendBroadcast",
+			send: func() error {
+				return q.SendBroadcast(ctx, []chan<- *configpb.TestGroup{make(chan *configpb.TestGroup), nil}, time.Hour, 0, Block)
+			},
+			want: "receiver 1: nil",
+		},
+		{
+			name: "SendSharded",
+			send: func() error { return q.SendSharded(ctx, []chan<- *configpb.TestGroup{nil}, time.Hour) },
+			want: "receiver 0: nil",
+		},
+		{
+			name: "SendRouted",
+			send: func() error {
+				return q.SendRouted(ctx, ResultSourceKind, map[string]chan<- *configpb.TestGroup{"gcs": nil}, nil, time.Hour)
+			},
+			want: `route "gcs": nil receivers`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.send(); err == nil || err.Error() != tc.want {
+				t.Errorf("%s() got error %v, wanted %s", tc.name, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestSendCancel(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSendCancel"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := make(chan *configpb.TestGroup)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- q.Send(ctx, ch, time.Hour)
+		}()
+		tg := <-ch
+		cancel()
+		if err := <-errCh; err != context.Canceled {
+			t.Fatalf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+		}
+		q.Fix(tg.GetName(), now, false)
+	}
+	if after := goroutines(before); after > before {
+		t.Errorf("Send() leaked %d goroutines after returning", after-before)
+	}
+}
+
+// goroutines returns how many goroutines there are once at most want remain,
+// or after a second, giving any which finished their work time to exit.
+func goroutines(want int) int {
+	deadline := time.Now().Add(time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= want || time.Now().After(deadline) {
+			return n
+		}
+		runtime.Gosched()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClose(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	log := logrus.WithField("test", "TestClose")
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		var q TestGroupQueue
+		q.SetClock(fake.NewClock(now))
+		q.Init(log, []*configpb.TestGroup{
+			{
+				Name: "hi",
+			},
+		}, now)
+		w := q.WatchSchedule(10)
+		if err := q.RemoveAfter("hi", time.Hour); err != nil {
+			t.Fatalf("RemoveAfter() got unexpected error: %v", err)
+		}
+		q.Add(&configpb.TestGroup{Name: "hi"}, now, false)
+		q.Add(&configpb.TestGroup{Name: "there"}, now, false)
+		if err := q.RemoveAfter("there", time.Hour); err != nil {
+			t.Fatalf("RemoveAfter() got unexpected error: %v", err)
+		}
+
+		ch := make(chan *configpb.TestGroup)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- q.Send(context.Background(), ch, time.Hour)
+		}()
+		<-ch
+		q.Close()
+		q.Close()
+		if err := <-errCh; err != context.Canceled {
+			t.Fatalf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+		}
+		for range w.Events() {
+		}
+		w.Close()
+
+		if err := q.Send(context.Background(), ch, time.Hour); err == nil {
+			t.Error("Send() after Close() failed to return an error")
+		}
+		if _, err := q.Next(context.Background()); err == nil {
+			t.Error("Next() after Close() failed to return an error")
+		}
+		if _, ok := <-q.WatchSchedule(10).Events(); ok {
+			t.Error("WatchSchedule() after Close() got an event")
+		}
+		if _, _, ok := q.StatusOf("there"); ok {
+			t.Error("StatusOf() of an item draining at Close() got it, wanted nothing")
+		}
+	}
+	if after := goroutines(before); after > before {
+		t.Errorf("Close() leaked %d goroutines", after-before)
+	}
+}
+
+func TestSetDepthThreshold(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	var groups []*configpb.TestGroup
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		groups = append(groups, &configpb.TestGroup{Name: name})
+	}
+	q.Init(logrus.WithField("test", "TestSetDepthThreshold"), groups, now)
+	for i, tg := range groups {
+		q.Fix(tg.Name, now.Add(time.Duration(i-len(groups))*time.Minute), true)
+	}
+	mets := NewQueueMetrics("test")
+	q.SetMetrics(mets)
+	depths := make(chan int, 5)
+	q.SetDepthThreshold(2, func(depth int) {
+		depths <- depth
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+
+	// Nothing receives a, so b, c, d and e are overdue, except for b when
+	// Send already took it off the queue while waiting to send a.
+	depth := <-depths
+	if depth != 3 && depth != 4 {
+		t.Errorf("SetDepthThreshold() got depth %d, wanted 3 or 4", depth)
+	}
+	if got := testutil.ToFloat64(mets.Overdue); got != float64(depth) {
+		t.Errorf("Overdue got %v, wanted %d", got, depth)
+	}
+	for _, want := range []string{"a", "b", "c", "d"} {
+		if got := (<-ch).Name; got != want {
+			t.Errorf("Send() got %q, wanted %q", got, want)
+		}
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	select {
+	case got := <-depths:
+		t.Errorf("SetDepthThreshold() got another depth %d", got)
+	default:
+	}
+}
+
+func BenchmarkSendBuffer(b *testing.B) {
+	groups := make([]*configpb.TestGroup, 1000)
+	for i := range groups {
+		groups[i] = &configpb.TestGroup{Name: fmt.Sprintf("group-%d", i)}
+	}
+	log := logrus.New()
+	log.SetLevel(logrus.WarnLevel)
+	for _, buffer := range []int{0, 16} {
+		b.Run(fmt.Sprintf("buffer-%d", buffer), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				q := TestGroupQueue{Buffer: buffer}
+				// Every group is ready at once, then Send removes each one.
+				q.Init(log, groups, time.Now())
+				ch := make(chan *configpb.TestGroup)
+				errCh := make(chan error, 1)
+				go func() {
+					errCh <- q.Send(context.Background(), ch, 0)
+					close(ch)
+				}()
+				for range ch {
+				}
+				if err := <-errCh; err != nil {
+					b.Fatalf("Send() got unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkGroups returns n test groups with unique names.
+func benchmarkGroups(n int) []*configpb.TestGroup {
+	groups := make([]*configpb.TestGroup, n)
+	for i := range groups {
+		groups[i] = &configpb.TestGroup{Name: fmt.Sprintf("group-%d", i)}
+	}
+	return groups
+}
+
+func benchmarkLogger() logrus.FieldLogger {
+	log := logrus.New()
+	log.SetLevel(logrus.WarnLevel)
+	return log
+}
+
+func BenchmarkInit(b *testing.B) {
+	groups := benchmarkGroups(50000)
+	log := benchmarkLogger()
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var q TestGroupQueue
+		q.Init(log, groups, now)
+		q.Init(log, groups, now) // reinit
+	}
+}
+
+func BenchmarkSendThroughput(b *testing.B) {
+	const n = 50000
+	groups := benchmarkGroups(n)
+	log := benchmarkLogger()
+	now := time.Now()
+	var q TestGroupQueue
+	q.Init(log, groups, now)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		// Every group is ready again right after it is sent.
+		errCh <- q.Send(ctx, ch, time.Nanosecond)
+	}()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		<-ch
+	}
+	b.StopTimer()
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		b.Fatalf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func BenchmarkStatus(b *testing.B) {
+	var q TestGroupQueue
+	q.Init(benchmarkLogger(), benchmarkGroups(50000), time.Now())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.Status()
+	}
+}
+
+func BenchmarkStatusConcurrent(b *testing.B) {
+	var q TestGroupQueue
+	q.Init(benchmarkLogger(), benchmarkGroups(50000), time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Nanosecond)
+	}()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			q.Status()
+			q.StatusOf("group-0")
+		}
+	})
+	b.StopTimer()
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		b.Fatalf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	log := logrus.WithField("test", "TestSnapshotRestore")
+	now := time.Now()
+	var before TestGroupQueue
+	before.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "removed",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	before.Fix("there", now.Add(time.Hour), true)
+	before.Fix("removed", now.Add(-time.Hour), false)
+
+	snapshot := before.Snapshot()
+	want := []GroupSchedule{
+		{Name: "hi", When: now, Generation: 1},
+		{Name: "removed", When: now.Add(-time.Hour), Generation: 1},
+		{Name: "there", When: now.Add(time.Hour), Generation: 1},
+	}
+	if diff := cmp.Diff(want, snapshot); diff != "" {
+		t.Errorf("Snapshot() got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	var after TestGroupQueue
+	later := now.Add(time.Minute)
+	after.Init(log, []*configpb.TestGroup{
+		{
+			Name: "added",
+		},
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, later)
+	if err := after.Restore(snapshot); err != nil {
+		t.Fatalf("Restore() got unexpected error: %v", err)
+	}
+
+	want = []GroupSchedule{
+		{Name: "added", When: later, Generation: 1},
+		{Name: "hi", When: now, Generation: 1},
+		{Name: "there", When: now.Add(time.Hour), Generation: 1},
+	}
+	if diff := cmp.Diff(want, after.Snapshot()); diff != "" {
+		t.Errorf("Restore() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	log := logrus.WithField("test", "TestGeneration")
+	now := time.Now()
+	groups := []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}
+	var q TestGroupQueue
+	if got := q.Generation(); got != 0 {
+		t.Errorf("Generation() before Init() got %d, wanted 0", got)
+	}
+	q.Init(log, groups, now)
+	if got := q.Generation(); got != 1 {
+		t.Errorf("Generation() after Init() got %d, wanted 1", got)
+	}
+	stale := q.Snapshot()
+	q.Update(groups, now)
+	q.Init(log, groups, now)
+	if got := q.Generation(); got != 3 {
+		t.Errorf("Generation() after reinit got %d, wanted 3", got)
+	}
+
+	q.Fix("hi", now.Add(time.Hour), true)
+	stale[0].When = now.Add(-time.Hour)
+	if err := q.Restore(stale); err == nil {
+		t.Error("Restore() of a stale snapshot failed to return an error")
+	}
+	if _, st, _ := q.StatusOf("hi"); !st.When.Equal(now.Add(time.Hour)) {
+		t.Errorf("Restore() of a stale snapshot moved hi to %v", st.When)
+	}
+
+	// Restores a snapshot without a generation, such as one persisted before a restart.
+	stale[0].Generation = 0
+	if err := q.Restore(stale); err != nil {
+		t.Errorf("Restore() got unexpected error: %v", err)
+	}
+	if _, st, _ := q.StatusOf("hi"); !st.When.Equal(now.Add(-time.Hour)) {
+		t.Errorf("Restore() moved hi to %v, wanted %v", st.When, now.Add(-time.Hour))
+	}
+}
+
+func TestSendFair(t *testing.T) {
+	log := logrus.WithField("test", "TestSendFair")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	var groups []*configpb.TestGroup
+	whens := map[string]time.Time{}
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("group-%d", i)
+		groups = append(groups, &configpb.TestGroup{Name: name})
+		whens[name] = now.Add(-time.Duration(i*7%5) * time.Minute)
+	}
+	q.Init(log, groups, now)
+	q.FixAll(whens, true)
+	for i, tg := range groups {
+		q.SetPriority(tg.Name, i) // ignored
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendFair(ctx, ch, time.Hour)
+	}()
+
+	var got []string
+	for range groups {
+		got = append(got, (<-ch).Name)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendFair() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	want := []string{"group-2", "group-4", "group-1", "group-3", "group-0"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SendFair() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestPause(t *testing.T) {
+	cases := []struct {
+		name string
+		keep bool
+	}{
+		{
+			name: "resume right away",
+		},
+		{
+			name: "resume keeps schedule",
+			keep: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			log := logrus.WithField("test", "TestPause")
+			now := time.Now()
+			clk := fake.NewClock(now)
+			q := TestGroupQueue{ResumeKeepsSchedule: tc.keep}
+			q.SetClock(clk)
+			q.Init(log, []*configpb.TestGroup{
+				{
+					Name: "hi",
+				},
+				{
+					Name: "there",
+				},
+			}, now.Add(time.Hour))
+			q.Fix("hi", now, false)
+			q.Fix("there", now.Add(time.Minute), false)
+
+			if err := q.Pause("hi"); err != nil {
+				t.Fatalf("Pause() got unexpected error: %v", err)
+			}
+			if err := q.Pause("missing"); err == nil {
+				t.Error("Pause(missing) failed to return an error")
+			}
+			if _, tg, _ := q.Status(); tg.GetName() != "hi" {
+				t.Errorf("Status() got %q, wanted paused head %q", tg.GetName(), "hi")
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan *configpb.TestGroup)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- q.Send(ctx, ch, 2*time.Hour)
+			}()
+
+			clk.BlockUntil(1) // skips the paused head
+			clk.Advance(time.Minute)
+			if got := (<-ch).Name; got != "there" {
+				t.Errorf("Send() got %q, wanted %q", got, "there")
+			}
+
+			q.Fix("hi", now.Add(time.Hour), true)
+			if err := q.Resume("hi"); err != nil {
+				t.Fatalf("Resume() got unexpected error: %v", err)
+			}
+			if tc.keep {
+				var when time.Time
+				for _, gs := range q.Schedule() {
+					if gs.Name == "hi" {
+						when = gs.When
+					}
+				}
+				if want := now.Add(time.Hour); !when.Equal(want) {
+					t.Errorf("Resume() scheduled %v, wanted %v", when, want)
+				}
+			} else if got := (<-ch).Name; got != "hi" {
+				t.Errorf("Send() after Resume() got %q, wanted %q", got, "hi")
+			}
+
+			cancel()
+			if err := <-errCh; err != context.Canceled {
+				t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+		})
+	}
+}
+
+func TestPauseAll(t *testing.T) {
+	log := logrus.WithField("test", "TestPauseAll")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "a",
+		},
+		{
+			Name: "b",
+		},
+		{
+			Name: "c",
+		},
+	}, now)
+	q.FixAll(map[string]time.Time{
+		"b": now.Add(time.Minute),
+		"c": now.Add(2 * time.Minute),
+	}, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, 10*time.Minute)
+	}()
+
+	var got []string
+	got = append(got, (<-ch).Name)
+	q.PauseAll()
+	clk.Advance(30 * time.Minute)
+	select {
+	case tg := <-ch:
+		t.Errorf("Send() while paused got %q", tg.Name)
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.ResumeAll(false)
+
+	for _, d := range []time.Duration{time.Minute, time.Minute, 8 * time.Minute, time.Minute, time.Minute} {
+		clk.BlockUntil(1)
+		clk.Advance(d)
+		got = append(got, (<-ch).Name)
+	}
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	want := []string{"a", "b", "c", "a", "b", "c"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	log := logrus.WithField("test", "TestPeek")
+	now := time.Now()
+	var q TestGroupQueue
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "middle",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.Fix("there", now.Add(-time.Minute), false)
+	q.Fix("hi", now.Add(time.Minute), true)
+
+	want := []*configpb.TestGroup{
+		{
+			Name: "there",
+		},
+		{
+			Name: "middle",
+		},
+	}
+	if diff := cmp.Diff(want, q.Peek(2), protocmp.Transform()); diff != "" {
+		t.Errorf("Peek() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if _, tg, _ := q.Status(); tg.GetName() != "there" {
+		t.Errorf("Status() after Peek() got %q, wanted %q", tg.GetName(), "there")
+	}
+}
+
+func TestWithinWindow(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestWithinWindow"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "late",
+		},
+		{
+			Name: "overdue",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.Fix("hi", now.Add(5*time.Minute), true)
+	q.Fix("late", now.Add(11*time.Minute), true)
+	q.Fix("overdue", now.Add(-time.Minute), false)
+	q.Fix("there", now.Add(10*time.Minute), true)
+
+	want := []GroupSchedule{
+		{
+			Name: "overdue",
+			When: now.Add(-time.Minute),
+		},
+		{
+			Name: "hi",
+			When: now.Add(5 * time.Minute),
+		},
+		{
+			Name: "there",
+			When: now.Add(10 * time.Minute),
+		},
+	}
+	if diff := cmp.Diff(want, q.WithinWindow(10*time.Minute)); diff != "" {
+		t.Errorf("WithinWindow() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if _, tg, _ := q.Status(); tg.GetName() != "overdue" {
+		t.Errorf("Status() after WithinWindow() got %q, wanted %q", tg.GetName(), "overdue")
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name     string
+		group    string
+		when     time.Time
+		wantHead string
+		wantWhen time.Time
+		err      bool
+	}{
+		{
+			name:     "earlier",
+			group:    "there",
+			when:     now.Add(-time.Hour),
+			wantHead: "there",
+			wantWhen: now.Add(-time.Hour),
+		},
+		{
+			name:     "later",
+			group:    "there",
+			when:     now.Add(time.Hour),
+			wantHead: "hi",
+			wantWhen: now.Add(-time.Minute),
+		},
+		{
+			name:     "head later",
+			group:    "hi",
+			when:     now.Add(time.Hour),
+			wantHead: "there",
+			wantWhen: now,
+		},
+		{
+			name:     "head earlier",
+			group:    "hi",
+			when:     now.Add(-time.Hour),
+			wantHead: "hi",
+			wantWhen: now.Add(-time.Hour),
+		},
+		{
+			name:     "missing",
+			group:    "missing",
+			when:     now,
+			wantHead: "hi",
+			wantWhen: now.Add(-time.Minute),
+			err:      true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q TestGroupQueue
+			q.Init(logrus.WithField("name", tc.name), []*configpb.TestGroup{
+				{
+					Name: "hi",
+				},
+				{
+					Name: "there",
+				},
+			}, now)
+			q.Fix("hi", now.Add(-time.Minute), false)
+
+			err := q.Reschedule(tc.group, tc.when)
+			switch {
+			case err != nil && !tc.err:
+				t.Errorf("Reschedule() got unexpected error: %v", err)
+			case err == nil && tc.err:
+				t.Error("Reschedule() failed to return an error")
+			}
+			_, tg, when := q.Status()
+			if tg.GetName() != tc.wantHead || !when.Equal(tc.wantWhen) {
+				t.Errorf("Status() got %q at %v, wanted %q at %v", tg.GetName(), when, tc.wantHead, tc.wantWhen)
+			}
+		})
+	}
+}
+
+func TestEvictStale(t *testing.T) {
+	log := logrus.WithField("test", "TestEvictStale")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "stale",
+		},
+		{
+			Name: "fresh",
+		},
+	}, now)
+	q.Reschedule("fresh", now.Add(20*time.Minute))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	if got := (<-ch).Name; got != "stale" {
+		t.Fatalf("Send() got %q, wanted %q", got, "stale")
+	}
+	clk.BlockUntil(1)
+	clk.Advance(20 * time.Minute)
+	if got := (<-ch).Name; got != "fresh" {
+		t.Fatalf("Send() got %q, wanted %q", got, "fresh")
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	clk.Advance(10 * time.Minute)
+	q.Add(&configpb.TestGroup{Name: "unsent"}, clk.Now(), false)
+	clk.Set(now.Add(70 * time.Minute))
+
+	if diff := cmp.Diff([]string{"stale"}, q.EvictStale(time.Hour)); diff != "" {
+		t.Errorf("EvictStale() got unexpected diff (-want +got):\n%s", diff)
+	}
+	var got []string
+	for _, gs := range q.Snapshot() {
+		got = append(got, gs.Name)
+	}
+	if diff := cmp.Diff([]string{"fresh", "unsent"}, got); diff != "" {
+		t.Errorf("EvictStale() left unexpected groups (-want +got):\n%s", diff)
+	}
+	if got := q.EvictStale(time.Hour); len(got) != 0 {
+		t.Errorf("EvictStale() again got %v, wanted none", got)
+	}
+}
+
+func TestEmitCounts(t *testing.T) {
+	log := logrus.WithField("test", "TestEmitCounts")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.SetFrequency("there", time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Minute)
+	}()
+	<-ch
+	<-ch
+	for i := 0; i < 2; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(time.Minute)
+		<-ch
+	}
+	clk.BlockUntil(1)
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if diff := cmp.Diff(map[string]uint64{"hi": 3, "there": 1}, q.EmitCounts()); diff != "" {
+		t.Errorf("EmitCounts() got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	q.Remove("there")
+	q.Add(&configpb.TestGroup{Name: "new"}, now, false)
+	if diff := cmp.Diff(map[string]uint64{"hi": 3}, q.EmitCounts()); diff != "" {
+		t.Errorf("EmitCounts() after Remove and Add got unexpected diff (-want +got):\n%s", diff)
+	}
+	q.Update([]*configpb.TestGroup{{Name: "new"}}, now)
+	if got := q.EmitCounts(); len(got) != 0 {
+		t.Errorf("EmitCounts() after Update removed hi got %v, wanted none", got)
+	}
+
+	q.Init(log, []*configpb.TestGroup{{Name: "hi"}}, now)
+	if got := q.EmitCounts(); len(got) != 0 {
+		t.Errorf("EmitCounts() after Init got %v, wanted none", got)
+	}
+}
+
+func TestLastSent(t *testing.T) {
+	log := logrus.WithField("test", "TestLastSent")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now.Add(time.Minute))
+	q.Reschedule("there", now.Add(time.Hour))
+
+	if when, ok := q.LastSent("hi"); ok {
+		t.Errorf("LastSent() before Send() got %v, wanted none", when)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	<-ch
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	want := now.Add(time.Minute)
+	if when, ok := q.LastSent("hi"); !ok || !when.Equal(want) {
+		t.Errorf("LastSent() got %v, %t, wanted %v, true", when, ok, want)
+	}
+	if _, ok := q.LastSent("there"); ok {
+		t.Error("LastSent() of unsent group unexpectedly returned a time")
+	}
+	wantSchedule := []GroupSchedule{
+		{Name: "hi", When: want.Add(time.Hour), LastSent: want, Generation: 1},
+		{Name: "there", When: now.Add(time.Hour), Generation: 1},
+	}
+	if diff := cmp.Diff(wantSchedule, q.Snapshot()); diff != "" {
+		t.Errorf("Snapshot() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestDashboardQueue(t *testing.T) {
+	log := logrus.WithField("test", "TestDashboardQueue")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q DashboardQueue
+	q.SetClock(clk)
+	q.Init(log, []*configpb.Dashboard{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now.Add(time.Minute))
+	q.Fix("there", now, false)
+
+	n, d, when := q.Status()
+	if n != 2 || d.GetName() != "there" || !when.Equal(now) {
+		t.Errorf("Status() got %d, %q, %v, wanted 2, %q, %v", n, d.GetName(), when, "there", now)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.Dashboard)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+
+	got := []*configpb.Dashboard{<-ch}
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	got = append(got, <-ch)
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	want := []*configpb.Dashboard{
+		{
+			Name: "there",
+		},
+		{
+			Name: "hi",
+		},
+	}
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if _, d, when := q.Status(); d.GetName() != "there" || !when.Equal(now.Add(time.Hour)) {
+		t.Errorf("Status() after Send() got %q, %v, wanted %q, %v", d.GetName(), when, "there", now.Add(time.Hour))
+	}
+}
+
+func TestInitFromConfig(t *testing.T) {
+	now := time.Now()
+	cfg := &configpb.Configuration{
+		TestGroups: []*configpb.TestGroup{
+			{
+				Name: "hi",
+			},
+			{
+				Name: "there",
+			},
+		},
+		Dashboards: []*configpb.Dashboard{
+			{
+				Name: "dash",
+			},
+		},
+	}
+	cases := []struct {
+		name       string
+		cfg        *configpb.Configuration
+		groups     []string
+		dashboards []string
+	}{
+		{
+			name:       "populated",
+			cfg:        cfg,
+			groups:     []string{"hi", "there"},
+			dashboards: []string{"dash"},
+		},
+		{
+			name: "nil",
+		},
+		{
+			name: "empty",
+			cfg:  &configpb.Configuration{},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			log := logrus.WithField("test", "TestInitFromConfig")
+			var groups TestGroupQueue
+			groups.Init(log, []*configpb.TestGroup{{Name: "old"}}, now)
+			groups.InitFromConfig(log, tc.cfg, now)
+			var got []string
+			for _, gs := range groups.Snapshot() {
+				got = append(got, gs.Name)
+			}
+			if diff := cmp.Diff(tc.groups, got); diff != "" {
+				t.Errorf("InitFromConfig() got unexpected group diff (-want +got):\n%s", diff)
+			}
+
+			var dashboards DashboardQueue
+			dashboards.InitFromConfig(log, tc.cfg, now)
+			got = nil
+			for _, gs := range dashboards.Snapshot() {
+				got = append(got, gs.Name)
+			}
+			if diff := cmp.Diff(tc.dashboards, got); diff != "" {
+				t.Errorf("InitFromConfig() got unexpected dashboard diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFixTestGroups(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name   string
+		groups []string
+		want   map[string]time.Time
+	}{
+		{
+			name: "none",
+			want: map[string]time.Time{
+				"hi":    now,
+				"there": now,
+			},
+		},
+		{
+			name:   "shared group",
+			groups: []string{"shared"},
+			want: map[string]time.Time{
+				"hi":    now.Add(-time.Hour),
+				"there": now.Add(-time.Hour),
+			},
+		},
+		{
+			name:   "one group",
+			groups: []string{"only-there", "missing"},
+			want: map[string]time.Time{
+				"hi":    now,
+				"there": now.Add(-time.Hour),
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q DashboardQueue
+			q.Init(logrus.WithField("name", tc.name), []*configpb.Dashboard{
+				{
+					Name: "hi",
+					DashboardTab: []*configpb.DashboardTab{
+						{
+							TestGroupName: "shared",
+						},
+					},
+				},
+				{
+					Name: "there",
+					DashboardTab: []*configpb.DashboardTab{
+						{
+							TestGroupName: "shared",
+						},
+						{
+							TestGroupName: "only-there",
+						},
+					},
+				},
+			}, now)
+			if err := q.FixTestGroups(now.Add(-time.Hour), false, tc.groups...); err != nil {
+				t.Errorf("FixTestGroups() got unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, q.Current()); diff != "" {
+				t.Errorf("FixTestGroups() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSendWithStats(t *testing.T) {
+	type step struct {
+		at      time.Duration
+		receive int
+	}
+	cases := []struct {
+		name      string
+		frequency time.Duration
+		steps     []step
+		want      map[string]int64
+		wantDepth int
+	}{
+		{
+			name:  "pop",
+			steps: []step{{receive: 2}, {at: time.Second, receive: 1}},
+			want: map[string]int64{
+				"a": 1,
+				"b": 1,
+				"c": 1,
+			},
+			wantDepth: 2,
+		},
+		{
+			name:      "reschedule",
+			frequency: time.Minute,
+			steps: []step{
+				{receive: 2},
+				{at: time.Second, receive: 1},
+				{at: 61 * time.Second, receive: 3},
+				{at: 121 * time.Second, receive: 3},
+			},
+			want: map[string]int64{
+				"a": 3,
+				"b": 3,
+				"c": 3,
+			},
+			wantDepth: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			clk := fake.NewClock(now)
+			var q TestGroupQueue
+			q.SetClock(clk)
+			q.Init(logrus.WithField("name", tc.name), []*configpb.TestGroup{
+				{
+					Name: "a",
+				},
+				{
+					Name: "b",
+				},
+				{
+					Name: "c",
+				},
+			}, now)
+			q.FixAll(map[string]time.Time{
+				"a": now.Add(-time.Second),
+				"b": now,
+				"c": now.Add(time.Second),
+			}, true)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan *configpb.TestGroup)
+			errCh := make(chan error, 1)
+			var stats SendStats
+			go func() {
+				errCh <- q.SendWithStats(ctx, ch, tc.frequency, &stats)
+			}()
+			var sent int64
+			for _, s := range tc.steps {
+				if s.at > 0 {
+					clk.BlockUntil(1)
+					clk.Set(now.Add(s.at))
+				}
+				for i := 0; i < s.receive; i++ {
+					<-ch
+					sent++
+				}
+			}
+			cancel()
+			if err := <-errCh; err != nil && err != context.Canceled {
+				t.Errorf("SendWithStats() got unexpected error: %v", err)
+			}
+
+			if got := stats.Sent(); got != sent {
+				t.Errorf("Sent() got %d, wanted %d", got, sent)
+			}
+			if diff := cmp.Diff(tc.want, stats.Counts()); diff != "" {
+				t.Errorf("Counts() got unexpected diff (-want +got):\n%s", diff)
+			}
+			if got := stats.MaxDepth(); got != tc.wantDepth {
+				t.Errorf("MaxDepth() got %d, wanted %d", got, tc.wantDepth)
+			}
+		})
+	}
+}
+
+type fakeObserver struct {
+	onReschedule func(name string)
+	events       []string
+}
+
+func (o *fakeObserver) OnSend(name string, at time.Time) {
+	o.events = append(o.events, fmt.Sprintf("send %s at %s", name, at.Format(time.Kitchen)))
+}
+
+func (o *fakeObserver) OnReschedule(name string, next time.Time) {
+	o.events = append(o.events, fmt.Sprintf("reschedule %s to %s", name, next.Format(time.Kitchen)))
+	if o.onReschedule != nil {
+		o.onReschedule(name)
+	}
+}
+
+func (o *fakeObserver) OnSkip(name string) {
+	o.events = append(o.events, fmt.Sprintf("skip %s", name))
+}
+
+func TestNewTestGroupQueue(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	var obs fakeObserver
+	q := NewTestGroupQueue(
+		WithClock(clk),
+		WithJitter(10*time.Minute),
+		WithObserver(&obs),
+	)
+	q.Init(logrus.WithField("test", "TestNewTestGroupQueue"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	<-ch
+	clk.BlockUntil(1)
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	_, _, when := q.Status()
+	if min, max := now.Add(time.Hour), now.Add(70*time.Minute); when.Before(min) || !when.Before(max) {
+		t.Errorf("Send() rescheduled to %v, wanted jitter between %v and %v", when, min, max)
+	}
+	want := []string{
+		"reschedule hi to " + when.Format(time.Kitchen),
+		"send hi at 12:00PM",
+	}
+	if diff := cmp.Diff(want, obs.events); diff != "" {
+		t.Errorf("WithObserver() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSendSameTimeOrder(t *testing.T) {
+	now := time.Now()
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	var groups []*configpb.TestGroup
+	for _, name := range []string{"charlie", "alpha", "delta", "bravo"} {
+		groups = append(groups, &configpb.TestGroup{Name: name})
+	}
+	q.Init(logrus.WithField("test", "TestSendSameTimeOrder"), groups, now)
+
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(context.Background(), ch, 0)
+		close(ch)
+	}()
+	var got []string
+	for tg := range ch {
+		got = append(got, tg.Name)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("Send() got unexpected error: %v", err)
+	}
+	want := []string{"alpha", "bravo", "charlie", "delta"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSendSkipped(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSendSkipped"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	mets := NewQueueMetrics("test")
+	q.SetMetrics(mets)
+	// Remove hi once Send takes it off the queue, but before looking it up.
+	q.SetObserver(&fakeObserver{
+		onReschedule: func(name string) {
+			if name == "hi" {
+				q.Remove(name)
+			}
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	var stats SendStats
+	go func() {
+		errCh <- q.SendWithStats(ctx, ch, time.Hour, &stats)
+	}()
+	if got := (<-ch).Name; got != "there" {
+		t.Errorf("SendWithStats() got %q, wanted there", got)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendWithStats() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if got := stats.Skipped(); got != 1 {
+		t.Errorf("Skipped() got %d, wanted 1", got)
+	}
+	if got := testutil.ToFloat64(mets.Skipped); got != 1 {
+		t.Errorf("Skipped metric got %v, wanted 1", got)
+	}
+}
+
+func TestFrequencyFunc(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	q := TestGroupQueue{
+		FrequencyFunc: func(tg *configpb.TestGroup) time.Duration {
+			return time.Duration(tg.GetDaysOfResults()) * time.Hour
+		},
+	}
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestFrequencyFunc"), []*configpb.TestGroup{
+		{
+			Name:          "fast",
+			DaysOfResults: 1,
+		},
+		{
+			Name:          "slow",
+			DaysOfResults: 7,
+		},
+	}, now)
+	q.Add(&configpb.TestGroup{Name: "default"}, now, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, 10*time.Minute)
+	}()
+	for i := 0; i < 3; i++ {
+		<-ch
+	}
+	clk.BlockUntil(1)
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	got := map[string]time.Duration{}
+	for _, gs := range q.Schedule() {
+		got[gs.Name] = gs.When.Sub(now)
+	}
+	want := map[string]time.Duration{
+		"default": 10 * time.Minute,
+		"fast":    time.Hour,
+		"slow":    7 * time.Hour,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestClassFunc(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	dashboards := map[string]string{}
+	var groups []*configpb.TestGroup
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("big-%02d", i)
+		dashboards[name] = "big"
+		groups = append(groups, &configpb.TestGroup{Name: name})
+	}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("small-%d", i)
+		dashboards[name] = "small"
+		groups = append(groups, &configpb.TestGroup{Name: name})
+	}
+	q := TestGroupQueue{
+		ClassFunc: func(tg *configpb.TestGroup) string {
+			return dashboards[tg.Name]
+		},
+	}
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestClassFunc"), groups, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	var got []string
+	for i := 0; i < 8; i++ {
+		got = append(got, dashboards[(<-ch).Name])
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	want := []string{"big", "small", "big", "small", "big", "small", "big", "big"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSetReadyLess(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.PullFrequency = time.Hour
+	q.Init(logrus.WithField("test", "TestSetReadyLess"), []*configpb.TestGroup{
+		{
+			Name:          "hi",
+			DaysOfResults: 1,
+		},
+		{
+			Name:          "later",
+			DaysOfResults: 30,
+		},
+		{
+			Name:          "there",
+			DaysOfResults: 7,
+		},
+		{
+			Name:          "world",
+			DaysOfResults: 3,
+		},
+	}, now)
+	q.Fix("later", now.Add(time.Minute), true)
+	// Send groups showing the most results first.
+	q.SetReadyLess(func(a, b *configpb.TestGroup) bool {
+		return a.DaysOfResults > b.DaysOfResults
+	})
+
+	ctx := context.Background()
+	var got []string
+	for i := 0; i < 3; i++ {
+		tg, err := q.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next() got unexpected error: %v", err)
+		}
+		got = append(got, tg.Name)
+	}
+	if diff := cmp.Diff([]string{"there", "world", "hi"}, got); diff != "" {
+		t.Errorf("Next() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFIFO(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.FIFO = true
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestFIFO"), []*configpb.TestGroup{
+		{
+			Name: "zz",
+		},
+		{
+			Name: "aa",
+		},
+		{
+			Name: "mm",
+		},
+	}, now.Add(time.Hour))
+
+	ch := make(chan *configpb.TestGroup, 10)
+	if err := q.Send(context.Background(), ch, time.Minute); err != nil {
+		t.Fatalf("Send() got unexpected error: %v", err)
+	}
+	close(ch)
+	var got []string
+	for tg := range ch {
+		got = append(got, tg.Name)
+	}
+	if diff := cmp.Diff([]string{"zz", "aa", "mm"}, got); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if n, _, _ := q.Status(); n != 0 {
+		t.Errorf("Send() left %d groups, wanted none", n)
+	}
+}
+
+func TestInitNow(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name   string
+		jitter time.Duration
+	}{
+		{
+			name: "basic",
+		},
+		{
+			name:   "jitter",
+			jitter: time.Minute,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clk := fake.NewClock(now)
+			q := NewTestGroupQueue(WithClock(clk), WithJitter(tc.jitter))
+			log := logrus.WithField("name", tc.name)
+			q.Init(log, []*configpb.TestGroup{{Name: "existing"}}, now.Add(time.Hour))
+			q.InitNow(log, []*configpb.TestGroup{
+				{
+					Name: "existing",
+				},
+				{
+					Name: "hi",
+				},
+				{
+					Name: "there",
+				},
+			})
+			for _, gs := range q.Schedule() {
+				if gs.When.Before(now) || gs.When.After(now.Add(tc.jitter)) {
+					t.Errorf("InitNow() scheduled %s at %v, wanted at most %s after %v", gs.Name, gs.When, tc.jitter, now)
+				}
+			}
+			clk.Advance(tc.jitter)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan *configpb.TestGroup)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- q.Send(ctx, ch, time.Hour)
+			}()
+			got := map[string]bool{}
+			for i := 0; i < 3; i++ {
+				got[(<-ch).Name] = true
+			}
+			cancel()
+			if err := <-errCh; err != context.Canceled {
+				t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+			want := map[string]bool{"existing": true, "hi": true, "there": true}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSetObserver(t *testing.T) {
+	log := logrus.WithField("test", "TestSetObserver")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.Reschedule("there", now.Add(time.Minute))
+
+	obs := fakeObserver{
+		onReschedule: func(name string) {
+			if name == "there" {
+				q.Remove(name) // calls back into the queue
+			}
+		},
+	}
+	q.SetObserver(&obs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	<-ch
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	clk.BlockUntil(1) // skipped there
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	want := []string{
+		"reschedule hi to 1:00PM",
+		"send hi at 12:00PM",
+		"reschedule there to 1:01PM",
+		"skip there",
+	}
+	if diff := cmp.Diff(want, obs.events); diff != "" {
+		t.Errorf("SetObserver() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestInitE(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name   string
+		groups []*configpb.TestGroup
+		err    string // in the error, if any
+		want   []string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "unique",
+			groups: []*configpb.TestGroup{{Name: "hi"}, {Name: "there"}},
+			want:   []string{"hi", "there"},
+		},
+		{
+			name:   "duplicate",
+			groups: []*configpb.TestGroup{{Name: "hi"}, {Name: "there"}, {Name: "hi"}},
+			err:    `"hi"`,
+			want:   []string{"before"},
+		},
+		{
+			name:   "nil",
+			groups: []*configpb.TestGroup{{Name: "hi"}, nil, {Name: "there"}},
+			err:    "item 1: nil",
+			want:   []string{"before"},
+		},
+		{
+			name:   "empty name",
+			groups: []*configpb.TestGroup{{Name: "hi"}, {Name: " "}},
+			err:    "item 1: empty name",
+			want:   []string{"before"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			log := logrus.WithField("name", tc.name)
+			var q TestGroupQueue
+			q.Init(log, []*configpb.TestGroup{{Name: "before"}}, now)
+			err := q.InitE(log, tc.groups, now)
+			switch {
+			case err != nil && tc.err == "":
+				t.Errorf("InitE() got unexpected error: %v", err)
+			case err == nil && tc.err != "":
+				t.Error("InitE() failed to return an error")
+			case err != nil && !strings.Contains(err.Error(), tc.err):
+				t.Errorf("InitE() got error %v, wanted it to contain %q", err, tc.err)
+			}
+			var got []string
+			for _, gs := range q.Snapshot() {
+				got = append(got, gs.Name)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("InitE() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDashboardQueueInitE(t *testing.T) {
+	var q DashboardQueue
+	err := q.InitE(logrus.WithField("test", "TestDashboardQueueInitE"), []*configpb.Dashboard{{Name: "hi"}, {Name: "hi"}}, time.Now())
+	if err == nil {
+		t.Error("InitE() failed to return an error")
+	}
+}
+
+func TestInitNil(t *testing.T) {
+	log := logrus.WithField("test", "TestInitNil")
+	now := time.Now()
+	var q TestGroupQueue
+	q.Init(log, []*configpb.TestGroup{nil, {Name: "hi"}, nil, {Name: "there"}, nil}, now)
+	q.Update([]*configpb.TestGroup{{Name: "hi"}, nil, {Name: "there"}}, now)
+	q.Add(nil, now, false)
+	if err := q.UpdateGroup(nil); err == nil {
+		t.Error("UpdateGroup(nil) failed to return an error")
+	}
+	var got []string
+	for _, gs := range q.Snapshot() {
+		got = append(got, gs.Name)
+	}
+	if diff := cmp.Diff([]string{"hi", "there"}, got); diff != "" {
+		t.Errorf("Init() got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	var dq DashboardQueue
+	dq.Init(log, []*configpb.Dashboard{{Name: "hi"}, nil}, now)
+	if n, _, _ := dq.Status(); n != 1 {
+		t.Errorf("DashboardQueue.Init() got %d dashboards, wanted 1", n)
+	}
+}
+
+func TestInitMap(t *testing.T) {
+	log := logrus.WithField("test", "TestInitMap")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	groups := []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+		{
+			Name: "again",
+		},
+	}
+	var want TestGroupQueue
+	want.SetClock(fake.NewClock(now))
+	want.Init(log, groups, now)
+
+	byName := map[string]*configpb.TestGroup{}
+	for _, tg := range groups {
+		byName[tg.Name] = tg
+	}
+	byName["nil"] = nil
+	var got TestGroupQueue
+	got.SetClock(fake.NewClock(now))
+	got.InitMap(log, byName, now)
+
+	if diff := cmp.Diff(want.Snapshot(), got.Snapshot()); diff != "" {
+		t.Errorf("InitMap() got unexpected diff (-Init +InitMap):\n%s", diff)
+	}
+	wantN, wantNext, wantWhen := want.Status()
+	gotN, gotNext, gotWhen := got.Status()
+	if gotN != wantN || gotNext != wantNext || !gotWhen.Equal(wantWhen) {
+		t.Errorf("InitMap() got status %d, %v, %v, wanted %d, %v, %v like Init", gotN, gotNext, gotWhen, wantN, wantNext, wantWhen)
+	}
+	if diff := cmp.Diff(want.Peek(3), got.Peek(3), protocmp.Transform()); diff != "" {
+		t.Errorf("InitMap() got unexpected order (-Init +InitMap):\n%s", diff)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	now := time.Now()
+	var q TestGroupQueue
+	q.Init(logrus.WithField("test", "TestUpdate"), []*configpb.TestGroup{
+		{
+			Name: "kept",
+		},
+		{
+			Name: "removed",
+		},
+	}, now)
+	q.Fix("kept", now.Add(time.Hour), true)
+
+	later := now.Add(time.Minute)
+	q.Update([]*configpb.TestGroup{
+		{
+			Name:      "kept",
+			GcsPrefix: "new/prefix",
+		},
+		{
+			Name: "added",
+		},
+	}, later)
+
+	want := []GroupSchedule{
+		{
+			Name:       "added",
+			When:       later,
+			Generation: 2,
+		},
+		{
+			Name:       "kept",
+			When:       now.Add(time.Hour),
+			Generation: 2,
+		},
+	}
+	if diff := cmp.Diff(want, q.Snapshot()); diff != "" {
+		t.Errorf("Update() got unexpected diff (-want +got):\n%s", diff)
+	}
+	tg, _, _ := q.StatusOf("kept")
+	if got := tg.GetGcsPrefix(); got != "new/prefix" {
+		t.Errorf("Update() kept GcsPrefix %q, wanted new/prefix", got)
+	}
+}
+
+func TestUpdateGroup(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestUpdateGroup"), []*configpb.TestGroup{
+		{
+			Name:      "hi",
+			GcsPrefix: "old/prefix",
+		},
+	}, now.Add(time.Hour))
+
+	if err := q.UpdateGroup(&configpb.TestGroup{Name: "missing"}); err == nil {
+		t.Error("UpdateGroup(missing) failed to return an error")
+	}
+	updated := &configpb.TestGroup{
+		Name:      "hi",
+		GcsPrefix: "new/prefix",
+	}
+	if err := q.UpdateGroup(updated); err != nil {
+		t.Fatalf("UpdateGroup() got unexpected error: %v", err)
+	}
+	if _, _, when := q.Status(); !when.Equal(now.Add(time.Hour)) {
+		t.Errorf("UpdateGroup() moved hi to %v, wanted %v", when, now.Add(time.Hour))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(time.Hour)
+	got := <-ch
+	if diff := cmp.Diff(updated, got, protocmp.Transform()); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestInitValidated(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name     string
+		groups   []string
+		problems int
+		err      bool
+		want     []string
+	}{
+		{
+			name:   "valid",
+			groups: []string{"hi", "there"},
+			want:   []string{"hi", "there"},
+		},
+		{
+			name:     "empty names",
+			groups:   []string{"hi", "", "  ", "there"},
+			problems: 2,
+			want:     []string{"hi", "there"},
+		},
+		{
+			name:     "duplicate",
+			groups:   []string{"hi", "", "hi"},
+			problems: 1,
+			err:      true,
+			want:     []string{"before"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			log := logrus.WithField("name", tc.name)
+			var q TestGroupQueue
+			q.Init(log, []*configpb.TestGroup{{Name: "before"}}, now)
+			var groups []*configpb.TestGroup
+			for _, name := range tc.groups {
+				groups = append(groups, &configpb.TestGroup{Name: name})
+			}
+			problems, err := q.InitValidated(log, groups, now)
+			switch {
+			case err != nil && !tc.err:
+				t.Errorf("InitValidated() got unexpected error: %v", err)
+			case err == nil && tc.err:
+				t.Error("InitValidated() failed to return an error")
+			}
+			if len(problems) != tc.problems {
+				t.Errorf("InitValidated() got problems %v, wanted %d", problems, tc.problems)
+			}
+			var got []string
+			for _, gs := range q.Snapshot() {
+				got = append(got, gs.Name)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("InitValidated() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDashboardQueueInitValidated(t *testing.T) {
+	var q DashboardQueue
+	problems, err := q.InitValidated(logrus.WithField("test", "TestDashboardQueueInitValidated"), []*configpb.Dashboard{{Name: "hi"}, {}}, time.Now())
+	if err != nil {
+		t.Errorf("InitValidated() got unexpected error: %v", err)
+	}
+	if len(problems) != 1 {
+		t.Errorf("InitValidated() got problems %v, wanted 1", problems)
+	}
+	if depth, _, _ := q.Status(); depth != 1 {
+		t.Errorf("InitValidated() got depth %d, wanted 1", depth)
+	}
+}
+
+func TestSendWithPolicy(t *testing.T) {
+	cases := []struct {
+		name        string
+		policy      DropPolicy
+		wantDropped int64
+		want        map[string]time.Duration
+	}{
+		{
+			name:   "block",
+			policy: Block,
+		},
+		{
+			name:        "drop newest",
+			policy:      DropNewest,
+			wantDropped: 2,
+			want: map[string]time.Duration{
+				"hi":    2 * time.Hour,
+				"there": time.Hour,
+			},
+		},
+		{
+			name:        "drop and reschedule",
+			policy:      DropAndReschedule,
+			wantDropped: 2,
+			want: map[string]time.Duration{
+				"hi":    time.Hour,
+				"there": time.Hour,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			clk := fake.NewClock(now)
+			var q TestGroupQueue
+			q.SetClock(clk)
+			q.Init(logrus.WithField("name", tc.name), []*configpb.TestGroup{
+				{
+					Name: "hi",
+				},
+				{
+					Name: "there",
+				},
+			}, now.Add(-time.Minute))
+			q.SetFrequency("hi", 2*time.Hour)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var stats SendStats
+			errCh := make(chan error, 1)
+			go func() {
+				// Nothing receives, so every send either blocks or drops.
+				errCh <- q.SendWithPolicy(ctx, make(chan *configpb.TestGroup), time.Hour, tc.policy, &stats)
+			}()
+			if tc.policy != Block {
+				clk.BlockUntil(1) // Wait until both groups are taken off the queue.
+			}
+			cancel()
+			if err := <-errCh; err != context.Canceled {
+				t.Errorf("SendWithPolicy() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+
+			if got := stats.Dropped(); got != tc.wantDropped {
+				t.Errorf("Dropped() got %d, wanted %d", got, tc.wantDropped)
+			}
+			if got := stats.Sent(); got != 0 {
+				t.Errorf("Sent() got %d, wanted 0", got)
+			}
+			if tc.want == nil {
+				return
+			}
+			got := map[string]time.Duration{}
+			for _, gs := range q.Schedule() {
+				got[gs.Name] = gs.When.Sub(now)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Schedule() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.PullFrequency = time.Minute
+	q.Init(logrus.WithField("test", "TestNext"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.Fix("there", now.Add(time.Second), true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// next advances the clock by d once Next is waiting, and returns what it got.
+	next := func(d time.Duration) string {
+		t.Helper()
+		ch := make(chan string, 1)
+		go func() {
+			tg, err := q.Next(ctx)
+			if err != nil {
+				t.Errorf("Next() got unexpected error: %v", err)
+			}
+			ch <- tg.GetName()
+		}()
+		if d > 0 {
+			clk.BlockUntil(1)
+			clk.Advance(d)
+		}
+		return <-ch
+	}
+
+	got := []string{
+		next(0),
+		next(time.Second),
+		next(59 * time.Second),
+		next(time.Second),
+	}
+	want := []string{"hi", "there", "hi", "there"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Next() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if when, ok := q.LastSent("there"); !ok || !when.Equal(now.Add(61*time.Second)) {
+		t.Errorf("LastSent() got %v, %t, wanted %v, true", when, ok, now.Add(61*time.Second))
+	}
+
+	cancel()
+	if _, err := q.Next(ctx); err != context.Canceled {
+		t.Errorf("Next() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestNextPop(t *testing.T) {
+	now := time.Now()
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestNextPop"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if tg, err := q.Next(ctx); err != nil || tg.Name != "hi" {
+		t.Fatalf("Next() got %v, %v, wanted hi", tg, err)
+	}
+	ch := make(chan *configpb.TestGroup)
+	go func() {
+		// The queue is empty, so this waits for there to be added.
+		tg, _ := q.Next(ctx)
+		ch <- tg
+	}()
+	q.Add(&configpb.TestGroup{Name: "there"}, now, false)
+	if tg := <-ch; tg.GetName() != "there" {
+		t.Errorf("Next() got %v, wanted there", tg)
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	now := time.Now()
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.PullFrequency = time.Minute
+	q.Init(logrus.WithField("test", "TestNextBatch"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+		{
+			Name: "world",
+		},
+		{
+			Name: "later",
+		},
+	}, now)
+	q.Fix("later", now.Add(time.Hour), true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	batch, err := q.NextBatch(ctx, 5)
+	if err != nil {
+		t.Fatalf("NextBatch() got unexpected error: %v", err)
+	}
+	var got []string
+	for _, tg := range batch {
+		got = append(got, tg.Name)
+	}
+	sort.Strings(got)
+	want := []string{"hi", "there", "world"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("NextBatch() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if when, ok := q.LastSent("world"); !ok || !when.Equal(now) {
+		t.Errorf("LastSent() got %v, %t, wanted %v, true", when, ok, now)
+	}
+
+	cancel()
+	if _, err := q.NextBatch(ctx, 5); err != context.Canceled {
+		t.Errorf("NextBatch() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestTryNext(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.PullFrequency = time.Hour
+	q.Init(logrus.WithField("test", "TestTryNext"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "removed",
+		},
+	}, now.Add(time.Minute))
+	if tg, ok := q.TryNext(); ok {
+		t.Errorf("TryNext() of a future queue got %q, wanted nothing", tg.Name)
+	}
+
+	clk.Advance(time.Minute)
+	q.Fix("removed", now, false)
+	q.Remove("removed")
+	tg, ok := q.TryNext()
+	if !ok || tg.Name != "hi" {
+		t.Fatalf("TryNext() got %v, %t, wanted hi, true", tg, ok)
+	}
+	if _, st, _ := q.StatusOf("hi"); !st.When.Equal(clk.Now().Add(time.Hour)) {
+		t.Errorf("TryNext() rescheduled hi to %v, wanted %v", st.When, clk.Now().Add(time.Hour))
+	}
+	if tg, ok := q.TryNext(); ok {
+		t.Errorf("TryNext() got %q after taking every ready group, wanted nothing", tg.Name)
+	}
+
+	q.Close()
+	clk.Advance(time.Hour)
+	if tg, ok := q.TryNext(); ok {
+		t.Errorf("TryNext() of a closed queue got %q, wanted nothing", tg.Name)
+	}
+}
+
+func TestStatusOfTrigger(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.PullFrequency = time.Hour
+	q.Init(logrus.WithField("test", "TestStatusOfTrigger"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now.Add(time.Minute))
+	if _, st, _ := q.StatusOf("hi"); st.Triggered {
+		t.Errorf("StatusOf() of a group never sent got trigger %v", st.Trigger)
+	}
+
+	clk.Advance(time.Minute)
+	for i := 0; i < 2; i++ {
+		if _, ok := q.TryNext(); !ok {
+			t.Fatal("TryNext() got nothing, wanted a scheduled group")
+		}
+	}
+	if err := q.Poke("there"); err != nil {
+		t.Fatalf("Poke() got unexpected error: %v", err)
+	}
+	if tg, ok := q.TryNext(); !ok || tg.Name != "there" {
+		t.Fatalf("TryNext() got %v, %t, wanted the poked group", tg, ok)
+	}
+	if err := q.Pause("hi"); err != nil {
+		t.Fatalf("Pause() got unexpected error: %v", err)
+	}
+	if err := q.Resume("hi"); err != nil {
+		t.Fatalf("Resume() got unexpected error: %v", err)
+	}
+	if tg, ok := q.TryNext(); !ok || tg.Name != "hi" {
+		t.Fatalf("TryNext() got %v, %t, wanted the resumed group", tg, ok)
+	}
+
+	want := map[string]queue.Trigger{
+		"hi":    queue.TriggerResumed,
+		"there": queue.TriggerPoked,
+	}
+	for name, w := range want {
+		if _, st, _ := q.StatusOf(name); !st.Triggered || st.Trigger != w {
+			t.Errorf("StatusOf(%q) got trigger %v, %t, wanted %v", name, st.Trigger, st.Triggered, w)
+		}
+	}
+
+	clk.Advance(time.Hour)
+	if tg, ok := q.TryNext(); !ok || tg.Name != "there" {
+		t.Fatalf("TryNext() got %v, %t, wanted the group due on schedule", tg, ok)
+	}
+	if _, st, _ := q.StatusOf("there"); st.Trigger != queue.TriggerScheduled {
+		t.Errorf("StatusOf() after a scheduled send got trigger %v, wanted %v", st.Trigger, queue.TriggerScheduled)
+	}
+}
+
+func TestLease(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.PullFrequency = time.Minute
+	q.Init(logrus.WithField("test", "TestLease"), []*configpb.TestGroup{{Name: "hi"}}, now)
+	if err := q.Lease("missing", time.Hour); err == nil {
+		t.Error("Lease() of a missing group got no error")
+	}
+
+	if _, ok := q.TryNext(); !ok {
+		t.Fatal("TryNext() got nothing, wanted a ready group")
+	}
+	if err := q.Lease("hi", 10*time.Minute); err != nil {
+		t.Fatalf("Lease() got unexpected error: %v", err)
+	}
+	clk.Advance(time.Minute)
+	if err := q.Poke("hi"); err != nil {
+		t.Fatalf("Poke() got unexpected error: %v", err)
+	}
+	if tg, ok := q.TryNext(); ok {
+		t.Fatalf("TryNext() of a leased group got %q, wanted nothing", tg.Name)
+	}
+	if _, st, _ := q.StatusOf("hi"); !st.When.Equal(now.Add(10 * time.Minute)) {
+		t.Errorf("TryNext() deferred the leased group to %v, wanted %v", st.When, now.Add(10*time.Minute))
+	}
+
+	clk.Advance(9 * time.Minute)
+	if tg, ok := q.TryNext(); !ok || tg.Name != "hi" {
+		t.Errorf("TryNext() once the lease expired got %v, %t, wanted hi, true", tg, ok)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name  string
+		later bool
+		want  map[string]time.Time
+	}{
+		{
+			name: "earlier",
+			want: map[string]time.Time{
+				"hi":    now,
+				"both":  now.Add(time.Minute),
+				"there": now.Add(2 * time.Hour),
+			},
+		},
+		{
+			name:  "later",
+			later: true,
+			want: map[string]time.Time{
+				"hi":    now,
+				"both":  now.Add(time.Hour),
+				"there": now.Add(2 * time.Hour),
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			log := logrus.WithField("name", tc.name)
+			var q, other TestGroupQueue
+			q.SetClock(fake.NewClock(now))
+			other.SetClock(fake.NewClock(now))
+			q.Init(log, []*configpb.TestGroup{{Name: "hi"}}, now)
+			q.Add(&configpb.TestGroup{Name: "both"}, now.Add(time.Minute), false)
+			other.Init(log, []*configpb.TestGroup{{Name: "both"}}, now.Add(time.Hour))
+			other.Add(&configpb.TestGroup{Name: "there"}, now.Add(2*time.Hour), false)
+
+			q.Merge(&other, tc.later)
+			got := map[string]time.Time{}
+			for _, gs := range q.Schedule() {
+				got[gs.Name] = gs.When
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Merge() got unexpected diff (-want +got):\n%s", diff)
+			}
+			if n := len(other.Schedule()); n != 2 {
+				t.Errorf("Merge() left %d groups in the other queue, wanted 2", n)
+			}
+			if tg, _, ok := q.StatusOf("there"); !ok || tg.Name != "there" {
+				t.Errorf("StatusOf() of a merged group got %v, %t", tg, ok)
+			}
+		})
+	}
+
+	t.Run("both ways", func(t *testing.T) {
+		log := logrus.WithField("name", "both ways")
+		var q, other TestGroupQueue
+		q.Init(log, []*configpb.TestGroup{{Name: "hi"}}, now)
+		other.Init(log, []*configpb.TestGroup{{Name: "there"}}, now)
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				q.Merge(&other, false)
+			}()
+			go func() {
+				defer wg.Done()
+				other.Merge(&q, false)
+			}()
+		}
+		wg.Wait()
+		if n, m := len(q.Schedule()), len(other.Schedule()); n != 2 || m != 2 {
+			t.Errorf("Merge() both ways got %d and %d groups, wanted 2 and 2", n, m)
+		}
+	})
+}
+
+func TestSendFlush(t *testing.T) {
+	now := time.Now()
+	var q TestGroupQueue
+	q.FlushTimeout = time.Minute
+	q.Init(logrus.WithField("test", "TestSendFlush"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+		{
+			Name: "world",
+		},
+	}, now.Add(-time.Minute))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	got := map[string]bool{(<-ch).Name: true}
+	cancel()
+	for len(got) < 3 {
+		select {
+		case tg := <-ch:
+			got[tg.Name] = true
+		case err := <-errCh:
+			t.Fatalf("Send() returned %v before flushing overdue groups, only sent %v", err, got)
+		}
+	}
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	q.FlushTimeout = 10 * time.Millisecond
+	q.Fix("hi", now, false)
+	if err := q.Send(ctx, ch, time.Hour); err != context.Canceled {
+		t.Errorf("Send() without a receiver returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if when, _ := q.Queue.When("hi"); !when.Equal(now) {
+		t.Errorf("Send() left the unsent group at %v, wanted %v", when, now)
+	}
+
+	// Puts back a group it popped at zero frequency.
+	var zero TestGroupQueue
+	zero.FlushTimeout = 10 * time.Millisecond
+	zero.Init(logrus.WithField("test", "TestSendFlush"), []*configpb.TestGroup{{Name: "hi"}}, now)
+	if err := zero.Send(ctx, ch, 0); err != context.Canceled {
+		t.Errorf("Send() at zero frequency returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if when, ok := zero.Queue.When("hi"); !ok || !when.Equal(now) {
+		t.Errorf("Send() at zero frequency left the unsent group at %v, %t, wanted %v", when, ok, now)
+	}
+	if n := zero.Len(); n != 1 {
+		t.Errorf("Len() after flushing at zero frequency got %d, wanted 1", n)
+	}
+}
+
+func TestQueueReader(t *testing.T) {
+	now := time.Now()
+	var q TestGroupQueue
+	q.Init(logrus.WithField("test", "TestQueueReader"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.Fix("there", now.Add(-time.Minute), false)
+
+	// next reads the queue only through the read-only view.
+	next := func(r QueueReader[*configpb.TestGroup]) (string, int, bool) {
+		_, who, _ := r.Status()
+		_, _, ok := r.StatusOf(who.Name)
+		return who.Name, len(r.Schedule()), ok && r.Len() == 2
+	}
+	name, n, ok := next(&q)
+	if name != "there" || n != 2 || !ok {
+		t.Errorf("QueueReader got %q, %d, %t, wanted there, 2, true", name, n, ok)
+	}
+}
+
+func TestScheduleWithLabels(t *testing.T) {
+	now := time.Now()
+	log := logrus.WithField("test", "TestScheduleWithLabels")
+	var q TestGroupQueue
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+		{
+			Name: "world",
+		},
+	}, now)
+	if err := q.SetLabels("missing", map[string]string{"team": "a"}); err == nil {
+		t.Error("SetLabels() of a missing group got no error")
+	}
+	labels := map[string]string{"team": "a", "release": "1"}
+	if err := q.SetLabels("hi", labels); err != nil {
+		t.Fatalf("SetLabels() got unexpected error: %v", err)
+	}
+	labels["team"] = "changed"
+	if err := q.SetLabels("there", map[string]string{"team": "a"}); err != nil {
+		t.Fatalf("SetLabels() got unexpected error: %v", err)
+	}
+	if err := q.SetLabels("world", map[string]string{"team": "b"}); err != nil {
+		t.Fatalf("SetLabels() got unexpected error: %v", err)
+	}
+
+	names := func(sel map[string]string) []string {
+		var names []string
+		for _, gs := range q.ScheduleWithLabels(sel) {
+			names = append(names, gs.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	cases := []struct {
+		sel  map[string]string
+		want []string
+	}{
+		{
+			want: []string{"hi", "there", "world"},
+		},
+		{
+			sel:  map[string]string{"team": "a"},
+			want: []string{"hi", "there"},
+		},
+		{
+			sel:  map[string]string{"team": "a", "release": "1"},
+			want: []string{"hi"},
+		},
+		{
+			sel: map[string]string{"team": "changed"},
+		},
+	}
+	for _, tc := range cases {
+		if diff := cmp.Diff(tc.want, names(tc.sel)); diff != "" {
+			t.Errorf("ScheduleWithLabels(%v) got unexpected diff (-want +got):\n%s", tc.sel, diff)
+		}
+	}
+
+	q.Update([]*configpb.TestGroup{{Name: "hi"}, {Name: "world"}}, now)
+	if diff := cmp.Diff(map[string]string{"team": "a", "release": "1"}, q.Labels("hi")); diff != "" {
+		t.Errorf("Update() changed the labels of a group it kept (-want +got):\n%s", diff)
+	}
+	if err := q.Remove("world"); err != nil {
+		t.Fatalf("Remove() got unexpected error: %v", err)
+	}
+	q.Add(&configpb.TestGroup{Name: "world"}, now, false)
+	q.Add(&configpb.TestGroup{Name: "there"}, now, false)
+	if got := names(map[string]string{"team": "b"}); len(got) != 0 {
+		t.Errorf("ScheduleWithLabels() after Remove got %v, wanted nothing", got)
+	}
+	if got := names(map[string]string{"team": "a"}); !cmp.Equal(got, []string{"hi"}) {
+		t.Errorf("ScheduleWithLabels() after Update removed there got %v, wanted [hi]", got)
+	}
+}
+
+func TestAdaptiveFrequency(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.PullFrequency = 4 * time.Minute
+	q.Adaptive = &AdaptiveFrequency{Floor: time.Minute, Ceiling: 8 * time.Minute, Factor: 2}
+	q.Init(logrus.WithField("test", "TestAdaptiveFrequency"), []*configpb.TestGroup{{Name: "hi"}}, now)
+	var print int
+	if err := q.SetFingerprint("hi", func() (string, error) { return fmt.Sprint(print), nil }); err != nil {
+		t.Fatalf("SetFingerprint() got unexpected error: %v", err)
+	}
+	if _, ok := q.TryNext(); !ok {
+		t.Fatal("TryNext() got nothing, wanted a ready group")
+	}
+
+	cases := []struct {
+		changed bool
+		want    time.Duration
+	}{
+		{changed: true, want: 2 * time.Minute},
+		{changed: true, want: time.Minute},
+		{changed: true, want: time.Minute},
+		{want: 2 * time.Minute},
+		{want: 4 * time.Minute},
+		{want: 8 * time.Minute},
+		{want: 8 * time.Minute},
+		{changed: true, want: 4 * time.Minute},
+	}
+	for i, tc := range cases {
+		if tc.changed {
+			print++
+		}
+		clk.Advance(10 * time.Minute)
+		if _, ok := q.TryNext(); ok != tc.changed {
+			t.Errorf("%d: TryNext() got %t, wanted %t", i, ok, tc.changed)
+		}
+		if got := q.Queue.Frequency("hi", q.PullFrequency); got != tc.want {
+			t.Errorf("%d: adapted frequency got %v, wanted %v", i, got, tc.want)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	now := time.Now()
+	log := logrus.WithField("test", "TestReset")
+	var q TestGroupQueue
+	q.Reset()
+	q.Init(log, []*configpb.TestGroup{{Name: "hi"}, {Name: "there"}}, now.Add(time.Hour))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+
+	gen := q.Generation()
+	q.Reset()
+	if n := q.Len(); n != 0 {
+		t.Errorf("Reset() left %d groups, wanted none", n)
+	}
+	if got := q.Generation(); got <= gen {
+		t.Errorf("Reset() left the generation at %d, wanted more than %d", got, gen)
+	}
+	if counts := q.EmitCounts(); len(counts) != 0 {
+		t.Errorf("Reset() kept counts %v", counts)
+	}
+
+	q.Init(log, []*configpb.TestGroup{{Name: "world"}}, now)
+	if got := (<-ch).Name; got != "world" {
+		t.Errorf("Send() after Reset() and Init() got %q, wanted world", got)
+	}
+	if n := q.Len(); n != 1 {
+		t.Errorf("Init() after Reset() got %d groups, wanted 1", n)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	var dq DashboardQueue
+	dq.Init(log, []*configpb.Dashboard{{Name: "dash", DashboardTab: []*configpb.DashboardTab{{TestGroupName: "hi"}}}}, now)
+	dq.Reset()
+	if n := dq.Len(); n != 0 {
+		t.Errorf("DashboardQueue.Reset() left %d dashboards, wanted none", n)
+	}
+	if err := dq.FixTestGroups(now, false, "hi"); err != nil {
+		t.Errorf("FixTestGroups() after Reset() got unexpected error: %v", err)
+	}
+}
+
+func TestSetActiveHours(t *testing.T) {
+	tz := time.FixedZone("EST", -5*60*60)
+	now := time.Date(2022, 6, 1, 22, 0, 0, 0, tz)
+	cases := []struct {
+		name       string
+		start, end time.Duration
+		want       time.Time
+	}{
+		{
+			name:  "closed",
+			start: 9 * time.Hour,
+			end:   17 * time.Hour,
+			want:  time.Date(2022, 6, 2, 9, 0, 0, 0, tz),
+		},
+		{
+			name:  "later today",
+			start: 23 * time.Hour,
+			end:   time.Hour,
+			want:  time.Date(2022, 6, 1, 23, 0, 0, 0, tz),
+		},
+		{
+			name:  "open over midnight",
+			start: 21 * time.Hour,
+			end:   6 * time.Hour,
+			want:  now,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clk := fake.NewClock(now)
+			var q TestGroupQueue
+			q.SetClock(clk)
+			q.PullFrequency = time.Hour
+			q.Init(logrus.WithField("name", tc.name), []*configpb.TestGroup{{Name: "hi"}}, now)
+			if err := q.SetActiveHours("hi", tz, tc.start, tc.end); err != nil {
+				t.Fatalf("SetActiveHours() got unexpected error: %v", err)
+			}
+			if !tc.want.After(now) {
+				if _, ok := q.TryNext(); !ok {
+					t.Error("TryNext() within active hours got nothing")
+				}
+				return
+			}
+			if tg, ok := q.TryNext(); ok {
+				t.Fatalf("TryNext() outside active hours got %q, wanted nothing", tg.Name)
+			}
+			if _, st, _ := q.StatusOf("hi"); !st.When.Equal(tc.want) {
+				t.Errorf("TryNext() deferred the group to %v, wanted %v", st.When, tc.want)
+			}
+			clk.Set(tc.want)
+			if _, ok := q.TryNext(); !ok {
+				t.Error("TryNext() once active hours start got nothing")
+			}
+		})
+	}
+
+	var q TestGroupQueue
+	q.Init(logrus.WithField("test", "TestSetActiveHours"), []*configpb.TestGroup{{Name: "hi"}}, now)
+	if err := q.SetActiveHours("hi", tz, 0, 25*time.Hour); err == nil {
+		t.Error("SetActiveHours() beyond a day got no error")
+	}
+	if err := q.SetActiveHours("missing", tz, time.Hour, 2*time.Hour); err == nil {
+		t.Error("SetActiveHours() of a missing group got no error")
+	}
+}
+
+func TestInitLazy(t *testing.T) {
+	now := time.Now()
+	store := map[string]*configpb.TestGroup{
+		"hi":    {Name: "hi", DaysOfResults: 1},
+		"there": {Name: "there", DaysOfResults: 2},
+	}
+	var loads int32
+	load := func(name string) *configpb.TestGroup {
+		atomic.AddInt32(&loads, 1)
+		return store[name]
+	}
+	var q TestGroupQueue
+	q.InitLazy(logrus.WithField("test", "TestInitLazy"), []string{"hi", "there", "missing"}, now, load)
+	q.Fix("there", now.Add(-time.Minute), false)
+	q.Fix("missing", now.Add(-time.Hour), false)
+	for name, item := range q.items {
+		if item != nil {
+			t.Errorf("InitLazy() held %q in memory: %v", name, item)
+		}
+	}
+	if _, tg, _ := q.Status(); tg != nil {
+		t.Errorf("Status() of a group load cannot find got %v, wanted nil", tg)
+	}
+	if tg, _, ok := q.StatusOf("hi"); !ok || tg.GetDaysOfResults() != 1 {
+		t.Errorf("StatusOf() got %v, %t, wanted the loaded group", tg, ok)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	for _, want := range []*configpb.TestGroup{store["there"], store["hi"]} {
+		if diff := cmp.Diff(want, <-ch, protocmp.Transform()); diff != "" {
+			t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+		}
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if n := atomic.LoadInt32(&loads); n < 4 {
+		t.Errorf("load got %d calls, wanted at least 4", n)
+	}
+
+	q.Init(logrus.WithField("test", "TestInitLazy"), []*configpb.TestGroup{{Name: "hi"}}, now)
+	if tg, _, _ := q.StatusOf("hi"); tg.GetDaysOfResults() != 0 {
+		t.Errorf("StatusOf() after Init got %v, wanted the group it was given", tg)
+	}
+}
+
+func TestSetRamp(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	var groups []*configpb.TestGroup
+	for i := 0; i < 10; i++ {
+		groups = append(groups, &configpb.TestGroup{Name: fmt.Sprint(i)})
+	}
+	q.Init(logrus.WithField("test", "TestSetRamp"), groups, now)
+	q.SetRamp(1, 10, 10*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	<-ch
+	// The ramp allows t + 0.45t^2 sends after t seconds, so a second one after about 750ms.
+	clk.BlockUntil(1)
+	clk.Advance(700 * time.Millisecond)
+	if n := clk.Timers(); n != 1 {
+		t.Errorf("Send() stopped waiting for the ramp after 700ms, %d timers left", n)
+	}
+	clk.Advance(100 * time.Millisecond)
+	<-ch
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestCopyOnEmit(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.CopyOnEmit = true
+	q.Init(logrus.WithField("test", "TestCopyOnEmit"), []*configpb.TestGroup{{Name: "hi", DaysOfResults: 1}}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Minute)
+	}()
+	first := <-ch
+	first.DaysOfResults = 7
+	if tg, _, _ := q.StatusOf("hi"); tg.DaysOfResults != 1 {
+		t.Errorf("changing the sent group changed the queue's copy to %v", tg)
+	}
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	second := <-ch
+	if second == first || second.DaysOfResults != 1 {
+		t.Errorf("Send() sent %v again after the first was changed, wanted a fresh copy", second)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	q.CopyOnEmit = false
+	if q.copied(first) != first {
+		t.Error("copied() without CopyOnEmit copied the group")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.PullFrequency = time.Hour
+	q.HistorySize = 3
+	q.Init(logrus.WithField("test", "TestHistory"), []*configpb.TestGroup{{Name: "hi"}}, now.Add(time.Minute))
+	if got := q.History("hi"); len(got) != 0 {
+		t.Errorf("History() before sending got %v, wanted nothing", got)
+	}
+
+	var want []EmitEvent
+	for i := 0; i < 5; i++ {
+		clk.Advance(time.Hour + time.Minute)
+		ready, _ := q.Queue.When("hi")
+		trigger := queue.TriggerScheduled
+		if i == 2 {
+			if err := q.Poke("hi"); err != nil {
+				t.Fatalf("Poke() got unexpected error: %v", err)
+			}
+			trigger = queue.TriggerPoked
+		}
+		if _, ok := q.TryNext(); !ok {
+			t.Fatalf("%d: TryNext() got nothing, wanted hi", i)
+		}
+		want = append(want, EmitEvent{When: clk.Now(), Trigger: trigger, Wait: clk.Now().Sub(ready)})
+	}
+	if diff := cmp.Diff(want[2:], q.History("hi")); diff != "" {
+		t.Errorf("History() got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	if err := q.Remove("hi"); err != nil {
+		t.Fatalf("Remove() got unexpected error: %v", err)
+	}
+	if got := q.History("hi"); len(got) != 0 {
+		t.Errorf("History() after Remove() got %v, wanted nothing", got)
+	}
+}
+
+func TestSendOnce(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSendOnce"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+		{
+			Name: "world",
+		},
+	}, now)
+	q.Fix("there", now.Add(time.Hour), true)
+	q.Fix("world", now.Add(-time.Hour), false)
+	want := []string{"world", "hi", "there"}
+	before := q.Snapshot()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	channel := make(chan *configpb.TestGroup, len(want))
+	if err := q.SendOnce(ctx, channel, false); err != nil {
+		t.Fatalf("SendOnce() got unexpected error: %v", err)
+	}
+	close(channel)
+	var got []string
+	for tg := range channel {
+		got = append(got, tg.Name)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SendOnce() got unexpected diff (-want +got):\n%s", diff)
+	}
+	after := q.Snapshot()
+	for i := range after {
+		after[i].LastSent = time.Time{}
+	}
+	if diff := cmp.Diff(before, after); diff != "" {
+		t.Errorf("SendOnce() changed the schedule (-want +got):\n%s", diff)
+	}
+
+	waiting := make(chan *configpb.TestGroup)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- q.SendOnce(ctx, waiting, true)
+	}()
+	got = nil
+	for i := 0; i < 2; i++ {
+		got = append(got, (<-waiting).Name)
+	}
+	clk.BlockUntil(1) // waits until there is ready
+	clk.Advance(time.Hour)
+	got = append(got, (<-waiting).Name)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SendOnce(wait) got unexpected diff (-want +got):\n%s", diff)
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("SendOnce(wait) got unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SendOnce(wait) failed to return after the last item")
+	}
+
+	go func() {
+		errs <- q.SendOnce(ctx, waiting, false)
+	}()
+	<-waiting
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("SendOnce() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestWaitPercentiles(t *testing.T) {
+	log := logrus.WithField("test", "TestWaitPercentiles")
+	now := time.Now()
+	var groups []*configpb.TestGroup
+	for i := 1; i <= 100; i++ {
+		groups = append(groups, &configpb.TestGroup{Name: fmt.Sprintf("group-%03d", i)})
+	}
+	pull := func(q *TestGroupQueue) {
+		t.Helper()
+		q.Init(log, groups, now)
+		for i, tg := range groups {
+			q.Fix(tg.Name, now.Add(-time.Duration(i+1)*time.Second), false)
+		}
+		for range groups {
+			if _, err := q.Next(context.Background()); err != nil {
+				t.Fatalf("Next() got unexpected error: %v", err)
+			}
+		}
+	}
+
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.PullFrequency = time.Hour
+	q.WaitSamples = 1000
+	pull(&q)
+	want := []time.Duration{time.Second, 50 * time.Second, 95 * time.Second, 99 * time.Second, 100 * time.Second}
+	if diff := cmp.Diff(want, q.WaitPercentiles(0, 0.5, 0.95, 0.99, 1)); diff != "" {
+		t.Errorf("WaitPercentiles() got unexpected diff (-want +got):\n%s", diff)
+	}
+	q.Init(log, groups, now)
+	if diff := cmp.Diff([]time.Duration{0}, q.WaitPercentiles(0.5)); diff != "" {
+		t.Errorf("WaitPercentiles() after Init() got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	// Samples a bounded number of waits.
+	q.WaitSamples = 20
+	pull(&q)
+	if n := len(q.waits); n != q.WaitSamples {
+		t.Errorf("WaitPercentiles() sampled %d waits, wanted %d", n, q.WaitSamples)
+	}
+	if got := q.WaitPercentiles(0.5)[0]; got < 10*time.Second || got > 90*time.Second {
+		t.Errorf("WaitPercentiles(0.5) got %v, wanted about 50s", got)
+	}
+}
+
+func TestPokeWindow(t *testing.T) {
+	cases := []struct {
+		name   string
+		window time.Duration
+		resend bool // whether the burst sends hi again
+	}{
+		{
+			name:   "disabled",
+			resend: true,
+		},
+		{
+			name:   "coalesce",
+			window: time.Minute,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			clk := fake.NewClock(now)
+			var q TestGroupQueue
+			q.SetClock(clk)
+			q.PokeWindow = tc.window
+			q.Init(logrus.WithField("name", tc.name), []*configpb.TestGroup{
+				{
+					Name: "hi",
+				},
+				{
+					Name: "there",
+				},
+			}, now.Add(time.Hour))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan *configpb.TestGroup)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- q.Send(ctx, ch, time.Hour)
+			}()
+
+			if err := q.Poke("hi"); err != nil {
+				t.Fatalf("Poke() got unexpected error: %v", err)
+			}
+			if tg := <-ch; tg.Name != "hi" {
+				t.Fatalf("Send() got %q, wanted hi", tg.Name)
+			}
+			clk.BlockUntil(1) // Wait until Send reschedules hi and sleeps.
+			for i := 0; i < 100; i++ {
+				if err := q.Poke("hi"); err != nil {
+					t.Fatalf("Poke() got unexpected error: %v", err)
+				}
+			}
+			if tc.resend {
+				if tg := <-ch; tg.Name != "hi" {
+					t.Errorf("Send() after the burst got %q, wanted hi", tg.Name)
+				}
+			} else {
+				for _, gs := range q.Schedule() {
+					if gs.Name == "hi" && !gs.When.Equal(now.Add(time.Hour)) {
+						t.Errorf("Schedule() got hi at %v, wanted %v", gs.When, now.Add(time.Hour))
+					}
+				}
+			}
+
+			clk.Advance(tc.window)
+			if err := q.Poke("hi"); err != nil {
+				t.Fatalf("Poke() got unexpected error: %v", err)
+			}
+			if tg := <-ch; tg.Name != "hi" {
+				t.Errorf("Send() after the window got %q, wanted hi", tg.Name)
+			}
+			cancel()
+			if err := <-errCh; err != context.Canceled {
+				t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+		})
+	}
+}
+
+func TestShouldSchedule(t *testing.T) {
+	log := logrus.WithField("test", "TestShouldSchedule")
+	now := time.Now()
+	cfg := &configpb.Configuration{
+		Dashboards: []*configpb.Dashboard{
+			{
+				Name: "dash",
+				DashboardTab: []*configpb.DashboardTab{
+					{
+						Name:          "tab",
+						TestGroupName: "hi",
+					},
+				},
+			},
+		},
+	}
+	groups := []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}
+	var q TestGroupQueue
+	names := func() []string {
+		var got []string
+		for _, gs := range q.Snapshot() {
+			got = append(got, gs.Name)
+		}
+		return got
+	}
+
+	q.ShouldSchedule = ConsumedGroups(cfg)
+	q.Init(log, groups, now)
+	if diff := cmp.Diff([]string{"hi"}, names()); diff != "" {
+		t.Errorf("Init() got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	q.Add(&configpb.TestGroup{Name: "there"}, now, false)
+	if diff := cmp.Diff([]string{"hi"}, names()); diff != "" {
+		t.Errorf("Add() of a rejected group got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	q.ShouldSchedule = func(tg *configpb.TestGroup) bool {
+		return tg.Name != "hi"
+	}
+	q.Add(&configpb.TestGroup{Name: "hi"}, now, false)
+	q.Add(&configpb.TestGroup{Name: "there"}, now, false)
+	if diff := cmp.Diff([]string{"there"}, names()); diff != "" {
+		t.Errorf("Add() got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	q.ShouldSchedule = nil
+	q.Init(log, groups, now)
+	if diff := cmp.Diff([]string{"hi", "there"}, names()); diff != "" {
+		t.Errorf("Init() without a filter got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestInitFiltered(t *testing.T) {
+	log := logrus.WithField("test", "TestInitFiltered")
+	var groups []*configpb.TestGroup
+	for _, name := range []string{"shard-0-a", "shard-1-b", "shard-0-c", "shard-1-d"} {
+		groups = append(groups, &configpb.TestGroup{Name: name})
+	}
+	var q TestGroupQueue
+	q.InitFiltered(log, groups, time.Now(), MatchName[*configpb.TestGroup](regexp.MustCompile(`^shard-0-`)))
+	if n, _, _ := q.Status(); n != 2 {
+		t.Errorf("Status() got depth %d, wanted 2", n)
+	}
+	var got []string
+	for _, gs := range q.Snapshot() {
+		got = append(got, gs.Name)
+	}
+	if diff := cmp.Diff([]string{"shard-0-a", "shard-0-c"}, got); diff != "" {
+		t.Errorf("InitFiltered() got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	var dq DashboardQueue
+	dq.InitFiltered(log, []*configpb.Dashboard{
+		{
+			Name:         "keep",
+			DashboardTab: []*configpb.DashboardTab{{Name: "tab", TestGroupName: "shard-0-a"}},
+		},
+		{
+			Name:         "drop",
+			DashboardTab: []*configpb.DashboardTab{{Name: "tab", TestGroupName: "shard-1-b"}},
+		},
+	}, time.Now(), MatchName[*configpb.Dashboard](regexp.MustCompile(`keep`)))
+	if n, _, _ := dq.Status(); n != 1 {
+		t.Errorf("DashboardQueue Status() got depth %d, wanted 1", n)
+	}
+	if err := dq.FixTestGroups(time.Now(), false, "shard-0-a"); err != nil {
+		t.Errorf("FixTestGroups() got unexpected error: %v", err)
+	}
+}
+
+func TestSendSharded(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	var groups []*configpb.TestGroup
+	for i := 0; i < 10; i++ {
+		groups = append(groups, &configpb.TestGroup{Name: fmt.Sprintf("group-%d", i)})
+	}
+	q.Init(logrus.WithField("test", "TestSendSharded"), groups, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type emit struct {
+		name  string
+		index int
+	}
+	emits := make(chan emit)
+	receivers := make([]chan<- *configpb.TestGroup, 3)
+	for i := range receivers {
+		ch := make(chan *configpb.TestGroup)
+		receivers[i] = ch
+		go func(i int) {
+			for tg := range ch {
+				emits <- emit{tg.Name, i}
+			}
+		}(i)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendSharded(ctx, receivers, time.Minute)
+	}()
+
+	got := map[string]int{}
+	for round := 0; round < 5; round++ {
+		for range groups {
+			e := <-emits
+			if idx, ok := got[e.name]; ok && idx != e.index {
+				t.Errorf("Round %d sent %s to %d, previously %d", round, e.name, e.index, idx)
+			}
+			got[e.name] = e.index
+			if want := ShardIndex(e.name, len(receivers)); e.index != want {
+				t.Errorf("Round %d sent %s to %d, wanted ShardIndex() of %d", round, e.name, e.index, want)
+			}
+		}
+		clk.BlockUntil(1) // Wait until every group is rescheduled.
+		clk.Advance(time.Minute)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendSharded() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if len(got) != len(groups) {
+		t.Errorf("SendSharded() sent %d groups, wanted %d", len(got), len(groups))
+	}
+
+	if err := q.SendSharded(ctx, nil, time.Minute); err == nil {
+		t.Error("SendSharded() without receivers failed to return an error")
+	}
+}
+
+func TestSendBroadcast(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSendBroadcast"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	w := q.WatchSchedule(10)
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := make(chan *configpb.TestGroup)
+	second := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendBroadcast(ctx, []chan<- *configpb.TestGroup{first, second}, time.Minute, 0, Block)
+	}()
+	for _, name := range []string{"hi", "there"} {
+		if got := (<-first).Name; got != name {
+			t.Errorf("SendBroadcast() sent %q to the first receiver, wanted %q", got, name)
+		}
+		select {
+		case event := <-w.Events():
+			t.Errorf("SendBroadcast() got %v before the second receiver took %q", event, name)
+		default:
+		}
+		if got := (<-second).Name; got != name {
+			t.Errorf("SendBroadcast() sent %q to the second receiver, wanted %q", got, name)
+		}
+		want := []ScheduleEvent{
+			{Kind: Sent, Name: name, When: now},
+			{Kind: Rescheduled, Name: name, When: now.Add(time.Minute)},
+		}
+		got := []ScheduleEvent{<-w.Events(), <-w.Events()}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("SendBroadcast() got unexpected diff (-want +got):\n%s", diff)
+		}
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendBroadcast() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSendBroadcastQuorum(t *testing.T) {
+	cases := []struct {
+		name   string
+		quorum int
+		sent   bool
+	}{
+		{
+			name:   "quorum",
+			quorum: 1,
+			sent:   true,
+		},
+		{
+			name:   "every receiver",
+			quorum: 2,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+			var q TestGroupQueue
+			q.SetClock(fake.NewClock(now))
+			mets := NewQueueMetrics("test")
+			q.SetMetrics(mets)
+			q.Init(logrus.WithField("name", tc.name), []*configpb.TestGroup{{Name: "hi"}}, now)
+			w := q.WatchSchedule(10)
+			defer w.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ready := make(chan *configpb.TestGroup, 1)
+			busy := make(chan *configpb.TestGroup) // never received from
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- q.SendBroadcast(ctx, []chan<- *configpb.TestGroup{ready, busy}, time.Minute, tc.quorum, DropNewest)
+			}()
+			<-ready
+			for event := range w.Events() {
+				if event.Kind == Rescheduled {
+					break
+				}
+			}
+			cancel()
+			if err := <-errCh; err != context.Canceled {
+				t.Errorf("SendBroadcast() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+			if _, sent := q.LastSent("hi"); sent != tc.sent {
+				t.Errorf("LastSent() got %t, wanted %t", sent, tc.sent)
+			}
+			if _, st, _ := q.StatusOf("hi"); !st.When.Equal(now.Add(time.Minute)) {
+				t.Errorf("StatusOf() got %v, wanted %v", st.When, now.Add(time.Minute))
+			}
+			var dropped float64
+			if !tc.sent {
+				dropped = 1
+			}
+			if got := testutil.ToFloat64(mets.Dropped); got != dropped {
+				t.Errorf("Dropped got %v, wanted %v", got, dropped)
+			}
+		})
+	}
+}
+
+func TestShardIndex(t *testing.T) {
+	// Pin the hash, which must not change across releases.
+	cases := []struct {
+		name string
+		n    int
+		want int
+	}{
+		{name: "hello", n: 1, want: 0},
+		{name: "hello", n: 3, want: 0},
+		{name: "hello", n: 7, want: 2},
+		{name: "group-1", n: 3, want: 1},
+	}
+	for _, tc := range cases {
+		if got := ShardIndex(tc.name, tc.n); got != tc.want {
+			t.Errorf("ShardIndex(%q, %d) got %d, wanted %d", tc.name, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestSendRouted(t *testing.T) {
+	cases := []struct {
+		name     string
+		routes   []string
+		fallback bool
+		want     map[string][]string // names received by each route, or "default"
+		wantSkip bool
+	}{
+		{
+			name:     "route and fallback",
+			routes:   []string{"gcs"},
+			fallback: true,
+			want: map[string][]string{
+				"gcs":     {"cloud"},
+				"default": {"legacy"},
+			},
+		},
+		{
+			name:   "route and skip",
+			routes: []string{"gcs"},
+			want: map[string][]string{
+				"gcs": {"cloud"},
+			},
+			wantSkip: true,
+		},
+		{
+			name:     "only fallback",
+			fallback: true,
+			want: map[string][]string{
+				"default": {"cloud", "legacy"},
+			},
+		},
+		{
+			name:     "skip everything",
+			want:     map[string][]string{},
+			wantSkip: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			var q TestGroupQueue
+			q.SetClock(fake.NewClock(now))
+			var obs fakeObserver
+			q.SetObserver(&obs)
+			q.Init(logrus.WithField("name", tc.name), []*configpb.TestGroup{
+				{
+					Name: "cloud",
+					ResultSource: &configpb.TestGroup_ResultSource{
+						ResultSourceConfig: &configpb.TestGroup_ResultSource_GcsConfig{
+							GcsConfig: &configpb.GCSConfig{},
+						},
+					},
+				},
+				{
+					Name: "legacy",
+				},
+			}, now)
+			q.Fix("cloud", now.Add(-time.Minute), false)
+
+			chans := map[string]chan *configpb.TestGroup{}
+			routes := map[string]chan<- *configpb.TestGroup{}
+			for _, kind := range tc.routes {
+				ch := make(chan *configpb.TestGroup, 2)
+				chans[kind] = ch
+				routes[kind] = ch
+			}
+			var fallback chan<- *configpb.TestGroup
+			if tc.fallback {
+				ch := make(chan *configpb.TestGroup, 2)
+				chans["default"] = ch
+				fallback = ch
+			}
+
+			// A zero frequency sends each group once, then returns.
+			if err := q.SendRouted(context.Background(), ResultSourceKind, routes, fallback, 0); err != nil {
+				t.Fatalf("SendRouted() got unexpected error: %v", err)
+			}
+
+			got := map[string][]string{}
+			for kind, ch := range chans {
+				close(ch)
+				for tg := range ch {
+					got[kind] = append(got[kind], tg.Name)
+				}
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("SendRouted() got unexpected diff (-want +got):\n%s", diff)
+			}
+			var skipped bool
+			for _, event := range obs.events {
+				if event == "skip legacy" {
+					skipped = true
+				}
+			}
+			if skipped != tc.wantSkip {
+				t.Errorf("SendRouted() skipped legacy: %t, wanted %t", skipped, tc.wantSkip)
+			}
+		})
+	}
+}
+
+func TestResultSourceKind(t *testing.T) {
+	gcs := &configpb.TestGroup{
+		ResultSource: &configpb.TestGroup_ResultSource{
+			ResultSourceConfig: &configpb.TestGroup_ResultSource_GcsConfig{
+				GcsConfig: &configpb.GCSConfig{},
+			},
+		},
+	}
+	if got := ResultSourceKind(gcs); got != "gcs" {
+		t.Errorf("ResultSourceKind() got %q, wanted gcs", got)
+	}
+	if got := ResultSourceKind(&configpb.TestGroup{}); got != "" {
+		t.Errorf("ResultSourceKind() got %q, wanted empty", got)
+	}
+}
+
+func TestSetLimiter(t *testing.T) {
+	var groups []*configpb.TestGroup
+	for i := 0; i < 6; i++ {
+		groups = append(groups, &configpb.TestGroup{Name: fmt.Sprintf("group-%d", i)})
+	}
+	var q TestGroupQueue
+	q.Init(logrus.WithField("test", "TestSetLimiter"), groups, time.Now())
+	const every = 20 * time.Millisecond
+	q.SetLimiter(rate.NewLimiter(rate.Every(every), 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	start := time.Now()
+	for range groups {
+		<-ch
+	}
+	// The first group uses the burst, so each other group waits for a token.
+	if elapsed, min := time.Since(start), every*time.Duration(len(groups)-2); elapsed < min {
+		t.Errorf("Send() sent %d groups in %v, wanted at least %v", len(groups), elapsed, min)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	q.SetLimiter(nil)
+}
+
+func TestSendBatch(t *testing.T) {
+	cases := []struct {
+		name     string
+		maxBatch int
+		want     []int
+	}{
+		{
+			name: "unlimited",
+			want: []int{5},
+		},
+		{
+			name:     "larger than ready",
+			maxBatch: 10,
+			want:     []int{5},
+		},
+		{
+			name:     "partial",
+			maxBatch: 2,
+			want:     []int{2, 2, 1},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			clk := fake.NewClock(now)
+			var q TestGroupQueue
+			q.SetClock(clk)
+			var groups []*configpb.TestGroup
+			for i := 0; i < 5; i++ {
+				groups = append(groups, &configpb.TestGroup{Name: fmt.Sprintf("group-%d", i)})
+			}
+			q.Init(logrus.WithField("name", tc.name), groups, now)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan []*configpb.TestGroup)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- q.SendBatch(ctx, ch, time.Hour, tc.maxBatch)
+			}()
+			var got []int
+			sent := map[string]bool{}
+			for range tc.want {
+				batch := <-ch
+				got = append(got, len(batch))
+				for _, tg := range batch {
+					sent[tg.Name] = true
+				}
+			}
+			clk.BlockUntil(1) // Wait until every group is rescheduled.
+			cancel()
+			if err := <-errCh; err != context.Canceled {
+				t.Errorf("SendBatch() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("SendBatch() got unexpected batch sizes (-want +got):\n%s", diff)
+			}
+			if len(sent) != len(groups) {
+				t.Errorf("SendBatch() sent %d groups, wanted %d", len(sent), len(groups))
+			}
+			for _, gs := range q.Schedule() {
+				if !gs.When.Equal(now.Add(time.Hour)) {
+					t.Errorf("Schedule() got %s at %v, wanted %v", gs.Name, gs.When, now.Add(time.Hour))
+				}
+			}
+		})
+	}
+}
+
+type fakeDeadlineObserver struct {
+	fakeObserver
+}
+
+func (o *fakeDeadlineObserver) OnExpire(name string, deadline time.Time) {
+	o.events = append(o.events, fmt.Sprintf("expire %s after %s", name, deadline.Format(time.Kitchen)))
+}
+
+func TestSetDeadline(t *testing.T) {
+	log := logrus.WithField("test", "TestSetDeadline")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	mets := NewQueueMetrics("test")
+	q.SetMetrics(mets)
+	var obs fakeDeadlineObserver
+	q.SetObserver(&obs)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now.Add(time.Minute))
+
+	if err := q.SetDeadline("missing", now); err == nil {
+		t.Error("SetDeadline() of a missing group failed to return an error")
+	}
+	if err := q.SetDeadline("hi", now.Add(30*time.Second)); err != nil {
+		t.Fatalf("SetDeadline() got unexpected error: %v", err)
+	}
+	if err := q.SetDeadline("there", now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("SetDeadline() got unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	if tg := <-ch; tg.Name != "there" {
+		t.Errorf("Send() got %q, wanted there", tg.Name)
+	}
+	clk.BlockUntil(1)
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	var names []string
+	for _, gs := range q.Schedule() {
+		names = append(names, gs.Name)
+	}
+	if diff := cmp.Diff([]string{"there"}, names); diff != "" {
+		t.Errorf("Schedule() got unexpected diff (-want +got):\n%s", diff)
+	}
+	var expired bool
+	for _, event := range obs.events {
+		if event == "expire hi after 12:00PM" {
+			expired = true
+		}
+	}
+	if !expired {
+		t.Errorf("Observer got events %v, wanted hi to expire", obs.events)
+	}
+	if got := testutil.ToFloat64(mets.Expired); got != 1 {
+		t.Errorf("Expired got %v, wanted 1", got)
+	}
+}
+
+func TestSetGate(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	q := TestGroupQueue{GateRetry: 5 * time.Minute}
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSetGate"), []*configpb.TestGroup{
+		{
+			Name: "open",
+		},
+		{
+			Name: "closed",
+		},
+		{
+			Name: "broken",
+		},
+	}, now)
+	var opened int32
+	gates := map[string]func(context.Context) (bool, error){
+		"open": func(ctx context.Context) (bool, error) {
+			if ctx == nil {
+				t.Error("SetGate() gate got a nil context")
+			}
+			return true, nil
+		},
+		"closed": func(context.Context) (bool, error) {
+			return atomic.LoadInt32(&opened) == 1, nil
+		},
+		"broken": func(context.Context) (bool, error) {
+			return false, errors.New("broken")
+		},
+	}
+	for name, gate := range gates {
+		if err := q.SetGate(name, gate); err != nil {
+			t.Fatalf("SetGate(%q) got unexpected error: %v", name, err)
+		}
+	}
+	if err := q.SetGate("missing", gates["open"]); err == nil {
+		t.Error("SetGate(missing) failed to return an error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	got := []string{(<-ch).Name, (<-ch).Name}
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"broken", "open"}, got); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+	clk.BlockUntil(1) // waiting to retry closed
+	if _, st, _ := q.StatusOf("closed"); !st.When.Equal(now.Add(5 * time.Minute)) {
+		t.Errorf("Send() rescheduled closed to %v, wanted %v", st.When, now.Add(5*time.Minute))
+	}
+
+	atomic.StoreInt32(&opened, 1)
+	clk.Advance(5 * time.Minute)
+	if tg := <-ch; tg.Name != "closed" {
+		t.Errorf("Send() after opening the gate got %q, wanted closed", tg.Name)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSetFingerprint(t *testing.T) {
+	log := logrus.WithField("test", "TestSetFingerprint")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	mets := NewQueueMetrics("test")
+	q.SetMetrics(mets)
+	q.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+
+	if err := q.SetFingerprint("missing", nil); err == nil {
+		t.Error("SetFingerprint() of a missing group failed to return an error")
+	}
+	if err := q.SetFingerprint("hi", func() (string, error) { return "stable", nil }); err != nil {
+		t.Fatalf("SetFingerprint() got unexpected error: %v", err)
+	}
+	var changes int
+	if err := q.SetFingerprint("there", func() (string, error) {
+		changes++
+		return fmt.Sprintf("change-%d", changes), nil
+	}); err != nil {
+		t.Fatalf("SetFingerprint() got unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Minute)
+	}()
+	var got []string
+	for i := 0; i < 2; i++ {
+		got = append(got, (<-ch).Name)
+	}
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	// Send skips hi, which is ready first yet unchanged.
+	got = append(got, (<-ch).Name)
+	clk.BlockUntil(1)
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if diff := cmp.Diff([]string{"hi", "there", "there"}, got); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	_, st, ok := q.StatusOf("hi")
+	if want := now.Add(2 * time.Minute); !ok || !st.When.Equal(want) {
+		t.Errorf("StatusOf(hi) got %v, %t, wanted %v, true", st.When, ok, want)
+	}
+	if got := testutil.ToFloat64(mets.Unchanged); got != 1 {
+		t.Errorf("Unchanged got %v, wanted 1", got)
+	}
+}
+
+func TestSetFingerprintSendAck(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSetFingerprintSendAck"), []*configpb.TestGroup{{Name: "hi"}}, now)
+	if err := q.SetFingerprint("hi", func() (string, error) { return "stable", nil }); err != nil {
+		t.Fatalf("SetFingerprint() got unexpected error: %v", err)
+	}
+	w := q.WatchSchedule(10)
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *Delivery[*configpb.TestGroup])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendAck(ctx, ch, time.Minute)
+	}()
+	(<-ch).Ack(nil)
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	// SendAck holds the unchanged group, so it must release it to send it again later.
+	want := now.Add(2 * time.Minute)
+	for event := range w.Events() {
+		if event.Kind == Rescheduled && event.When.Equal(want) {
+			break
+		}
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendAck() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if _, st, ok := q.StatusOf("hi"); !ok || !st.When.Equal(want) {
+		t.Errorf("StatusOf(hi) got %v, %t, wanted %v, true", st.When, ok, want)
+	}
+}
+
+func TestFreshFunc(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	q := TestGroupQueue{
+		FreshFunc: func(tg *configpb.TestGroup) bool {
+			return tg.Name == "hi"
+		},
+	}
+	q.SetClock(fake.NewClock(now))
+	mets := NewQueueMetrics("test")
+	q.SetMetrics(mets)
+	q.Init(logrus.WithField("test", "TestFreshFunc"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	// Send skips hi, which is ready first yet fresh.
+	if tg := <-ch; tg.Name != "there" {
+		t.Errorf("Send() got %q, wanted there", tg.Name)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	if _, st, ok := q.StatusOf("hi"); !ok || !st.When.Equal(now.Add(time.Hour)) {
+		t.Errorf("StatusOf(hi) got %v, %t, wanted %v, true", st.When, ok, now.Add(time.Hour))
+	}
+	if when, ok := q.LastSent("hi"); ok {
+		t.Errorf("LastSent(hi) got %v, wanted none", when)
+	}
+	if got := testutil.ToFloat64(mets.Fresh); got != 1 {
+		t.Errorf("Fresh got %v, wanted 1", got)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name    string
+		groups  map[string]time.Duration // when each group is ready, relative to now
+		sentAgo time.Duration            // send the earliest group this long ago when set
+		healthy bool
+	}{
+		{
+			name:    "empty",
+			healthy: true,
+		},
+		{
+			name: "idle",
+			groups: map[string]time.Duration{
+				"hi": time.Hour,
+			},
+			healthy: true,
+		},
+		{
+			name: "recently ready",
+			groups: map[string]time.Duration{
+				"hi": -30 * time.Second,
+			},
+			healthy: true,
+		},
+		{
+			name: "stuck",
+			groups: map[string]time.Duration{
+				"hi":    -3 * time.Minute,
+				"there": -2 * time.Minute,
+			},
+		},
+		{
+			name: "sending",
+			groups: map[string]time.Duration{
+				"hi":    -3 * time.Minute,
+				"there": -2 * time.Minute,
+			},
+			sentAgo: 30 * time.Second,
+			healthy: true,
+		},
+		{
+			name: "stopped sending",
+			groups: map[string]time.Duration{
+				"hi":    -3 * time.Minute,
+				"there": -2 * time.Minute,
+			},
+			sentAgo: 90 * time.Second,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clk := fake.NewClock(now)
+			var q TestGroupQueue
+			q.SetClock(clk)
+			q.PullFrequency = time.Hour
+			var groups []*configpb.TestGroup
+			for name := range tc.groups {
+				groups = append(groups, &configpb.TestGroup{Name: name})
+			}
+			q.Init(logrus.WithField("name", tc.name), groups, now)
+			for name, when := range tc.groups {
+				q.Reschedule(name, now.Add(when))
+			}
+			if tc.sentAgo > 0 {
+				clk.Set(now.Add(-tc.sentAgo))
+				if _, err := q.Next(context.Background()); err != nil {
+					t.Fatalf("Next() got unexpected error: %v", err)
+				}
+				clk.Set(now)
+			}
+
+			err := q.Healthy(time.Minute)
+			switch {
+			case err != nil && tc.healthy:
+				t.Errorf("Healthy() got unexpected error: %v", err)
+			case err == nil && !tc.healthy:
+				t.Error("Healthy() failed to return an error")
+			}
+		})
+	}
+}
+
+// fakeTracer records spans in memory.
+type fakeTracer struct {
+	lock  sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	tracer *fakeTracer
+	name   string
+	depth  int
+	ended  bool
+}
+
+type fakeSpanKey struct{}
+
+func (t *fakeTracer) Start(ctx context.Context, name string, depth int) (context.Context, Span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	span := &fakeSpan{tracer: t, name: name, depth: depth}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, fakeSpanKey{}, span), span
+}
+
+func (s *fakeSpan) End() {
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.ended = true
+}
+
+// ended returns a description of each span, along with whether it ended.
+func (t *fakeTracer) ended() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var got []string
+	for _, s := range t.spans {
+		got = append(got, fmt.Sprintf("%s depth %d ended %t", s.name, s.depth, s.ended))
+	}
+	return got
+}
+
+func TestSetTracer(t *testing.T) {
+	now := time.Now()
+	log := logrus.WithField("test", "TestSetTracer")
+	groups := []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}
+
+	t.Run("send", func(t *testing.T) {
+		var q TestGroupQueue
+		q.SetClock(fake.NewClock(now))
+		var tracer fakeTracer
+		q.SetTracer(&tracer)
+		q.Init(log, groups, now)
+		q.Reschedule("there", now.Add(-time.Minute))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch := make(chan *configpb.TestGroup)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- q.Send(ctx, ch, time.Hour)
+		}()
+		for i := 0; i < 2; i++ {
+			<-ch
+		}
+		cancel()
+		if err := <-errCh; err != context.Canceled {
+			t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+		}
+		want := []string{
+			"there depth 2 ended true",
+			"hi depth 2 ended true",
+		}
+		if diff := cmp.Diff(want, tracer.ended()); diff != "" {
+			t.Errorf("Send() got unexpected spans (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("ack", func(t *testing.T) {
+		var q TestGroupQueue
+		q.SetClock(fake.NewClock(now))
+		var tracer fakeTracer
+		q.SetTracer(&tracer)
+		q.Init(log, groups[:1], now)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch := make(chan *Delivery[*configpb.TestGroup])
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- q.SendAck(ctx, ch, time.Hour)
+		}()
+		d := <-ch
+		span, ok := d.Context.Value(fakeSpanKey{}).(*fakeSpan)
+		if !ok || span.name != "hi" {
+			t.Errorf("Delivery Context got span %v, wanted hi", span)
+		}
+		if diff := cmp.Diff([]string{"hi depth 0 ended false"}, tracer.ended()); diff != "" {
+			t.Errorf("SendAck() before Ack() got unexpected spans (-want +got):\n%s", diff)
+		}
+		d.Ack(nil)
+		if diff := cmp.Diff([]string{"hi depth 0 ended true"}, tracer.ended()); diff != "" {
+			t.Errorf("SendAck() after Ack() got unexpected spans (-want +got):\n%s", diff)
+		}
+		cancel()
+		if err := <-errCh; err != context.Canceled {
+			t.Errorf("SendAck() returned unexpected error: want %v, got %v", context.Canceled, err)
+		}
+	})
+}
+
+func TestSetLogger(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSetLogger"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.Reschedule("there", now.Add(time.Minute))
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	q.SetLogger(logger)
+	q.SetObserver(&fakeObserver{
+		onReschedule: func(name string) {
+			if name == "there" {
+				q.Remove(name) // mid-flight
+			}
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	<-ch
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	clk.BlockUntil(1) // skipped there
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	var got []string
+	for _, entry := range hook.AllEntries() {
+		got = append(got, fmt.Sprintf("%s %s %v", entry.Level, entry.Message, entry.Data["name"]))
+	}
+	want := []string{
+		"debug Rescheduled item hi",
+		"debug Rescheduled item there",
+		"debug Skipped item there",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SetLogger() got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	hook.Reset()
+	q.Add(&configpb.TestGroup{Name: "there"}, now, false)
+	q.SetLimiter(rate.NewLimiter(1, 0)) // fails every wait, since its burst is zero
+	if err := q.Send(context.Background(), ch, time.Hour); err == nil {
+		t.Error("Send() failed to return an error")
+	}
+	if entry := hook.LastEntry(); entry == nil || entry.Level != logrus.WarnLevel {
+		t.Errorf("SetLogger() got last entry %v, wanted a warning", entry)
+	}
+}
+
+// failingLimiter fails the first failures waits.
+type failingLimiter struct {
+	failures int
+	lock     sync.Mutex
+}
+
+func (l *failingLimiter) Wait(context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.failures > 0 {
+		l.failures--
+		return errors.New("transient")
+	}
+	return nil
+}
+
+type errLimiter struct {
+	err error
+}
+
+func (l errLimiter) Wait(context.Context) error {
+	return l.err
+}
+
+func TestSendErrorSentinels(t *testing.T) {
+	now := time.Now()
+	log := logrus.WithField("test", "TestSendErrorSentinels")
+	ch := make(chan *configpb.TestGroup)
+
+	var uninitialized TestGroupQueue
+	if err := uninitialized.Send(context.Background(), ch, time.Hour); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("Send() before Init() got %v, wanted %v", err, ErrNotInitialized)
+	}
+
+	var closed TestGroupQueue
+	closed.Init(log, []*configpb.TestGroup{{Name: "hi"}}, now)
+	closed.Close()
+	if err := closed.Send(context.Background(), ch, time.Hour); !errors.Is(err, ErrClosed) {
+		t.Errorf("Send() after Close() got %v, wanted %v", err, ErrClosed)
+	}
+
+	var q TestGroupQueue
+	q.Init(log, []*configpb.TestGroup{{Name: "hi"}}, now.Add(time.Hour))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.Send(ctx, ch, time.Hour); err != context.Canceled {
+		t.Errorf("Send() after cancelling got %v, wanted %v", err, context.Canceled)
+	}
+
+	failure := errors.New("limiter failed")
+	q.Fix("hi", now, false)
+	q.Queue.SetLimiter(errLimiter{err: failure})
+	err := q.Send(context.Background(), ch, time.Hour)
+	if !errors.Is(err, failure) {
+		t.Errorf("Send() got %v, wanted it to wrap %v", err, failure)
+	}
+	if err == failure {
+		t.Errorf("Send() returned %v without wrapping it", err)
+	}
+}
+
+func TestUninitialized(t *testing.T) {
+	now := time.Now()
+	ctx := context.Background()
+	ch := make(chan *configpb.TestGroup)
+	var q TestGroupQueue
+
+	if n, tg, when := q.Status(); n != 0 || tg != nil || !when.IsZero() {
+		t.Errorf("Status() got %d, %v, %v, wanted nothing", n, tg, when)
+	}
+	if n, name, when := q.HeadStatus(); n != 0 || name != "" || !when.IsZero() {
+		t.Errorf("HeadStatus() got %d, %q, %v, wanted nothing", n, name, when)
+	}
+	if tg, st, ok := q.StatusOf("hi"); ok || tg != nil || !st.When.IsZero() {
+		t.Errorf("StatusOf() got %v, %v, %t, wanted nothing", tg, st.When, ok)
+	}
+	if n := q.Len(); n != 0 {
+		t.Errorf("Len() got %d, wanted 0", n)
+	}
+	if got := q.Schedule(); len(got) != 0 {
+		t.Errorf("Schedule() got %v, wanted nothing", got)
+	}
+	if got := q.Snapshot(); len(got) != 0 {
+		t.Errorf("Snapshot() got %v, wanted nothing", got)
+	}
+	if got := q.Peek(1); len(got) != 0 {
+		t.Errorf("Peek() got %v, wanted nothing", got)
+	}
+	if err := q.Fix("hi", now, false); err == nil {
+		t.Error("Fix() got no error")
+	}
+	if err := q.Poke("hi"); err == nil {
+		t.Error("Poke() got no error")
+	}
+	if err := q.Remove("hi"); err == nil {
+		t.Error("Remove() got no error")
+	}
+	if tg, ok := q.TryNext(); ok {
+		t.Errorf("TryNext() got %v, wanted nothing", tg)
+	}
+
+	sends := []struct {
+		name string
+		send func() error
+	}{
+		{
+			name: "Send",
+			send: func() error { return q.Send(ctx, ch, time.Hour) },
+		},
+		{
+			name: "SendFair",
+			send: func() error { return q.SendFair(ctx, ch, time.Hour) },
+		},
+		{
+			name: "SendWithIDs",
+			send: func() error { return q.SendWithIDs(ctx, make(chan Emit[*configpb.TestGroup]), time.Hour) },
+		},
+		{
+			name: "SendBatch",
+			send: func() error { return q.SendBatch(ctx, make(chan []*configpb.TestGroup), time.Hour, 0) },
+		},
+		{
+			name: "SendAck",
+			send: func() error { return q.SendAck(ctx, make(chan *Delivery[*configpb.TestGroup]), time.Hour) },
+		},
+		{
+			name: "Next",
+			send: func() error {
+				_, err := q.Next(ctx)
+				return err
+			},
+		},
+	}
+	for _, tc := range sends {
+		if err := tc.send(); !errors.Is(err, ErrNotInitialized) {
+			t.Errorf("%s() before Init() got %v, wanted %v", tc.name, err, ErrNotInitialized)
+		}
+	}
+
+	q.Init(logrus.WithField("test", "TestUninitialized"), nil, now)
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := q.Send(cctx, ch, time.Hour); err != context.Canceled {
+		t.Errorf("Send() after Init() with no groups got %v, wanted %v", err, context.Canceled)
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	cases := []struct {
+		name     string
+		retries  int
+		failures int
+		wait     []time.Duration // between each retry
+		err      bool
+	}{
+		{
+			name:     "fail fast",
+			failures: 1,
+			err:      true,
+		},
+		{
+			name:     "resume",
+			retries:  2,
+			failures: 2,
+			wait:     []time.Duration{time.Minute, 2 * time.Minute},
+		},
+		{
+			name:     "give up",
+			retries:  2,
+			failures: 3,
+			wait:     []time.Duration{time.Minute, 2 * time.Minute},
+			err:      true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+			clk := fake.NewClock(now)
+			q := TestGroupQueue{
+				SendRetries:      tc.retries,
+				SendRetryBackoff: time.Minute,
+			}
+			q.SetClock(clk)
+			q.Init(logrus.WithField("name", tc.name), []*configpb.TestGroup{{Name: "hi"}}, now)
+			q.Queue.SetLimiter(&failingLimiter{failures: tc.failures})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan *configpb.TestGroup)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- q.Send(ctx, ch, time.Hour)
+			}()
+			for _, wait := range tc.wait {
+				clk.BlockUntil(1)
+				clk.Advance(wait)
+			}
+			if tc.err {
+				if err := <-errCh; err == nil || err == context.Canceled {
+					t.Errorf("Send() got error %v, wanted a transient one", err)
+				}
+				return
+			}
+			if got := (<-ch).Name; got != "hi" {
+				t.Errorf("Send() got %q, wanted hi", got)
+			}
+			cancel()
+			if err := <-errCh; err != context.Canceled {
+				t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+		})
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	errs := make(chan error, 1)
+	q := TestGroupQueue{
+		SendRetries:      1,
+		SendRetryBackoff: time.Minute,
+		SendErrors:       errs,
+	}
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSendErrors"), []*configpb.TestGroup{{Name: "hi"}}, now)
+	q.Queue.SetLimiter(&failingLimiter{failures: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	// Reported while waiting to retry, long before Send returns.
+	if err := <-errs; err == nil || err.Error() != "transient" {
+		t.Errorf("SendErrors got %v, wanted the transient error", err)
+	}
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	if got := (<-ch).Name; got != "hi" {
+		t.Errorf("Send() got %q, wanted hi", got)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSetLoggerNil(t *testing.T) {
+	var q TestGroupQueue
+	q.SetLogger(nil)
+	q.Init(logrus.WithField("test", "TestSetLoggerNil"), []*configpb.TestGroup{{Name: "hi"}}, time.Now())
+	ch := make(chan *configpb.TestGroup, 1)
+	if err := q.Send(context.Background(), ch, 0); err != nil {
+		t.Errorf("Send() got unexpected error: %v", err)
+	}
+}
+
+func TestRescheduleAll(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	var groups []*configpb.TestGroup
+	for i := 0; i < 3; i++ {
+		groups = append(groups, &configpb.TestGroup{Name: fmt.Sprintf("group-%d", i)})
+	}
+	q.Init(logrus.WithField("test", "TestRescheduleAll"), groups, now.Add(time.Hour))
+	q.Reschedule("group-1", now.Add(2*time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	clk.BlockUntil(1) // Send is waiting for the first group.
+
+	when := now.Add(time.Minute)
+	q.RescheduleAll(when)
+	if n, _, _ := q.Status(); n != len(groups) {
+		t.Errorf("Status() got depth %d, wanted %d", n, len(groups))
+	}
+	for _, gs := range q.Schedule() {
+		if !gs.When.Equal(when) {
+			t.Errorf("Schedule() got %s at %v, wanted %v", gs.Name, gs.When, when)
+		}
+	}
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	got := map[string]bool{}
+	for range groups {
+		got[(<-ch).Name] = true
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if len(got) != len(groups) {
+		t.Errorf("Send() got %v, wanted every group", got)
+	}
+}
+
+func TestSendWithIDs(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSendWithIDs"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan Emit[*configpb.TestGroup])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendWithIDs(ctx, ch, time.Minute)
+	}()
+	var ids []uint64
+	names := map[string]int{}
+	firsts := map[string]int{}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 2; i++ {
+			emit := <-ch
+			ids = append(ids, emit.EmitID)
+			names[emit.Item.Name]++
+			if emit.FirstEmit {
+				firsts[emit.Item.Name]++
+			}
+		}
+		clk.BlockUntil(1) // Wait until both groups are rescheduled.
+		clk.Advance(time.Minute)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendWithIDs() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Errorf("SendWithIDs() got EmitID %d after %d, wanted strictly increasing IDs: %v", ids[i], ids[i-1], ids)
+		}
+	}
+	if diff := cmp.Diff(map[string]int{"hi": 3, "there": 3}, names); diff != "" {
+		t.Errorf("SendWithIDs() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]int{"hi": 1, "there": 1}, firsts); diff != "" {
+		t.Errorf("SendWithIDs() got unexpected FirstEmit diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSendWithIDsDeadline(t *testing.T) {
+	cases := []struct {
+		name     string
+		fraction float64
+		want     map[string]time.Duration
+	}{
+		{
+			name: "frequency",
+			want: map[string]time.Duration{"hi": 10 * time.Minute, "there": time.Hour},
+		},
+		{
+			name:     "fraction",
+			fraction: 0.5,
+			want:     map[string]time.Duration{"hi": 5 * time.Minute, "there": 30 * time.Minute},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			var q TestGroupQueue
+			q.SetClock(fake.NewClock(now))
+			q.DeadlineFraction = tc.fraction
+			q.Init(logrus.WithField("test", "TestSendWithIDsDeadline"), []*configpb.TestGroup{
+				{
+					Name: "hi",
+				},
+				{
+					Name: "there",
+				},
+			}, now)
+			if err := q.SetFrequency("hi", 10*time.Minute); err != nil {
+				t.Fatalf("SetFrequency() got unexpected error: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan Emit[*configpb.TestGroup])
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- q.SendWithIDs(ctx, ch, time.Hour)
+			}()
+			got := map[string]time.Duration{}
+			for i := 0; i < 2; i++ {
+				emit := <-ch
+				got[emit.Item.Name] = emit.Deadline.Sub(emit.When)
+			}
+			cancel()
+			if err := <-errCh; err != context.Canceled {
+				t.Errorf("SendWithIDs() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("SendWithIDs() got unexpected deadline diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSendWithIDsHeartbeat(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	q := TestGroupQueue{HeartbeatInterval: time.Minute}
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSendWithIDsHeartbeat"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+	}, now.Add(150*time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan Emit[*configpb.TestGroup])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendWithIDs(ctx, ch, time.Hour)
+	}()
+	var got []Emit[*configpb.TestGroup]
+	for _, d := range []time.Duration{time.Minute, time.Minute, 30 * time.Second} {
+		clk.BlockUntil(2) // Wait for both the queue and the heartbeat.
+		clk.Advance(d)
+		got = append(got, <-ch)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendWithIDs() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	want := []Emit[*configpb.TestGroup]{
+		{
+			When:      now.Add(time.Minute),
+			Heartbeat: true,
+		},
+		{
+			When:      now.Add(2 * time.Minute),
+			Heartbeat: true,
+		},
+		{
+			Item:      &configpb.TestGroup{Name: "hi"},
+			EmitID:    1,
+			When:      now.Add(150 * time.Second),
+			Attempt:   1,
+			FirstEmit: true,
+			Deadline:  now.Add(150 * time.Second).Add(time.Hour),
+		},
+	}
+	for i := range got {
+		if got[i].Context == nil {
+			t.Errorf("SendWithIDs() emitted %d without a context", i)
+		}
+		got[i].Context = nil
+	}
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Errorf("SendWithIDs() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSendWithIDsPoked(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSendWithIDsPoked"), []*configpb.TestGroup{{Name: "hi"}}, now)
+	q.Add(&configpb.TestGroup{Name: "there"}, now.Add(time.Hour), false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan Emit[*configpb.TestGroup])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendWithIDs(ctx, ch, time.Hour)
+	}()
+	var got []Emit[*configpb.TestGroup]
+	got = append(got, <-ch)
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	if err := q.Poke("there"); err != nil {
+		t.Fatalf("Poke() got unexpected error: %v", err)
+	}
+	got = append(got, <-ch)
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendWithIDs() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	want := []Emit[*configpb.TestGroup]{
+		{
+			Item:      &configpb.TestGroup{Name: "hi"},
+			EmitID:    1,
+			When:      now,
+			Attempt:   1,
+			Trigger:   queue.TriggerImmediate,
+			FirstEmit: true,
+			Deadline:  now.Add(time.Hour),
+		},
+		{
+			Item:      &configpb.TestGroup{Name: "there"},
+			EmitID:    2,
+			When:      now.Add(time.Minute),
+			Attempt:   1,
+			Poked:     true,
+			Trigger:   queue.TriggerPoked,
+			FirstEmit: true,
+			Deadline:  now.Add(time.Minute + time.Hour),
+		},
+	}
+	for i := range got {
+		if got[i].Context == nil {
+			t.Errorf("SendWithIDs() emitted %d without a context", i)
+		}
+		got[i].Context = nil
+	}
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Errorf("SendWithIDs() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestEmitContext(t *testing.T) {
+	now := time.Now()
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestEmitContext"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.Fix("there", now.Add(-time.Minute), false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan Emit[*configpb.TestGroup])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendWithIDs(ctx, ch, time.Hour)
+	}()
+	removed, paused := <-ch, <-ch
+	if removed.Item.Name != "there" || paused.Item.Name != "hi" {
+		t.Fatalf("SendWithIDs() emitted %q then %q, wanted there then hi", removed.Item.Name, paused.Item.Name)
+	}
+	if removed.Context.Err() != nil || paused.Context.Err() != nil {
+		t.Fatal("SendWithIDs() emitted an already cancelled context")
+	}
+	if err := q.Remove("there"); err != nil {
+		t.Fatalf("Remove() got unexpected error: %v", err)
+	}
+	if err := removed.Context.Err(); err != context.Canceled {
+		t.Errorf("Remove() left the context of the emit with %v, wanted %v", err, context.Canceled)
+	}
+	if err := paused.Context.Err(); err != nil {
+		t.Errorf("Remove() cancelled the context of another emit: %v", err)
+	}
+	if err := q.Pause("hi"); err != nil {
+		t.Fatalf("Pause() got unexpected error: %v", err)
+	}
+	if err := paused.Context.Err(); err != context.Canceled {
+		t.Errorf("Pause() left the context of the emit with %v, wanted %v", err, context.Canceled)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendWithIDs() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestKeyFunc(t *testing.T) {
+	log := logrus.WithField("test", "TestKeyFunc")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.KeyFunc = func(tg *configpb.TestGroup) string {
+		return tg.GcsPrefix + "/" + tg.Name
+	}
+	groups := []*configpb.TestGroup{
+		{
+			Name:      "hi",
+			GcsPrefix: "tenant-a",
+		},
+		{
+			Name:      "hi",
+			GcsPrefix: "tenant-b",
+		},
+	}
+	if err := q.InitE(log, groups, now); err != nil {
+		t.Fatalf("InitE() got unexpected error: %v", err)
+	}
+	if err := q.InitE(log, append(groups, groups[0]), now); err == nil {
+		t.Error("InitE() with a duplicate key failed to return an error")
+	}
+	q.Fix("tenant-b/hi", now.Add(-time.Minute), false)
+	if _, tg, _ := q.Status(); tg != groups[1] {
+		t.Errorf("Status() got %v, wanted %v", tg, groups[1])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup, 2)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	got := []string{(<-ch).GcsPrefix, (<-ch).GcsPrefix}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if diff := cmp.Diff([]string{"tenant-b", "tenant-a"}, got); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if _, st, ok := q.StatusOf("tenant-a/hi"); !ok || !st.When.Equal(now.Add(time.Hour)) {
+		t.Errorf("StatusOf(tenant-a/hi) got %v, %t, wanted %v, true", st.When, ok, now.Add(time.Hour))
+	}
+}
+
+func TestMultiStatus(t *testing.T) {
+	log := logrus.WithField("test", "TestMultiStatus")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var groups TestGroupQueue
+	groups.Init(log, []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	groups.Fix("there", now.Add(-time.Minute), false)
+	var dashboards DashboardQueue
+	dashboards.Init(log, nil, now)
+
+	got := MultiStatus(map[string]StatusReporter{
+		"groups":     &groups,
+		"dashboards": &dashboards,
+	})
+	want := []QueueStatus{
+		{
+			Queue: "dashboards",
+		},
+		{
+			Queue: "groups",
+			Depth: 2,
+			Next:  "there",
+			When:  now.Add(-time.Minute),
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("MultiStatus() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestHeadReady(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name   string
+		groups []*configpb.TestGroup
+		when   time.Time
+		want   string
+		ready  bool
+	}{
+		{
+			name: "empty",
+			when: now,
+		},
+		{
+			name:   "ready",
+			groups: []*configpb.TestGroup{{Name: "hi"}},
+			when:   now.Add(-time.Minute),
+			want:   "hi",
+			ready:  true,
+		},
+		{
+			name:   "now",
+			groups: []*configpb.TestGroup{{Name: "hi"}},
+			when:   now,
+			want:   "hi",
+			ready:  true,
+		},
+		{
+			name:   "future",
+			groups: []*configpb.TestGroup{{Name: "hi"}},
+			when:   now.Add(time.Minute),
+			want:   "hi",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q TestGroupQueue
+			q.SetClock(fake.NewClock(now))
+			q.Init(logrus.WithField("test", "TestHeadReady"), tc.groups, tc.when)
+			tg, ready := q.HeadReady()
+			if tg.GetName() != tc.want || ready != tc.ready {
+				t.Errorf("HeadReady() got %q, %t, wanted %q, %t", tg.GetName(), ready, tc.want, tc.ready)
+			}
+			if tc.want == "" && tg != nil {
+				t.Errorf("HeadReady() got %v, wanted nil", tg)
+			}
+		})
+	}
+}
+
+func TestStatusWhen(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.Init(logrus.WithField("test", "TestStatusWhen"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name: "there",
+		},
+	}, now)
+	q.Fix("there", now.Add(-time.Minute), false)
+
+	_, who, want := q.Queue.Status()
+	if who == nil || *who != "there" {
+		t.Fatalf("Queue.Status() got %v, wanted there", who)
+	}
+	_, tg, when := q.Status()
+	if tg.GetName() != "there" {
+		t.Errorf("Status() got %q, wanted there", tg.GetName())
+	}
+	if !when.Equal(want) || when.IsZero() {
+		t.Errorf("Status() got when %v, wanted %v", when, want)
+	}
+}
+
+func TestStatusOf(t *testing.T) {
+	now := time.Now()
+	var q TestGroupQueue
+	q.Init(logrus.WithField("test", "TestStatusOf"), []*configpb.TestGroup{
+		{
+			Name: "hi",
+		},
+		{
+			Name:      "there",
+			GcsPrefix: "bucket/there",
+		},
+	}, now)
+	q.Fix("there", now.Add(time.Hour), true)
+
+	cases := []struct {
+		name string
+		want *configpb.TestGroup
+		when time.Time
+		ok   bool
+	}{
+		{
+			name: "hi",
+			want: &configpb.TestGroup{
+				Name: "hi",
+			},
+			when: now,
+			ok:   true,
+		},
+		{
+			name: "there",
+			want: &configpb.TestGroup{
+				Name:      "there",
+				GcsPrefix: "bucket/there",
+			},
+			when: now.Add(time.Hour),
+			ok:   true,
+		},
+		{
+			name: "missing",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, st, ok := q.StatusOf(tc.name)
+			if ok != tc.ok {
+				t.Errorf("StatusOf() got ok %t, wanted %t", ok, tc.ok)
+			}
+			if diff := cmp.Diff(tc.want, got, protocmp.Transform()); diff != "" {
+				t.Errorf("StatusOf() got unexpected diff (-want +got):\n%s", diff)
+			}
+			if !st.When.Equal(tc.when) {
+				t.Errorf("StatusOf() got when %v, wanted %v", st.When, tc.when)
+			}
+		})
+	}
+	if depth, _, _ := q.Status(); depth != 2 {
+		t.Errorf("StatusOf() changed the queue depth to %d", depth)
+	}
+}
+
+func TestSetCron(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 20, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSetCron"), []*configpb.TestGroup{
+		{
+			Name: "hourly",
+		},
+		{
+			Name: "interval",
+		},
+	}, now)
+
+	if err := q.SetCron("hourly", "not a spec"); err == nil {
+		t.Error("SetCron() of an invalid spec failed to return an error")
+	}
+	if err := q.SetCron("missing", "0 * * * *"); err == nil {
+		t.Error("SetCron() of a missing group failed to return an error")
+	}
+	if err := q.SetCron("hourly", "CRON_TZ=UTC 0 * * * *"); err != nil {
+		t.Fatalf("SetCron() got unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan *configpb.TestGroup)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, 10*time.Minute)
+	}()
+	schedule := func() map[string]string {
+		got := map[string]string{}
+		for _, gs := range q.Schedule() {
+			got[gs.Name] = gs.When.Format(time.Kitchen)
+		}
+		return got
+	}
+
+	<-ch
+	<-ch
+	clk.BlockUntil(1)
+	want := map[string]string{
+		"hourly":   "1:00PM",
+		"interval": "12:30PM",
+	}
+	if diff := cmp.Diff(want, schedule()); diff != "" {
+		t.Errorf("Schedule() got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	clk.Set(now.Add(40 * time.Minute)) // 1:00PM
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		got[(<-ch).Name] = true
+	}
+	clk.BlockUntil(1)
+	want = map[string]string{
+		"hourly":   "2:00PM",
+		"interval": "1:10PM",
+	}
+	if diff := cmp.Diff(want, schedule()); diff != "" {
+		t.Errorf("Schedule() at 1:00PM got unexpected diff (-want +got):\n%s", diff)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestRemoveAfter(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.PullFrequency = time.Hour
+	q.Init(logrus.WithField("test", "TestRemoveAfter"), []*configpb.TestGroup{{Name: "hi"}, {Name: "there"}}, now.Add(time.Minute))
+
+	if err := q.RemoveAfter("missing", time.Minute); err == nil {
+		t.Error("RemoveAfter() of a missing item got no error")
+	}
+	if err := q.RemoveAfter("hi", 10*time.Minute); err != nil {
+		t.Fatalf("RemoveAfter() got unexpected error: %v", err)
+	}
+	if _, st, _ := q.StatusOf("hi"); !st.Draining || !st.RemoveAt.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("StatusOf() got draining %t until %v, wanted true until %v", st.Draining, st.RemoveAt, now.Add(10*time.Minute))
+	}
+	clk.Advance(2 * time.Minute)
+	if got, ok := q.TryNext(); !ok || got.Name != "there" {
+		t.Errorf("TryNext() got %v, %t, wanted there", got, ok)
+	}
+	if got, ok := q.TryNext(); ok {
+		t.Errorf("TryNext() of a draining item got %v, wanted nothing", got)
+	}
+
+	// Re-adding within the grace period keeps the earlier schedule.
+	q.Add(&configpb.TestGroup{Name: "hi"}, clk.Now().Add(time.Hour), false)
+	if _, st, ok := q.StatusOf("hi"); !ok || !st.When.Equal(now.Add(time.Minute)) || st.Draining {
+		t.Errorf("StatusOf() got %v, %t, draining %t, wanted %v, true, not draining", st.When, ok, st.Draining, now.Add(time.Minute))
+	}
+	clk.Advance(10 * time.Minute)
+	if got, ok := q.TryNext(); !ok || got.Name != "hi" {
+		t.Errorf("TryNext() after re-adding got %v, %t, wanted hi", got, ok)
+	}
+
+	// Otherwise the item is removed once the grace period elapses.
+	if err := q.RemoveAfter("there", 10*time.Minute); err != nil {
+		t.Fatalf("RemoveAfter() got unexpected error: %v", err)
+	}
+	clk.Advance(5 * time.Minute)
+	if _, st, ok := q.StatusOf("there"); !ok || !st.Draining {
+		t.Errorf("StatusOf() during the grace period got %t, draining %t, wanted there draining", ok, st.Draining)
+	}
+	clk.Advance(5 * time.Minute)
+	for i := 0; q.Len() != 1 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, _, ok := q.StatusOf("there"); ok {
+		t.Error("StatusOf() after the grace period got there, wanted nothing")
+	}
+
+	// Forgets removing an item Update drops.
+	if err := q.RemoveAfter("hi", 10*time.Minute); err != nil {
+		t.Fatalf("RemoveAfter() got unexpected error: %v", err)
+	}
+	q.Update([]*configpb.TestGroup{{Name: "there"}}, clk.Now())
+	q.Update([]*configpb.TestGroup{{Name: "hi"}, {Name: "there"}}, clk.Now())
+	if _, st, ok := q.StatusOf("hi"); !ok || st.Draining {
+		t.Errorf("StatusOf() after Update() dropped and re-added hi got %t, draining %t, wanted hi not draining", ok, st.Draining)
+	}
+	if n := len(q.removing); n != 0 {
+		t.Errorf("Update() left %d removals, wanted none", n)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ScheduleEventKind describes what changed about the schedule of an item.
+type ScheduleEventKind int
+
+const (
+	// Added items are in the queue from then on.
+	Added ScheduleEventKind = iota
+	// Removed items are no longer in the queue.
+	Removed
+	// Rescheduled items are next sent at a new time.
+	Rescheduled
+	// Sent items were sent successfully.
+	Sent
+)
+
+func (k ScheduleEventKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Rescheduled:
+		return "rescheduled"
+	case Sent:
+		return "sent"
+	}
+	return "unknown"
+}
+
+// ScheduleEvent describes a change to the schedule of the named item.
+type ScheduleEvent struct {
+	Kind ScheduleEventKind
+	Name string
+	// When the item is next sent, or when it was sent, and zero once removed.
+	When time.Time
+}
+
+// ScheduleWatch streams schedule events, see WatchSchedule.
+type ScheduleWatch struct {
+	events  chan ScheduleEvent
+	dropped uint64
+	close   func()
+}
+
+// Events returns the channel of events, which is closed by Close.
+func (w *ScheduleWatch) Events() <-chan ScheduleEvent {
+	return w.events
+}
+
+// Dropped returns how many events the queue dropped because the buffer of events was full.
+func (w *ScheduleWatch) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Close the watch, so it receives no more events and its channel is closed.
+func (w *ScheduleWatch) Close() {
+	w.close()
+}
+
+// WatchSchedule streams an event each time an item is added, removed, rescheduled or sent,
+// buffering up to buffer events, which is the channel analog of SetObserver.
+//
+// Drops events rather than waiting while the buffer is full, so a slow watcher
+// never stalls sending, and counts them, see Dropped. Send reschedules an item
+// when taking it off the queue, then reports it sent once a receiver takes it,
+// while Poke and Reschedule also report rescheduling an item. Close the watch
+// once done with it to stop buffering events, or Close the queue.
+func (q *ItemQueue[T]) WatchSchedule(buffer int) *ScheduleWatch {
+	w := &ScheduleWatch{events: make(chan ScheduleEvent, buffer)}
+	w.close = func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		if q.watches[w] {
+			delete(q.watches, w)
+			close(w.events)
+		}
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		close(w.events)
+		return w
+	}
+	if q.watches == nil {
+		q.watches = map[*ScheduleWatch]bool{}
+	}
+	q.watches[w] = true
+	return w
+}
+
+// notify every watch of an event about the named item, without waiting for any of them.
+//
+// Caller must hold the lock, either for reading or writing.
+func (q *ItemQueue[T]) notify(kind ScheduleEventKind, name string, when time.Time) {
+	for w := range q.watches {
+		select {
+		case w.events <- ScheduleEvent{Kind: kind, Name: name, When: when}:
+		default:
+			atomic.AddUint64(&w.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	configpb "github.com/GoogleCloudPlatform/testgrid/pb/config"
+	"github.com/GoogleCloudPlatform/testgrid/util/clock/fake"
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+)
+
+func TestWatchSchedule(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	var q TestGroupQueue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestWatchSchedule"), []*configpb.TestGroup{{Name: "hi"}}, now.Add(time.Hour))
+	w := q.WatchSchedule(10)
+	defer w.Close()
+
+	q.Add(&configpb.TestGroup{Name: "there"}, now.Add(time.Hour), false)
+	clk.Advance(time.Minute)
+	if err := q.Poke("there"); err != nil {
+		t.Fatalf("Poke() got unexpected error: %v", err)
+	}
+	ch := make(chan *configpb.TestGroup)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	<-ch
+	clk.BlockUntil(1)
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	q.Remove("hi")
+
+	poked := now.Add(time.Minute)
+	want := []ScheduleEvent{
+		{Kind: Added, Name: "there", When: now.Add(time.Hour)},
+		{Kind: Rescheduled, Name: "there", When: poked},
+		{Kind: Rescheduled, Name: "there", When: poked.Add(time.Hour)},
+		{Kind: Sent, Name: "there", When: poked},
+		{Kind: Removed, Name: "hi"},
+	}
+	var got []ScheduleEvent
+	for range want {
+		got = append(got, <-w.Events())
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("WatchSchedule() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if n := w.Dropped(); n != 0 {
+		t.Errorf("Dropped() got %d, wanted 0", n)
+	}
+
+	w.Close()
+	if _, ok := <-w.Events(); ok {
+		t.Error("Close() failed to close the events")
+	}
+	q.Add(&configpb.TestGroup{Name: "hi"}, now, false)
+}
+
+func TestWatchScheduleDropped(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var q TestGroupQueue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestWatchScheduleDropped"), nil, now)
+	w := q.WatchSchedule(1)
+	defer w.Close()
+	q.Add(&configpb.TestGroup{Name: "hi"}, now, false)
+	q.Add(&configpb.TestGroup{Name: "there"}, now, false)
+	q.Add(&configpb.TestGroup{Name: "again"}, now, false)
+	if n := w.Dropped(); n != 2 {
+		t.Errorf("Dropped() got %d, wanted 2", n)
+	}
+	if got := <-w.Events(); got.Name != "hi" {
+		t.Errorf("Events() got %v, wanted hi", got)
+	}
+}
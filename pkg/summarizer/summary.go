@@ -202,7 +202,7 @@ func Update(ctx context.Context, client gcs.ConditionalClient, mets *Metrics, co
 				"active": activeDashboards,
 			})
 			if next != nil {
-				log = log.WithField("next", *next)
+				log = log.WithField("next", next.Name)
 			}
 			delay := time.Since(when)
 			if delay < 0 {
@@ -230,7 +230,7 @@ func Update(ctx context.Context, client gcs.ConditionalClient, mets *Metrics, co
 		}
 	}()
 
-	dashboardNames := make(chan string)
+	dashboards := make(chan *configpb.Dashboard)
 
 	// TODO(fejta): cache downloaded group?
 	findGroup := func(dash string, tab *configpb.DashboardTab) (*gcs.Path, *configpb.TestGroup, gridReader, error) {
@@ -306,7 +306,8 @@ func Update(ctx context.Context, client gcs.ConditionalClient, mets *Metrics, co
 	for i := 0; i < concurrency; i++ {
 		go func() {
 			defer wg.Done()
-			for dashName := range dashboardNames {
+			for dash := range dashboards {
+				dashName := dash.Name
 				lock.Lock()
 				start := active.Add(dashName)
 				if !start {
@@ -344,9 +345,9 @@ func Update(ctx context.Context, client gcs.ConditionalClient, mets *Metrics, co
 		}()
 	}
 	defer wg.Wait()
-	defer close(dashboardNames)
+	defer close(dashboards)
 
-	return q.Send(ctx, dashboardNames, freq)
+	return q.Send(ctx, dashboards, freq)
 }
 
 func filterDashboards(dashboards map[string]*configpb.Dashboard, allowed stringset.Set) map[string]*configpb.Dashboard {
@@ -472,7 +472,7 @@ func TestProcessGCSNotifications(t *testing.T) {
 					Time: now,
 				},
 			},
-			want:     "world",
+			want:     "boom", // both are fixed to the same time, so by name
 			wantWhen: now.Add(namedDurations["finished.json"]),
 		},
 		{
@@ -0,0 +1,58 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package clock abstracts telling the time and waiting for it to pass,
+// so that tests can control time instead of sleeping.
+package clock
+
+import "time"
+
+// Clock tells the current time and creates timers.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer sends the current time on its channel after a duration elapses.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Real is a Clock backed by the time package.
+type Real struct{}
+
+// Now returns time.Now().
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer returns a time.NewTimer(d).
+func (Real) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.timer.Stop()
+}
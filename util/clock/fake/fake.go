@@ -0,0 +1,126 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake contains a clock whose time only moves when told to.
+package fake
+
+import (
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/testgrid/util/clock"
+)
+
+// Clock is a clock.Clock whose time only changes when advanced.
+type Clock struct {
+	now    time.Time
+	timers map[*timer]bool
+	lock   sync.Mutex
+	cond   *sync.Cond
+}
+
+// NewClock returns a clock stopped at now.
+func NewClock(now time.Time) *Clock {
+	c := &Clock{
+		now:    now,
+		timers: map[*timer]bool{},
+	}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// NewTimer returns a timer that fires once the clock advances by d.
+func (c *Clock) NewTimer(d time.Duration) clock.Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &timer{
+		clock: c,
+		when:  c.now.Add(d),
+		ch:    make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+	c.timers[t] = true
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance the clock by d, firing any timers that expire.
+func (c *Clock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if t.when.After(c.now) {
+			continue
+		}
+		t.ch <- c.now
+		delete(c.timers, t)
+	}
+	c.cond.Broadcast()
+}
+
+// Set the clock to now, firing any timers that expire.
+func (c *Clock) Set(now time.Time) {
+	c.Advance(now.Sub(c.Now()))
+}
+
+// Timers returns the number of timers waiting to fire.
+func (c *Clock) Timers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil waits until at least n timers are waiting to fire.
+func (c *Clock) BlockUntil(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+type timer struct {
+	clock *Clock
+	when  time.Time
+	ch    chan time.Time
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *timer) Stop() bool {
+	c := t.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.timers[t] {
+		return false
+	}
+	delete(c.timers, t)
+	c.cond.Broadcast()
+	return true
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := NewClock(now)
+	if got := c.Now(); !got.Equal(now) {
+		t.Errorf("Now() got %v, wanted %v", got, now)
+	}
+
+	early := c.NewTimer(time.Second)
+	late := c.NewTimer(time.Minute)
+	stopped := c.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("Stop() of a waiting timer returned false")
+	}
+	if got := c.Timers(); got != 2 {
+		t.Errorf("Timers() got %d, wanted 2", got)
+	}
+	c.BlockUntil(2)
+
+	c.Advance(time.Second)
+	select {
+	case got := <-early.C():
+		if want := now.Add(time.Second); !got.Equal(want) {
+			t.Errorf("early timer fired at %v, wanted %v", got, want)
+		}
+	default:
+		t.Error("early timer failed to fire")
+	}
+	select {
+	case <-late.C():
+		t.Error("late timer fired early")
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+	if early.Stop() {
+		t.Error("Stop() of a fired timer returned true")
+	}
+
+	c.Set(now.Add(time.Hour))
+	select {
+	case <-late.C():
+	default:
+		t.Error("late timer failed to fire")
+	}
+	if got := c.Timers(); got != 0 {
+		t.Errorf("Timers() got %d, wanted 0", got)
+	}
+
+	select {
+	case <-c.NewTimer(0).C():
+	default:
+		t.Error("zero timer failed to fire immediately")
+	}
+}
@@ -26,9 +26,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/GoogleCloudPlatform/testgrid/util/clock"
 	"github.com/sirupsen/logrus"
 )
 
@@ -38,24 +43,145 @@ import (
 // First call must be to Init().
 // Exported methods are safe to call concurrently.
 type Queue struct {
+	// OnEmpty is called by Send once nothing is ready to send, without holding the lock.
+	// Send calls it once when it starts with nothing ready, then once after each OnNonEmpty.
+	OnEmpty func()
+	// OnNonEmpty is called by Send once something is ready to send after OnEmpty,
+	// without holding the lock.
+	OnNonEmpty func()
+	// EmptyDebounce delays OnEmpty until nothing has been ready for this long,
+	// so a queue which only empties briefly does not flap.
+	EmptyDebounce time.Duration
+	// FIFO sends every name once in the order it was added, such as for a one-off
+	// backfill, then removes it, so Send returns once the queue is empty whatever
+	// the frequency. Ignores when each name is scheduled, along with priorities,
+	// weights and other per-name settings. Adding a name still in the queue keeps
+	// its place, whereas adding one which was already sent puts it at the back.
+	// Set before calling Init.
+	FIFO bool
+	// ZeroFrequency decides what sends do with each item they send at a zero frequency:
+	// PopAtZero removes it, whereas RepeatAtZero sends it again as soon as possible.
+	ZeroFrequency ZeroFrequencyMode
+	// Anchor decides what sends reschedule each item they send relative to: AnchorSent
+	// reschedules it frequency after it is sent, so slow sends drift, whereas AnchorScheduled
+	// reschedules it frequency after it was scheduled, holding a steady cadence.
+	// Items with a Schedule ignore it.
+	Anchor AnchorMode
+	// JumpTolerance detects the wall clock jumping by more than this while sends sleep,
+	// such as after an NTP step or a VM resuming from suspend, at which point every
+	// item is shifted by the jump, see ShiftAll. So they keep their spacing rather than
+	// all becoming ready at once after a forward jump, or stalling after a backward one.
+	// Only jumps while sleeping are detected. Zero disables detection.
+	JumpTolerance time.Duration
+	// Align holds ready items until the next multiple of this since the zero time,
+	// such as the top of each minute, then sends every item ready by then together
+	// as a wave, which SendBatch sends as one batch. Trades up to this much latency
+	// for better batching downstream. Zero sends each item as soon as it is ready.
+	Align time.Duration
+	// CatchUp decides what AnchorScheduled does once an item falls more than its
+	// frequency behind: SkipMissed skips the slots it missed, whereas BurstMissed
+	// sends it once for each of them as soon as possible.
+	CatchUp CatchUpMode
+
 	queue  priorityQueue
 	items  map[string]*item
 	lock   sync.RWMutex
 	signal chan struct{}
 	log    logrus.FieldLogger
+	rand   *rand.Rand
+	clock  clock.Clock
+
+	limiter  Limiter
+	paused   bool
+	pausedAt time.Time
+	sends    uint64 // number of items taken off the queue
+	enqueued uint64 // number of items added when FIFO
+	// custom is set once any item has a priority, lane, weight, dependencies, minimum
+	// interval, class or is paused, or ready items have an order, so the earliest
+	// item may not be sent first.
+	custom bool
+	// classes records when an item of each class was last taken, counting every take.
+	classes map[string]uint64
+	// readyLess orders ready items, see SetReadyLess.
+	readyLess func(a, b string) bool
+	// shuffle orders items ready at the same time randomly, see SetShuffle.
+	shuffle bool
+	// frequency replaces the frequency passed to sends when positive, see SetDefaultFrequency.
+	frequency time.Duration
+	// pinned names the item sent next, see PinNext.
+	pinned string
+	// sweep names items to send first, in order, see SweepDeps.
+	sweep []string
+
+	windows []Window
+	spread  time.Duration
+	// windowEnd is when the current window ends, or zero outside one.
+	windowEnd time.Time
 }
 
+// ZeroFrequencyMode decides what sends do with an item sent at a zero frequency.
+type ZeroFrequencyMode int
+
+const (
+	// PopAtZero removes each item once it is sent, so sends return once the queue
+	// is empty, such as to process every item once. The default.
+	PopAtZero ZeroFrequencyMode = iota
+	// RepeatAtZero reschedules each item at the time it is sent, so it is sent
+	// again as soon as possible, after any other item which was already ready.
+	// An item with its own frequency, see SetFrequency, is rescheduled by that.
+	RepeatAtZero
+)
+
+// AnchorMode decides what sends reschedule each item relative to.
+type AnchorMode int
+
+const (
+	// AnchorSent reschedules each item relative to when it is sent. The default.
+	AnchorSent AnchorMode = iota
+	// AnchorScheduled reschedules each item relative to when it was scheduled, see CatchUp.
+	AnchorScheduled
+)
+
+// CatchUpMode decides how AnchorScheduled reschedules an item which missed slots.
+type CatchUpMode int
+
+const (
+	// SkipMissed reschedules the item at its first slot after it is sent. The default.
+	SkipMissed CatchUpMode = iota
+	// BurstMissed reschedules the item at its next slot, even when that already passed.
+	BurstMissed
+)
+
 // Init (or reinit) the queue with the specified groups, which should be updated at frequency.
 func (q *Queue) Init(log logrus.FieldLogger, names []string, when time.Time) {
-	n := len(names)
-	found := make(map[string]bool, n)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+	q.log = log
+	q.update(names, when)
+}
 
+// Update the queue to the specified names after Init, logging like the last Init.
+//
+// Like Init, keeps when each existing name is next sent, schedules new names at when
+// and removes names that are no longer specified.
+func (q *Queue) Update(names []string, when time.Time) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 	defer q.rouse()
+	q.update(names, when)
+}
+
+// update the queue to the specified names.
+//
+// Caller must hold the lock.
+func (q *Queue) update(names []string, when time.Time) {
+	n := len(names)
+	found := make(map[string]bool, n)
+	log := q.log
 
 	if q.signal == nil {
-		q.signal = make(chan struct{})
+		q.signal = make(chan struct{}, 1)
 	}
 
 	if q.items == nil {
@@ -66,23 +192,29 @@ func (q *Queue) Init(log logrus.FieldLogger, names []string, when time.Time) {
 	}
 	items := q.items
 
-	q.log = log
+	adding := log.WithField("when", when)
+	var added bool
 	for _, name := range names {
 		found[name] = true
 		if _, ok := items[name]; ok {
 			continue
 		}
 		it := &item{
-			name:  name,
-			when:  when,
-			index: len(q.queue),
+			name:      name,
+			when:      when,
+			index:     len(q.queue),
+			order:     q.enqueue(),
+			rank:      q.rank(),
+			immediate: !when.After(q.timeNow()),
 		}
-		heap.Push(&q.queue, it)
+		// Append every new item, then fix the heap once rather than after each one.
+		q.queue = append(q.queue, it)
+		added = true
 		items[name] = it
-		log.WithFields(logrus.Fields{
-			"when": when,
-			"name": name,
-		}).Info("Adding name to queue")
+		adding.WithField("name", name).Info("Adding name to queue")
+	}
+	if added {
+		heap.Init(&q.queue)
 	}
 
 	for name, it := range items {
@@ -90,11 +222,87 @@ func (q *Queue) Init(log logrus.FieldLogger, names []string, when time.Time) {
 			continue
 		}
 		log.WithField("name", name).Info("Removing name from queue")
-		heap.Remove(&q.queue, it.index)
+		if it.index >= 0 {
+			heap.Remove(&q.queue, it.index)
+		}
 		delete(q.items, name)
 	}
 }
 
+// Add the named item at when, leaving all other items unchanged.
+//
+// If the item already exists its next time only changes like Fix: moving
+// it earlier when that is sooner, and only moving it later if later is set.
+func (q *Queue) Add(name string, when time.Time, later bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+
+	log := q.log.WithFields(logrus.Fields{
+		"when": when,
+		"name": name,
+	})
+
+	if it, ok := q.items[name]; ok {
+		switch {
+		case it.index < 0: // popped by Send
+		case when.Before(it.when):
+		case later && !when.Equal(it.when):
+		default:
+			return
+		}
+		it.when = when
+		if it.index < 0 {
+			it.order = q.enqueue()
+			heap.Push(&q.queue, it)
+		} else {
+			heap.Fix(&q.queue, it.index)
+		}
+		log.Info("Rescheduled name in queue")
+		return
+	}
+	it := &item{
+		name:      name,
+		when:      when,
+		order:     q.enqueue(),
+		rank:      q.rank(),
+		immediate: !when.After(q.timeNow()),
+	}
+	heap.Push(&q.queue, it)
+	q.items[name] = it
+	log.Info("Adding name to queue")
+}
+
+// enqueue returns the place of an item being added at the back of a FIFO queue,
+// or zero when the queue is not FIFO.
+//
+// Caller must hold the lock.
+func (q *Queue) enqueue() uint64 {
+	if !q.FIFO {
+		return 0
+	}
+	q.enqueued++
+	return q.enqueued
+}
+
+// Remove the named item, leaving all other items unchanged.
+func (q *Queue) Remove(name string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+
+	it, ok := q.items[name]
+	if !ok {
+		return errors.New("not found")
+	}
+	if it.index >= 0 {
+		heap.Remove(&q.queue, it.index)
+	}
+	delete(q.items, name)
+	q.log.WithField("name", name).Info("Removing name from queue")
+	return nil
+}
+
 // FixAll will fix multiple groups inside a single critical section.
 //
 // If later is set then it will move out the next update time, otherwise
@@ -151,7 +359,13 @@ func (q *Queue) Fix(name string, when time.Time, later bool) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 	defer q.rouse()
+	return q.fix(name, when, later)
+}
 
+// fix the next time to send the group, see Fix.
+//
+// Caller must hold the lock.
+func (q *Queue) fix(name string, when time.Time, later bool) error {
 	it, ok := q.items[name]
 	if !ok {
 		return errors.New("not found")
@@ -168,164 +382,1768 @@ func (q *Queue) Fix(name string, when time.Time, later bool) error {
 		return nil
 	}
 	it.when = when
-	heap.Fix(&q.queue, it.index)
+	if it.index >= 0 {
+		heap.Fix(&q.queue, it.index)
+	}
 	log.Info("Fixed names")
 	return nil
 }
 
-// Current status for each item in the queue.
-func (q *Queue) Current() map[string]time.Time {
-	currently := make(map[string]time.Time, len(q.queue))
-	q.lock.RLock()
-	defer q.lock.RUnlock()
-	for _, item := range q.queue {
-		currently[item.name] = item.when
+// Poke the named item, so that it is sent as soon as possible.
+//
+// Sends report the item was poked the next time they take it, see Scheduled.
+func (q *Queue) Poke(name string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+	if err := q.fix(name, q.timeNow(), false); err != nil {
+		return err
 	}
-	return currently
+	q.items[name].poked = true
+	return nil
 }
 
-// Status of the queue: depth, next item and when the next item is ready.
-func (q *Queue) Status() (int, *string, time.Time) {
-	q.lock.RLock()
-	defer q.lock.RUnlock()
-	var who *string
-	var when time.Time
-	if it := q.queue.peek(); it != nil {
-		who = &it.name
-		when = it.when
+// PinNext makes the named item the very next one sends take off the queue, once,
+// after which they send items in the usual order again.
+//
+// Unlike Poke, which makes the item ready to compete with other ready items,
+// the pinned item is sent before any other, whatever their schedule, priority or lane.
+// Pinning another item replaces the pin, and an item held by SendHolding is
+// sent next once it is released, like a paused item once it is resumed.
+func (q *Queue) PinNext(name string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+	if _, ok := q.items[name]; !ok {
+		return errors.New("not found")
 	}
-	return len(q.queue), who, when
+	q.pinned = name
+	return nil
 }
 
-func (q *Queue) rouse() {
-	select {
-	case q.signal <- struct{}{}: // wake up early
-	default: // not sleeping
+// Release an item held by SendHolding, so it is next sent at when.
+//
+// Sends it as soon as possible instead when it was poked while held, so
+// the poke is folded into a single send once the hold ends rather than lost.
+func (q *Queue) Release(name string, when time.Time) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+
+	it, ok := q.items[name]
+	if !ok {
+		return errors.New("not found")
+	}
+	if it.index >= 0 {
+		return errors.New("not held")
 	}
+	if now := q.timeNow(); it.poked && now.Before(when) {
+		when = now
+	}
+	it.when = when
+	heap.Push(&q.queue, it)
+	return nil
 }
 
-func (q *Queue) sleep(d time.Duration) {
-	log := q.log.WithFields(logrus.Fields{
-		"seconds": d.Round(100 * time.Millisecond).Seconds(),
-	})
-	if d > 5*time.Second {
-		log.Info("Sleeping...")
-	} else {
-		log.Debug("Sleeping...")
+// Frequency returns how often the named item is sent: its override, or else frequency.
+func (q *Queue) Frequency(name string, frequency time.Duration) time.Duration {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	frequency = q.defaultTo(frequency)
+	if it, ok := q.items[name]; ok {
+		return it.every(frequency)
 	}
-	sleep := time.NewTimer(d)
-	start := time.Now()
-	select {
-	case <-q.signal:
-		if !sleep.Stop() {
-			<-sleep.C
-		}
-		dur := time.Now().Sub(start)
-		log := log.WithField("after", dur.Round(time.Millisecond))
-		switch {
-		case dur > 10*time.Second:
-			log.Info("Roused")
-		case dur > time.Second:
-			log.Debug("Roused")
-		default:
-			log.Trace("Roused")
-		}
-	case <-sleep.C:
+	return frequency
+}
+
+// SetDefaultFrequency replaces the frequency passed to sends and Next with d, even while they run,
+// or stops replacing it when d is zero.
+//
+// Like SetFrequency, applies the next time an item is rescheduled, so items
+// keep when they are next sent. Items with their own frequency keep it.
+func (q *Queue) SetDefaultFrequency(d time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.frequency = d
+}
+
+// defaultTo returns the default frequency when set, see SetDefaultFrequency, or else frequency.
+//
+// Caller must hold the lock.
+func (q *Queue) defaultTo(frequency time.Duration) time.Duration {
+	if q.frequency > 0 {
+		return q.frequency
 	}
+	return frequency
 }
 
-// Send test groups to receivers until the context expires.
+// SetFrequency overrides how often Send reschedules the named item.
 //
-// Pops items off the queue when frequency is zero.
-// Otherwise reschedules the item after the specified frequency has elapsed.
-func (q *Queue) Send(ctx context.Context, receivers chan<- string, frequency time.Duration) error {
-	var next func() (*string, time.Time)
-	if frequency == 0 {
-		next = func() (*string, time.Time) {
-			if len(q.queue) == 0 {
-				return nil, time.Time{}
-			}
-			it := heap.Pop(&q.queue).(*item)
-			return &it.name, it.when
-		}
-	} else {
-		next = func() (*string, time.Time) {
-			it := q.queue.peek()
-			if it == nil {
-				return nil, time.Time{}
-			}
-			when := it.when
-			it.when = time.Now().Add(frequency)
-			heap.Fix(&q.queue, it.index)
-			return &it.name, when
-		}
+// The override applies the next time Send reschedules the item, so it does not
+// change when the item is next sent. Use Fix to also move that time.
+// The override belongs to the item, so removing the item clears it.
+// A zero frequency clears the override, reverting to the frequency passed to Send.
+func (q *Queue) SetFrequency(name string, frequency time.Duration) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	it, ok := q.items[name]
+	if !ok {
+		return errors.New("not found")
 	}
+	it.frequency = frequency
+	return nil
+}
 
-	for {
-		if err := ctx.Err(); err != nil {
-			return err
-		}
-		q.lock.Lock()
-		who, when := next()
-		q.lock.Unlock()
+// Schedule computes when to next send an item, such as a cron.Schedule.
+type Schedule interface {
+	// Next returns when to send the item after t.
+	Next(t time.Time) time.Time
+}
 
-		if who == nil {
-			if frequency == 0 {
-				return nil
-			}
-			q.sleep(time.Second)
-			continue
-		}
+// SetSchedule reschedules the named item at the times the schedule returns,
+// rather than frequency after it is sent. A nil schedule uses frequency again.
+//
+// Returns an error when the item is missing, and leaves when it is next sent unchanged.
+func (q *Queue) SetSchedule(name string, s Schedule) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
 
-		if dur := time.Until(when); dur > 0 {
-			q.sleep(dur)
-		}
-		select {
-		case receivers <- *who:
-		case <-ctx.Done():
-			return ctx.Err()
-		}
+	it, ok := q.items[name]
+	if !ok {
+		return errors.New("not found")
 	}
+	it.schedule = s
+	return nil
 }
 
-type priorityQueue []*item
-
-func (pq priorityQueue) Len() int { return len(pq) }
-func (pq priorityQueue) Less(i, j int) bool {
-	return pq[i].when.Before(pq[j].when)
+// NextAfter returns when to send the named item again after sending it at when.
+//
+// Uses the item's schedule when set, otherwise its frequency, see Frequency.
+func (q *Queue) NextAfter(name string, when time.Time, frequency time.Duration) time.Time {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	frequency = q.defaultTo(frequency)
+	if it, ok := q.items[name]; ok {
+		return it.next(when, frequency)
+	}
+	return when.Add(frequency)
 }
-func (pq priorityQueue) Swap(i, j int) {
-	pq[i], pq[j] = pq[j], pq[i]
-	pq[i].index = i
-	pq[j].index = j
+
+// SetPriority of the named item, which defaults to zero.
+//
+// Priority only breaks ties between items that are ready to send: the
+// ready item with the highest priority is sent first, followed by the one
+// that has been ready the longest when their priorities are equal.
+// An item that is not yet ready is never sent before a ready one, whatever
+// its priority.
+func (q *Queue) SetPriority(name string, priority int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	it, ok := q.items[name]
+	if !ok {
+		return errors.New("not found")
+	}
+	it.priority = priority
+	q.custom = q.custom || priority != 0
+	return nil
 }
 
-func (pq *priorityQueue) Push(something interface{}) {
-	it := something.(*item)
-	it.index = len(*pq)
-	*pq = append(*pq, it)
+// SetLane of the named item, which defaults to zero.
+//
+// Lanes are strict tiers: sends only send a ready item of a lane once no item
+// of a lower lane is ready, whatever their priorities, and even when sending fairly.
+// So a busy lane starves every higher one, such as a slow lane of archived items.
+func (q *Queue) SetLane(name string, lane int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	it, ok := q.items[name]
+	if !ok {
+		return errors.New("not found")
+	}
+	it.lane = lane
+	q.custom = q.custom || lane != 0
+	return nil
 }
 
-func (pq *priorityQueue) Pop() interface{} {
-	old := *pq
-	n := len(old)
-	it := old[n-1]
-	it.index = -1
-	old[n-1] = nil
-	*pq = old[0 : n-1]
-	return it
+// SetWeight of the named item, which defaults to one.
+//
+// Weights share sending between ready items of the same priority and class, or every
+// ready item when sending fairly: while several items stay ready, each one is
+// sent in proportion to its weight, so an item of weight 3 is sent three times
+// as often as one of weight 1, which is still sent a quarter of the time.
+// Items are chosen by smooth weighted round robin: each time something is sent,
+// every candidate earns credit equal to its weight, then the one with the most
+// credit is sent and pays back the total weight of the candidates.
+// Uses the usual order when every ready item has the default weight.
+func (q *Queue) SetWeight(name string, weight int) error {
+	if weight < 1 {
+		return fmt.Errorf("weight must be positive: %d", weight)
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	it, ok := q.items[name]
+	if !ok {
+		return errors.New("not found")
+	}
+	it.weight = weight
+	q.custom = q.custom || weight > 1
+	return nil
 }
 
-func (pq priorityQueue) peek() *item {
-	n := len(pq)
-	if n == 0 {
-		return nil
+// SetDeps of the named item, which then waits to be sent until each of deps
+// is sent after the item was last sent.
+//
+// So an item which aggregates others is only sent once every one of them
+// was sent in the current cycle, rather than from stale inputs. Returns an
+// error instead of creating a cycle of dependencies, or when a dependency
+// is not in the queue. Dependencies removed from the queue later are ignored.
+// Clears the dependencies of the item when deps is empty.
+func (q *Queue) SetDeps(name string, deps []string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+
+	it, ok := q.items[name]
+	if !ok {
+		return errors.New("not found")
 	}
-	return pq[0]
+	for _, dep := range deps {
+		if _, ok := q.items[dep]; !ok {
+			return fmt.Errorf("dependency %q not found", dep)
+		}
+	}
+	if path := q.cycle(name, deps); path != nil {
+		return fmt.Errorf("dependency cycle: %s", strings.Join(path, " -> "))
+	}
+	it.deps = append([]string(nil), deps...)
+	q.custom = q.custom || len(deps) > 0
+	return nil
 }
 
-type item struct {
-	name  string
-	when  time.Time
-	index int
+// SweepDeps sends every item ready now in dependency order, each after the items
+// it depends on, see SetDeps, such as once after Init so that aggregating items are
+// not first sent from missing inputs. Orders items independent of each other by name.
+//
+// Sends then schedule items as usual. The sweep ends early at the first item in order
+// which is not yet ready, and is replaced by a later SweepDeps. Returns an error naming
+// the cycle rather than sweeping when the dependencies of items form one.
+func (q *Queue) SweepDeps() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+	order, err := q.topo()
+	if err != nil {
+		return err
+	}
+	q.sweep = order
+	return nil
+}
+
+// topo returns the name of every item, each after its dependencies.
+//
+// Caller must hold the lock.
+func (q *Queue) topo() ([]string, error) {
+	names := make([]string, 0, len(q.items))
+	for name := range q.items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(names))
+	order := make([]string, 0, len(names))
+	var visit func(path []string, name string) error
+	visit = func(path []string, name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		}
+		state[name] = visiting
+		deps := append([]string(nil), q.items[name].deps...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if _, ok := q.items[dep]; !ok {
+				continue
+			}
+			if err := visit(append(path[:len(path):len(path)], name), dep); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(nil, name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// swept returns the next item of the sweep when it is ready at now, see SweepDeps,
+// ending the sweep otherwise.
+//
+// Caller must hold the lock.
+func (q *Queue) swept(now time.Time) *item {
+	for len(q.sweep) > 0 {
+		name := q.sweep[0]
+		q.sweep = q.sweep[1:]
+		it, ok := q.items[name]
+		if !ok || it.index < 0 || it.paused {
+			continue
+		}
+		if it.when.After(now) {
+			q.sweep = nil
+			return nil
+		}
+		return it
+	}
+	q.sweep = nil
+	return nil
+}
+
+// cycle returns the path from name back to itself through deps and their dependencies, if any.
+//
+// Caller must hold the lock.
+func (q *Queue) cycle(name string, deps []string) []string {
+	visited := map[string]bool{}
+	var visit func(path, deps []string) []string
+	visit = func(path, deps []string) []string {
+		for _, dep := range deps {
+			next := append(path[:len(path):len(path)], dep)
+			if dep == name {
+				return next
+			}
+			if visited[dep] {
+				continue
+			}
+			visited[dep] = true
+			it, ok := q.items[dep]
+			if !ok {
+				continue
+			}
+			if found := visit(next, it.deps); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	return visit([]string{name}, deps)
+}
+
+// waiting returns true when the item depends on one not sent since the item was, see SetDeps.
+//
+// Caller must hold the lock.
+func (q *Queue) waiting(it *item) bool {
+	for _, name := range it.deps {
+		if dep, ok := q.items[name]; ok && dep.sent <= it.sent {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMinInterval between sending the named item, or no minimum when zero.
+//
+// However the item is scheduled, including by Poke or a schedule, it is not
+// sent again until the interval has elapsed since it was last sent. An item
+// ready sooner waits until then instead.
+func (q *Queue) SetMinInterval(name string, d time.Duration) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+
+	it, ok := q.items[name]
+	if !ok {
+		return errors.New("not found")
+	}
+	it.minInterval = d
+	q.custom = q.custom || d > 0
+	return nil
+}
+
+// SetReadyLess orders items which are ready at the same priority by less, or by
+// the default order again when nil.
+//
+// Never reorders items which are not yet ready, nor ones ready at different
+// priorities, nor those sent fairly. Less must be a strict weak ordering of names:
+// items where neither is less than the other keep their default order, see
+// item.before. Is called while holding the lock, so must not call the queue.
+func (q *Queue) SetReadyLess(less func(a, b string) bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.readyLess = less
+	q.custom = q.custom || less != nil
+}
+
+// before returns true when the ready item a is sent before b, see SetReadyLess.
+//
+// Caller must hold the lock.
+func (q *Queue) before(a, b *item) bool {
+	if q.readyLess != nil {
+		if q.readyLess(a.name, b.name) {
+			return true
+		}
+		if q.readyLess(b.name, a.name) {
+			return false
+		}
+	}
+	if q.shuffle && a.when.Equal(b.when) && a.rank != b.rank {
+		return a.rank < b.rank
+	}
+	return a.before(b)
+}
+
+// SetShuffle sends items ready at the same time in a random order, drawn again
+// each time an item is sent, rather than by which was sent least recently.
+//
+// Spreads which items go first evenly over time, such as after RescheduleAll
+// makes every item ready at once. Only orders ready items, never changing when
+// they are ready, and yields to any order from SetReadyLess. Shuffles
+// deterministically after Seed.
+func (q *Queue) SetShuffle(shuffle bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.shuffle = shuffle
+	q.custom = q.custom || shuffle
+	names := make([]string, 0, len(q.items))
+	for name := range q.items {
+		names = append(names, name)
+	}
+	sort.Strings(names) // so ranks are deterministic after Seed
+	for _, name := range names {
+		q.items[name].rank = q.rank()
+	}
+}
+
+// rank returns a random order among items ready at the same time when shuffling,
+// or else zero, see SetShuffle.
+//
+// Caller must hold the lock.
+func (q *Queue) rank() int64 {
+	if !q.shuffle {
+		return 0
+	}
+	if q.rand == nil {
+		return rand.Int63()
+	}
+	return q.rand.Int63()
+}
+
+// SetClass of the named item, such as the dashboard it belongs to, which defaults to none.
+//
+// Sending takes turns between classes: whenever items of several classes are
+// ready at the same priority, or any priority when sending fairly, it sends the
+// first ready item of the class sent least recently. So while items of N classes
+// stay ready, each class is sent at least once every N sends, however many items
+// it has. Items without a class take turns as a class of their own.
+func (q *Queue) SetClass(name, class string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	it, ok := q.items[name]
+	if !ok {
+		return errors.New("not found")
+	}
+	it.class = class
+	if class != "" {
+		q.custom = true
+		if q.classes == nil {
+			q.classes = map[string]uint64{}
+		}
+	}
+	return nil
+}
+
+// SetPaused stops sending the named item until it is unpaused.
+//
+// A paused item keeps its place in the queue, so it is still reported by
+// Status and Current, but Send skips it in favor of the next ready item.
+func (q *Queue) SetPaused(name string, paused bool) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+
+	it, ok := q.items[name]
+	if !ok {
+		return errors.New("not found")
+	}
+	it.resumed = it.resumed || it.paused && !paused
+	it.paused = paused
+	q.custom = q.custom || paused
+	return nil
+}
+
+// Paused reports whether the named item is paused, see SetPaused.
+func (q *Queue) Paused(name string) bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	it, ok := q.items[name]
+	return ok && it.paused
+}
+
+// ShiftAll moves when every item is next sent by offset, preserving their order.
+//
+// A negative offset moves every item earlier. Times are not clamped to the
+// present, which would reorder them: items moved into the past are ready
+// right away and are sent in their original order.
+func (q *Queue) ShiftAll(offset time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+	q.queue.shift(offset)
+	q.log.WithField("offset", offset).Info("Shifted all names")
+}
+
+// RescheduleAll sets when every item is next sent to when, keeping every item in the queue.
+//
+// Unlike ShiftAll this sets an absolute time, so items with the same
+// priority become ready together. Leaves items held by SendHolding held.
+func (q *Queue) RescheduleAll(when time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+	for _, it := range q.queue {
+		it.when = when
+	}
+	heap.Init(&q.queue)
+	q.log.WithField("when", when).Info("Rescheduled all names")
+}
+
+// JitterAll delays when every item is next sent by a random duration up to max.
+//
+// Spreads out items which would otherwise be ready at the same time, for
+// example after RescheduleAll. Leaves items held by SendHolding held.
+func (q *Queue) JitterAll(max time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+	for _, it := range q.queue {
+		it.when = it.when.Add(q.jitter(max))
+	}
+	heap.Init(&q.queue)
+}
+
+// PauseAll stops Send from sending any item until ResumeAll.
+//
+// Send keeps running while paused, waiting for ResumeAll or its context to expire.
+// An item Send already took off the queue may still be sent after pausing.
+func (q *Queue) PauseAll() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+	if q.paused {
+		return
+	}
+	q.paused = true
+	q.pausedAt = q.timeNow()
+	q.log.Info("Paused queue")
+}
+
+// ResumeAll allows Send to send items again after PauseAll.
+//
+// Unless catchUp is set this delays every item by how long the queue was
+// paused, so that items remain as far from being ready as when the queue
+// paused, rather than sending every item that became ready in a burst.
+func (q *Queue) ResumeAll(catchUp bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+	if !q.paused {
+		return
+	}
+	q.paused = false
+	paused := q.timeNow().Sub(q.pausedAt)
+	if !catchUp {
+		q.queue.shift(paused)
+	}
+	q.log.WithField("paused", paused).Info("Resumed queue")
+}
+
+// Limiter allows sending an item once Wait returns, such as a *rate.Limiter.
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// SetLimiter makes sends wait for the limiter before taking each ready item off the queue.
+//
+// Items remain at their current time until the limiter allows sending them.
+// A nil limiter sends items as soon as they are ready.
+func (q *Queue) SetLimiter(l Limiter) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.limiter = l
+}
+
+// Ramp is a Limiter whose rate grows linearly from a start rate to a target rate over
+// a duration, so a backend just starting up is not sent everything due at once.
+//
+// The ramp begins the first time a send waits for it, and afterwards allows the target rate.
+type Ramp struct {
+	start, target float64 // per second
+	dur           time.Duration
+	clock         clock.Clock
+
+	lock  sync.Mutex
+	began time.Time // when the ramp began, or zero before its first Wait
+	waits int       // how many Waits the ramp allowed or is waiting to allow
+}
+
+// NewRamp returns a Ramp from start to target sends per second over d, timed by clk,
+// or the system clock when clk is nil. A non-positive target never waits.
+func NewRamp(clk clock.Clock, start, target float64, d time.Duration) *Ramp {
+	if clk == nil {
+		clk = clock.Real{}
+	}
+	if start < 0 {
+		start = 0
+	}
+	if d < 0 {
+		d = 0
+	}
+	return &Ramp{start: start, target: target, dur: d, clock: clk}
+}
+
+// Wait until the ramp allows another send, or the context expires.
+func (r *Ramp) Wait(ctx context.Context) error {
+	if r.target <= 0 {
+		return ctx.Err()
+	}
+	r.lock.Lock()
+	now := r.clock.Now()
+	if r.began.IsZero() {
+		r.began = now
+	}
+	when := r.at(r.waits)
+	r.waits++
+	r.lock.Unlock()
+	timer := r.clock.NewTimer(when.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+// at returns when the ramp allows the nth send, counting from zero, once the
+// sends it allows by then add up to n.
+//
+// Caller must hold the lock.
+func (r *Ramp) at(n int) time.Time {
+	secs := r.dur.Seconds()
+	ramped := (r.start + r.target) / 2 * secs // sends allowed during the ramp
+	k := float64(n)
+	var t float64
+	switch {
+	case secs <= 0 || k >= ramped:
+		t = secs + (k-ramped)/r.target
+	case r.start == r.target:
+		t = k / r.start
+	default:
+		// Solve start*t + (target-start)/(2*secs)*t^2 = k for t.
+		a := (r.target - r.start) / (2 * secs)
+		t = (math.Sqrt(r.start*r.start+4*a*k) - r.start) / (2 * a)
+	}
+	return r.began.Add(time.Duration(t * float64(time.Second)))
+}
+
+// Seed the random source used to jitter rescheduled items and shuffle ready ones.
+//
+// Items are jittered and shuffled deterministically after seeding, which is useful for tests.
+func (q *Queue) Seed(seed int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.rand = rand.New(rand.NewSource(seed))
+}
+
+// SetClock changes the clock the queue uses to tell time, which defaults to the system clock.
+//
+// Sends wait on timers from the clock, so tests can step a fake.Clock past
+// each frequency rather than sleeping for it, see TestSendClock.
+func (q *Queue) SetClock(c clock.Clock) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.clock = c
+}
+
+func (q *Queue) getClock() clock.Clock {
+	if q.clock == nil {
+		return clock.Real{}
+	}
+	return q.clock
+}
+
+// timeNow returns the current time according to the clock.
+//
+// Caller must hold the lock.
+func (q *Queue) timeNow() time.Time {
+	return q.getClock().Now()
+}
+
+// jitter returns a random duration in [0, max).
+//
+// Caller must hold the lock.
+func (q *Queue) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	if q.rand == nil {
+		return time.Duration(rand.Int63n(int64(max)))
+	}
+	return time.Duration(q.rand.Int63n(int64(max)))
+}
+
+// Current status for each item in the queue.
+func (q *Queue) Current() map[string]time.Time {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	currently := make(map[string]time.Time, len(q.queue))
+	for _, item := range q.queue {
+		currently[item.name] = item.when
+	}
+	return currently
+}
+
+// When the named item is next ready, if it is in the queue.
+func (q *Queue) When(name string) (time.Time, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	it, ok := q.items[name]
+	if !ok || it.index < 0 {
+		return time.Time{}, false
+	}
+	return it.when, true
+}
+
+// Status of the queue: depth, next item and when the next item is ready.
+func (q *Queue) Status() (int, *string, time.Time) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	var who *string
+	var when time.Time
+	if it := q.queue.peek(); it != nil {
+		who = &it.name
+		when = it.when
+	}
+	return len(q.queue), who, when
+}
+
+// Len returns the depth of the queue reported by Status, without the next item.
+func (q *Queue) Len() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return len(q.queue)
+}
+
+// IsEmpty returns true when the queue has a depth of zero, see Len.
+func (q *Queue) IsEmpty() bool {
+	return q.Len() == 0
+}
+
+// TimeUntilNext returns how long until the next item is ready, or zero when it already
+// is, and false when the queue is empty, so callers can sleep rather than poll Status.
+//
+// Like Status, considers the next item even when it is paused.
+func (q *Queue) TimeUntilNext() (time.Duration, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	it := q.queue.peek()
+	if it == nil {
+		return 0, false
+	}
+	if d := it.when.Sub(q.timeNow()); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// Overdue returns how many items are ready to send right now, ignoring paused items.
+func (q *Queue) Overdue() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.queue.overdue(q.timeNow(), false)
+}
+
+// ReadyCount returns how many items are next sent now or earlier, including paused items.
+//
+// Unlike the depth from Status, excludes items scheduled for later.
+func (q *Queue) ReadyCount() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.queue.overdue(q.timeNow(), true)
+}
+
+// ProjectedLoad returns how many times sends are expected to send items within window
+// of now, counting each time an item is sent again at its frequency or schedule.
+//
+// Uses the frequency of each item, see SetFrequency and SetDefaultFrequency, and counts
+// an item without one once when it is sent within window. Overdue items count as sent
+// now. Ignores paused items and items held by SendHolding.
+func (q *Queue) ProjectedLoad(window time.Duration) int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	now := q.timeNow()
+	end := now.Add(window)
+	var n int
+	for _, it := range q.queue {
+		if it.paused || it.when.After(end) {
+			continue
+		}
+		n++
+		next := it.when
+		if next.Before(now) {
+			next = now
+		}
+		if it.schedule != nil {
+			for after := it.schedule.Next(next); after.After(next) && !after.After(end); after = it.schedule.Next(after) {
+				next = after
+				n++
+			}
+			continue
+		}
+		if every := it.every(q.frequency); every > 0 {
+			n += int(end.Sub(next) / every)
+		}
+	}
+	return n
+}
+
+// Peek returns up to the next n names in the order they are scheduled.
+//
+// Leaves the queue unchanged. Names scheduled at the same time are ordered
+// by name. Ignores priority and pausing, see SetPriority and SetPaused.
+func (q *Queue) Peek(n int) []string {
+	q.lock.RLock()
+	items := make([]Scheduled, 0, len(q.queue))
+	for _, it := range q.queue {
+		items = append(items, Scheduled{Name: it.name, When: it.when})
+	}
+	q.lock.RUnlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].When.Equal(items[j].When) {
+			return items[i].When.Before(items[j].When)
+		}
+		return items[i].Name < items[j].Name
+	})
+	if n > len(items) {
+		n = len(items)
+	}
+	var names []string
+	for i := 0; i < n; i++ {
+		names = append(names, items[i].Name)
+	}
+	return names
+}
+
+func (q *Queue) rouse() {
+	select {
+	case q.signal <- struct{}{}: // wake up early
+	default: // already roused
+	}
+}
+
+// sleep until d elapses, the queue changes or the context expires.
+func (q *Queue) sleep(ctx context.Context, d time.Duration) {
+	if d < 0 {
+		q.log.Debug("Waiting for the queue to change...")
+		select {
+		case <-q.signal:
+		case <-ctx.Done():
+		}
+		return
+	}
+	log := q.log.WithFields(logrus.Fields{
+		"seconds": d.Round(100 * time.Millisecond).Seconds(),
+	})
+	if d > 5*time.Second {
+		log.Info("Sleeping...")
+	} else {
+		log.Debug("Sleeping...")
+	}
+	q.lock.RLock()
+	clk := q.getClock()
+	tolerance := q.JumpTolerance
+	q.lock.RUnlock()
+	sleep := clk.NewTimer(d)
+	start := clk.Now()
+	if tolerance > 0 {
+		defer func() { q.jumped(start, clk.Now(), d, tolerance) }()
+	}
+	select {
+	case <-q.signal:
+		if !sleep.Stop() {
+			<-sleep.C()
+		}
+		dur := clk.Now().Sub(start)
+		log := log.WithField("after", dur.Round(time.Millisecond))
+		switch {
+		case dur > 10*time.Second:
+			log.Info("Roused")
+		case dur > time.Second:
+			log.Debug("Roused")
+		default:
+			log.Trace("Roused")
+		}
+	case <-ctx.Done():
+		if !sleep.Stop() {
+			<-sleep.C()
+		}
+	case <-sleep.C():
+	}
+}
+
+// jumped shifts every item when the wall clock jumped by more than tolerance
+// between start and end of sleeping for up to d, see JumpTolerance.
+//
+// Measures how long the sleep took with the monotonic clock when the clock has one,
+// and otherwise assumes it took at most d.
+func (q *Queue) jumped(start, end time.Time, d, tolerance time.Duration) {
+	wall := end.Round(0).Sub(start.Round(0))
+	slept := end.Sub(start)
+	if slept > d {
+		slept = d
+	}
+	jump := wall - slept
+	if jump <= tolerance && jump >= -tolerance {
+		return
+	}
+	q.log.WithField("jump", jump).Warning("Clock jumped, shifting all names")
+	q.ShiftAll(jump)
+}
+
+// Send test groups to receivers until the context expires.
+//
+// Pops items off the queue when frequency is zero, unless ZeroFrequency is RepeatAtZero.
+// Otherwise reschedules the item after the specified frequency has elapsed,
+// or after the item's own frequency when overridden with SetFrequency.
+func (q *Queue) Send(ctx context.Context, receivers chan<- string, frequency time.Duration) error {
+	return q.SendWithJitter(ctx, receivers, frequency, 0)
+}
+
+// SendWithJitter sends names to receivers until the context expires.
+//
+// Behaves like Send, except it delays each rescheduled item by a random
+// duration in [0, jitter), which spreads out items that would otherwise
+// become ready at the same time. Items are not jittered by Init.
+//
+// A zero jitter is identical to Send.
+func (q *Queue) SendWithJitter(ctx context.Context, receivers chan<- string, frequency, jitter time.Duration) error {
+	return q.send(ctx, sendOptions{frequency: frequency, jitter: jitter}, func(s Scheduled) bool {
+		select {
+		case receivers <- s.Name:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
+
+// Scheduled is a name sent by the queue, along with when it was ready to send.
+type Scheduled struct {
+	Name string
+	When time.Time
+	// Depth of the queue once the name was taken off it.
+	Depth int
+	// Next time the name is sent, or zero when it left the queue.
+	Next time.Time
+	// Poked is set when the name was poked since it was last taken off the queue.
+	Poked bool
+	// Taken is when the name was taken off the queue, at or after When, and later
+	// than it when the queue falls behind.
+	Taken time.Time
+	// Trigger is why the name was taken off the queue.
+	Trigger Trigger
+}
+
+// Trigger is why a send took an item off the queue, see Scheduled.
+type Trigger int
+
+const (
+	// TriggerScheduled items were sent because their next time arrived.
+	TriggerScheduled Trigger = iota
+	// TriggerPoked items were sent after Poke.
+	TriggerPoked
+	// TriggerPinned items were sent after PinNext.
+	TriggerPinned
+	// TriggerResumed items were sent for the first time since SetPaused resumed them.
+	TriggerResumed
+	// TriggerImmediate items were sent for the first time since Init, Update or Add
+	// made them ready right away.
+	TriggerImmediate
+)
+
+func (t Trigger) String() string {
+	switch t {
+	case TriggerScheduled:
+		return "scheduled"
+	case TriggerPoked:
+		return "poked"
+	case TriggerPinned:
+		return "pinned"
+	case TriggerResumed:
+		return "resumed"
+	case TriggerImmediate:
+		return "immediate"
+	}
+	return fmt.Sprintf("Trigger(%d)", int(t))
+}
+
+// LastTrigger returns why the named item was last taken off the queue,
+// and whether it is in the queue and was ever taken.
+func (q *Queue) LastTrigger(name string) (Trigger, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	it, ok := q.items[name]
+	if !ok || it.taken.IsZero() {
+		return TriggerScheduled, false
+	}
+	return it.trigger, true
+}
+
+// SendScheduled sends each name and when it was scheduled to receivers until the context expires.
+//
+// Otherwise behaves like SendWithJitter.
+func (q *Queue) SendScheduled(ctx context.Context, receivers chan<- Scheduled, frequency, jitter time.Duration) error {
+	return q.send(ctx, sendOptions{frequency: frequency, jitter: jitter}, scheduledTo(ctx, receivers))
+}
+
+// SendGraceful behaves like SendScheduled, except when the context expires
+// before a receiver gets the item it took off the queue.
+//
+// Rather than leaving the item rescheduled, it puts the item back at the time
+// it was scheduled, so the next send sends it right away.
+func (q *Queue) SendGraceful(ctx context.Context, receivers chan<- Scheduled, frequency, jitter time.Duration) error {
+	return q.send(ctx, sendOptions{frequency: frequency, jitter: jitter, restore: true}, scheduledTo(ctx, receivers))
+}
+
+// SendFair behaves like SendScheduled, except it ignores priority.
+//
+// Whenever several items are ready it sends the most overdue one first,
+// which bounds how stale any item can become.
+func (q *Queue) SendFair(ctx context.Context, receivers chan<- Scheduled, frequency, jitter time.Duration) error {
+	return q.send(ctx, sendOptions{frequency: frequency, jitter: jitter, fair: true}, scheduledTo(ctx, receivers))
+}
+
+// SendHolding sends each item to receivers once it is ready, until the context expires.
+//
+// Rather than rescheduling sent items, it holds them out of the queue
+// until they are released with Release (or reintroduced by Add).
+// Held items are not counted by Status or Current, and are never sent
+// again while held, even when poked. Puts back an item the context expires
+// before a receiver gets, like SendGraceful.
+func (q *Queue) SendHolding(ctx context.Context, receivers chan<- Scheduled) error {
+	return q.send(ctx, sendOptions{hold: true}, scheduledTo(ctx, receivers))
+}
+
+func scheduledTo(ctx context.Context, receivers chan<- Scheduled) func(Scheduled) bool {
+	return func(s Scheduled) bool {
+		select {
+		case receivers <- s:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// send items to deliver until the context expires or deliver returns false.
+func (q *Queue) send(ctx context.Context, opts sendOptions, deliver func(Scheduled) bool) error {
+	var allowed bool // whether the limiter allows taking the next ready item
+	var ready readiness
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.lock.Lock()
+		if limiter := q.limiter; limiter != nil && !allowed && q.hasReady(opts.fair) {
+			q.lock.Unlock()
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+			allowed = true
+			continue
+		}
+		who, dur := q.take(opts)
+		now := q.timeNow()
+		q.lock.Unlock()
+
+		if who == nil {
+			if dur == 0 {
+				return nil
+			}
+			if wait := ready.idle(now, q.EmptyDebounce, q.OnEmpty); wait > 0 && (dur < 0 || wait < dur) {
+				dur = wait
+			}
+			// Wait for the next item to become ready, or for the queue to change.
+			// A negative duration waits until the queue changes.
+			q.sleep(ctx, dur)
+			continue
+		}
+
+		ready.busy(q.OnNonEmpty)
+		allowed = false
+		if !deliver(*who) {
+			if opts.restore || opts.hold {
+				q.restore(*who)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// restore an item send took off the queue, so it is next sent no later than when it was scheduled.
+func (q *Queue) restore(s Scheduled) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+	it, ok := q.items[s.Name]
+	if !ok {
+		return
+	}
+	if it.index < 0 {
+		it.when = s.When
+		heap.Push(&q.queue, it)
+		return
+	}
+	if s.When.Before(it.when) {
+		it.when = s.When
+		heap.Fix(&q.queue, it.index)
+	}
+}
+
+// readiness tracks whether send has anything ready, for OnEmpty and OnNonEmpty.
+type readiness struct {
+	empty bool      // whether OnEmpty was called since something was last ready
+	since time.Time // when nothing was ready after something was, or zero
+}
+
+// idle records that nothing is ready at now, calling onEmpty once nothing has
+// been ready for debounce. Otherwise returns how much longer until then.
+func (r *readiness) idle(now time.Time, debounce time.Duration, onEmpty func()) time.Duration {
+	if r.empty {
+		return 0
+	}
+	if r.since.IsZero() {
+		r.since = now
+	}
+	if wait := r.since.Add(debounce).Sub(now); wait > 0 {
+		return wait
+	}
+	r.empty = true
+	if onEmpty != nil {
+		onEmpty()
+	}
+	return 0
+}
+
+// busy records that something is ready, calling onNonEmpty if it was empty.
+func (r *readiness) busy(onNonEmpty func()) {
+	r.since = time.Time{}
+	if !r.empty {
+		return
+	}
+	r.empty = false
+	if onNonEmpty != nil {
+		onNonEmpty()
+	}
+}
+
+// hasReady returns true when send can take an item off the queue right now.
+//
+// Caller must hold the lock.
+func (q *Queue) hasReady(fair bool) bool {
+	if q.paused {
+		return false
+	}
+	now := q.timeNow()
+	if _, ok := q.window(now); ok {
+		return false
+	}
+	if q.FIFO {
+		return len(q.queue) > 0
+	}
+	if q.pin() != nil {
+		return true
+	}
+	it, _ := q.ready(q.aligned(now), fair)
+	return it != nil
+}
+
+// aligned returns the last boundary of Align at or before now, or now when not aligning.
+//
+// Items are ready once they are scheduled at or before it, see Align.
+func (q *Queue) aligned(now time.Time) time.Time {
+	if q.Align <= 0 {
+		return now
+	}
+	return now.Truncate(q.Align)
+}
+
+// untilAligned converts how long until an item is ready by the aligned time of now
+// into how long until the boundary of Align at which it is ready.
+func (q *Queue) untilAligned(now time.Time, dur time.Duration) time.Duration {
+	if q.Align <= 0 || dur <= 0 {
+		return dur
+	}
+	when := q.aligned(now).Add(dur)
+	boundary := when.Truncate(q.Align)
+	if boundary.Before(when) {
+		boundary = boundary.Add(q.Align)
+	}
+	return boundary.Sub(now)
+}
+
+// pin returns the item to send next, see PinNext, or nil when there is none,
+// it left the queue or it is paused.
+//
+// Caller must hold the lock.
+func (q *Queue) pin() *item {
+	if q.pinned == "" {
+		return nil
+	}
+	it, ok := q.items[q.pinned]
+	if !ok || it.index < 0 || it.paused {
+		return nil
+	}
+	return it
+}
+
+// ready returns the ready item to send first, or else how long until an item is ready.
+//
+// Caller must hold the lock.
+func (q *Queue) ready(now time.Time, fair bool) (*item, time.Duration) {
+	if q.custom {
+		return q.queue.ready(now, fair, q.waiting, q.before)
+	}
+	// Otherwise the earliest item is sent first, without visiting any others.
+	it := q.queue.peek()
+	if it == nil {
+		return nil, time.Second
+	}
+	if dur := it.when.Sub(now); dur > 0 {
+		return nil, dur
+	}
+	return it, 0
+}
+
+// SendBatch sends every item ready at the same time to receivers as one batch, until the context expires.
+//
+// Sends at most maxBatch items in each batch when positive, and each item at most
+// once per batch, and reschedules each item frequency later like SendScheduled.
+// Ignores any limiter.
+func (q *Queue) SendBatch(ctx context.Context, receivers chan<- []Scheduled, frequency time.Duration, maxBatch int) error {
+	opts := sendOptions{frequency: frequency}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var batch []Scheduled
+		opts.batched = map[string]bool{}
+		q.lock.Lock()
+		who, dur := q.take(opts)
+		for who != nil {
+			opts.batched[who.Name] = true
+			batch = append(batch, *who)
+			if maxBatch > 0 && len(batch) >= maxBatch {
+				break
+			}
+			who, _ = q.take(opts)
+		}
+		q.lock.Unlock()
+
+		if len(batch) == 0 {
+			if dur == 0 {
+				return nil
+			}
+			q.sleep(ctx, dur)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case receivers <- batch:
+		}
+	}
+}
+
+// Next blocks until an item is ready, then returns it along with when it was scheduled.
+//
+// Reschedules the item frequency later, or removes it when frequency is zero like Send.
+// Unlike Send, an empty queue waits for an item to be added.
+// Must not be called while a Send is running.
+func (q *Queue) Next(ctx context.Context, frequency time.Duration) (*Scheduled, error) {
+	opts := sendOptions{frequency: frequency}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		q.lock.Lock()
+		who, dur := q.take(opts)
+		q.lock.Unlock()
+		if who != nil {
+			return who, nil
+		}
+		if dur == 0 {
+			dur = -1
+		}
+		q.sleep(ctx, dur)
+	}
+}
+
+// TryNext returns the next ready item like Next, or false right away when no item is ready.
+//
+// Reschedules the item like Next, so consumers can pull items from their own select loop.
+func (q *Queue) TryNext(frequency time.Duration) (*Scheduled, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	who, _ := q.take(sendOptions{frequency: frequency})
+	return who, who != nil
+}
+
+// NextBatch blocks until an item is ready, then returns up to n distinct items ready by then.
+//
+// Returns fewer than n items rather than waiting for more to be ready, and
+// one when n is not positive. Otherwise behaves like Next.
+func (q *Queue) NextBatch(ctx context.Context, frequency time.Duration, n int) ([]Scheduled, error) {
+	opts := sendOptions{frequency: frequency}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var batch []Scheduled
+		opts.batched = map[string]bool{}
+		q.lock.Lock()
+		who, dur := q.take(opts)
+		for who != nil {
+			opts.batched[who.Name] = true
+			batch = append(batch, *who)
+			if len(batch) >= n {
+				break
+			}
+			who, _ = q.take(opts)
+		}
+		q.lock.Unlock()
+		if len(batch) > 0 {
+			return batch, nil
+		}
+		if dur == 0 {
+			dur = -1
+		}
+		q.sleep(ctx, dur)
+	}
+}
+
+// take the next item to send, or else how long to wait.
+//
+// Holds items sent when hold is set, otherwise pops them when frequency
+// is zero, see ZeroFrequency, and reschedules them when it is not.
+// A zero wait means the queue is done sending, and a negative one means
+// waiting until the queue changes. Caller must hold the lock.
+func (q *Queue) take(opts sendOptions) (*Scheduled, time.Duration) {
+	frequency, jitter, hold := q.defaultTo(opts.frequency), opts.jitter, opts.hold
+	if q.FIFO {
+		frequency, hold = 0, false // send each item once, see FIFO
+	}
+	// Pop each item, and stop once the queue is empty.
+	pop := frequency == 0 && !hold && (q.FIFO || q.ZeroFrequency == PopAtZero)
+	if q.paused {
+		return nil, -1
+	}
+	now := q.timeNow()
+	if end, ok := q.window(now); ok {
+		q.windowEnd = end
+		return nil, end.Sub(now)
+	}
+	q.closeWindow(now)
+	it := q.queue.peek()
+	if it == nil {
+		if pop {
+			return nil, 0
+		}
+		return nil, time.Second
+	}
+	trigger := TriggerScheduled
+	pinned, swept := q.pin(), (*item)(nil)
+	if pinned == nil {
+		swept = q.swept(q.aligned(now))
+	}
+	if pinned != nil {
+		it = pinned
+		trigger = TriggerPinned
+	} else if swept != nil {
+		it = swept
+	} else {
+		ready := q.aligned(now)
+		if !q.FIFO {
+			var dur time.Duration
+			if it, dur = q.ready(ready, opts.fair); it == nil {
+				return nil, q.untilAligned(now, dur)
+			}
+		}
+		if q.custom && !q.FIFO {
+			if q.classes != nil {
+				it = q.queue.rotate(ready, it, opts.fair, q.waiting, q.before, q.classes)
+			}
+			it = q.queue.weigh(ready, it, opts.fair, q.waiting, q.before)
+		}
+	}
+	if opts.batched[it.name] {
+		// Leave the item as it was for the next batch.
+		if swept != nil {
+			q.sweep = append([]string{it.name}, q.sweep...)
+		}
+		return nil, 0
+	}
+	if pinned != nil {
+		q.pinned = ""
+	}
+	q.sends++
+	it.sent = q.sends
+	if q.classes != nil {
+		q.classes[it.class] = q.sends
+	}
+	it.taken = now
+	if trigger == TriggerScheduled {
+		trigger = it.triggered()
+	}
+	s := Scheduled{Name: it.name, When: it.when, Poked: it.poked, Taken: now, Trigger: trigger}
+	it.poked = false
+	it.resumed = false
+	it.immediate = false
+	it.trigger = trigger
+	it.rank = q.rank()
+	if pop || hold {
+		heap.Remove(&q.queue, it.index)
+		s.Depth = len(q.queue)
+		return &s, 0
+	}
+	it.when = q.reschedule(it, now, frequency).Add(q.jitter(jitter))
+	heap.Fix(&q.queue, it.index)
+	s.Depth = len(q.queue)
+	s.Next = it.when
+	return &s, 0
+}
+
+// reschedule returns when to send the item again after taking it at now, see Anchor.
+//
+// Caller must hold the lock.
+func (q *Queue) reschedule(it *item, now time.Time, frequency time.Duration) time.Time {
+	every := it.every(frequency)
+	if q.Anchor != AnchorScheduled || it.schedule != nil || every <= 0 {
+		return it.next(now, frequency)
+	}
+	next := it.when.Add(every)
+	if q.CatchUp == SkipMissed && !next.After(now) {
+		missed := now.Sub(it.when) / every
+		next = it.when.Add((missed + 1) * every)
+	}
+	return next
+}
+
+// sendOptions control how send chooses and reschedules items.
+type sendOptions struct {
+	frequency time.Duration
+	jitter    time.Duration
+	hold      bool            // hold sent items until they are released
+	fair      bool            // send the most overdue item first, ignoring priority
+	restore   bool            // put back items the context expired before delivering
+	batched   map[string]bool // items already in the batch, which take leaves alone
+}
+
+type priorityQueue []*item
+
+func (pq priorityQueue) Len() int { return len(pq) }
+func (pq priorityQueue) Less(i, j int) bool {
+	return pq[i].before(pq[j])
+}
+func (pq priorityQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
+
+func (pq *priorityQueue) Push(something interface{}) {
+	it := something.(*item)
+	it.index = len(*pq)
+	*pq = append(*pq, it)
+}
+
+func (pq *priorityQueue) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	it := old[n-1]
+	it.index = -1
+	old[n-1] = nil
+	*pq = old[0 : n-1]
+	return it
+}
+
+// shift when every item is ready by offset, which preserves their order.
+func (pq priorityQueue) shift(offset time.Duration) {
+	for _, it := range pq {
+		it.when = it.when.Add(offset)
+	}
+}
+
+func (pq priorityQueue) peek() *item {
+	n := len(pq)
+	if n == 0 {
+		return nil
+	}
+	return pq[0]
+}
+
+// ready returns the ready item to send first, see SetPriority, ignoring
+// paused items, those still waiting for dependencies, see SetDeps,
+// and those sent too recently, see SetMinInterval.
+// Otherwise returns how long until an item is ready.
+//
+// When fair is set it returns the most overdue ready item, whatever its priority.
+// Either way it returns an item of the lowest lane with one ready, see SetLane.
+//
+// Only visits ready and paused items along with the next item to be ready:
+// the children of any other item are ready even later.
+func (pq priorityQueue) ready(now time.Time, fair bool, waiting func(*item) bool, before func(a, b *item) bool) (*item, time.Duration) {
+	var best *item
+	var wait time.Duration
+	var visit func(i int)
+	visit = func(i int) {
+		if i >= len(pq) {
+			return
+		}
+		it := pq[i]
+		switch {
+		case it.paused, waiting(it):
+		case it.when.After(now):
+			if dur := it.when.Sub(now); wait == 0 || dur < wait {
+				wait = dur
+			}
+			return
+		case it.early(now):
+			if dur := it.taken.Add(it.minInterval).Sub(now); wait == 0 || dur < wait {
+				wait = dur
+			}
+		case best == nil:
+			best = it
+		case it.lane != best.lane:
+			if it.lane < best.lane {
+				best = it
+			}
+		case fair:
+			if it.before(best) {
+				best = it
+			}
+		case it.priority > best.priority || it.priority == best.priority && before(it, best):
+			best = it
+		}
+		visit(2*i + 1)
+		visit(2*i + 2)
+	}
+	visit(0)
+	if wait == 0 {
+		wait = time.Second // every item is paused
+	}
+	return best, wait
+}
+
+// overdue returns how many items are ready at now, including paused ones if set.
+//
+// Only visits ready items and their children, since the heap orders items by when.
+func (pq priorityQueue) overdue(now time.Time, paused bool) int {
+	var n int
+	var visit func(i int)
+	visit = func(i int) {
+		if i >= len(pq) || pq[i].when.After(now) {
+			return
+		}
+		if paused || !pq[i].paused {
+			n++
+		}
+		visit(2*i + 1)
+		visit(2*i + 2)
+	}
+	visit(0)
+	return n
+}
+
+// rotate chooses the class sent least recently among those with an item ready at now
+// in the lane of best with its priority, or any priority when fair, see SetClass.
+//
+// Returns the first ready item of that class, or best when it is in that class.
+func (pq priorityQueue) rotate(now time.Time, best *item, fair bool, waiting func(*item) bool, before func(a, b *item) bool, classes map[string]uint64) *item {
+	firsts := map[string]*item{}
+	var visit func(i int)
+	visit = func(i int) {
+		if i >= len(pq) {
+			return
+		}
+		it := pq[i]
+		if it.when.After(now) {
+			return
+		}
+		if !it.paused && !waiting(it) && !it.early(now) && it.lane == best.lane && (fair || it.priority == best.priority) {
+			if first, ok := firsts[it.class]; !ok || before(it, first) {
+				firsts[it.class] = it
+			}
+		}
+		visit(2*i + 1)
+		visit(2*i + 2)
+	}
+	visit(0)
+	for class, first := range firsts {
+		switch {
+		case classes[class] < classes[best.class]:
+		case classes[class] > classes[best.class]:
+			continue
+		case before(first, best):
+		default:
+			continue
+		}
+		best = first
+	}
+	return best
+}
+
+// weigh chooses between best and the other items ready at now with its lane, priority
+// and class, or every ready item of its lane and class when fair, by their weight, see SetWeight.
+func (pq priorityQueue) weigh(now time.Time, best *item, fair bool, waiting func(*item) bool, before func(a, b *item) bool) *item {
+	var candidates []*item
+	var weighted bool
+	var visit func(i int)
+	visit = func(i int) {
+		if i >= len(pq) {
+			return
+		}
+		it := pq[i]
+		if it.when.After(now) {
+			return
+		}
+		if !it.paused && !waiting(it) && !it.early(now) && it.lane == best.lane && it.class == best.class && (fair || it.priority == best.priority) {
+			candidates = append(candidates, it)
+			weighted = weighted || it.share() > 1
+		}
+		visit(2*i + 1)
+		visit(2*i + 2)
+	}
+	visit(0)
+	if !weighted {
+		return best
+	}
+	var total int
+	for _, it := range candidates {
+		it.credit += it.share()
+		total += it.share()
+	}
+	for _, it := range candidates {
+		switch {
+		case it.credit > best.credit:
+		case it.credit < best.credit:
+			continue
+		case before(it, best):
+		default:
+			continue
+		}
+		best = it
+	}
+	best.credit -= total
+	return best
+}
+
+type item struct {
+	name      string
+	when      time.Time
+	index     int
+	frequency time.Duration
+	schedule  Schedule
+	priority  int
+	lane      int // see SetLane
+	weight    int
+	credit    int // earned by weigh
+	class     string
+	poked     bool    // since it was last taken, see Poke
+	resumed   bool    // since it was last taken, see SetPaused
+	immediate bool    // ready when added and not taken since, see TriggerImmediate
+	trigger   Trigger // of the last take, see LastTrigger
+	order     uint64  // in a FIFO queue, see before
+	rank      int64   // among items ready at the same time, see SetShuffle
+	paused    bool
+	deps      []string
+	sent      uint64    // when the item was last taken, counting every take
+	taken     time.Time // when the item was last taken
+	// minInterval between taking the item, see SetMinInterval.
+	minInterval time.Duration
+}
+
+// triggered returns why the item is taken, unless it is pinned.
+func (it *item) triggered() Trigger {
+	switch {
+	case it.poked:
+		return TriggerPoked
+	case it.resumed:
+		return TriggerResumed
+	case it.immediate:
+		return TriggerImmediate
+	}
+	return TriggerScheduled
+}
+
+// early returns true when the item was taken less than its minimum interval before now.
+func (it *item) early(now time.Time) bool {
+	return it.minInterval > 0 && !it.taken.IsZero() && now.Before(it.taken.Add(it.minInterval))
+}
+
+// before returns true when the item is next sent before other.
+//
+// Orders items scheduled at the same time by which was taken least recently,
+// then by name, so whichever order they were added in, they are always sent
+// in the same order, and one sent again right away is not sent before the rest.
+// Orders items of a FIFO queue by when they were added instead.
+func (it *item) before(other *item) bool {
+	if it.order != other.order {
+		return it.order < other.order
+	}
+	if it.when.Equal(other.when) {
+		if it.sent != other.sent {
+			return it.sent < other.sent
+		}
+		return it.name < other.name
+	}
+	return it.when.Before(other.when)
+}
+
+// share returns the weight of the item, defaulting to one.
+func (it *item) share() int {
+	if it.weight > 0 {
+		return it.weight
+	}
+	return 1
+}
+
+// next returns when to send the item again after now, see NextAfter.
+func (it *item) next(now time.Time, frequency time.Duration) time.Time {
+	if it.schedule != nil {
+		return it.schedule.Next(now)
+	}
+	return now.Add(it.every(frequency))
+}
+
+// every returns how often to send the item, defaulting to frequency.
+func (it *item) every(frequency time.Duration) time.Duration {
+	if it.frequency > 0 {
+		return it.frequency
+	}
+	return frequency
 }
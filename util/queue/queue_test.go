@@ -19,10 +19,15 @@ package queue
 import (
 	"container/heap"
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/GoogleCloudPlatform/testgrid/util/clock/fake"
 	"github.com/google/go-cmp/cmp"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/protobuf/testing/protocmp"
@@ -83,6 +88,159 @@ func TestInit(t *testing.T) {
 	}
 }
 
+func TestAdd(t *testing.T) {
+	now := time.Now()
+	log := logrus.WithField("test", "TestAdd")
+	cases := []struct {
+		name  string
+		q     *Queue
+		add   string
+		when  time.Time
+		later bool
+
+		next []string
+	}{
+		{
+			name: "empty",
+			q: func() *Queue {
+				var q Queue
+				q.Init(log, nil, now)
+				return &q
+			}(),
+			add:  "hi",
+			when: now,
+			next: []string{"hi"},
+		},
+		{
+			name: "add",
+			q: func() *Queue {
+				var q Queue
+				q.Init(log, []string{"first", "third"}, now)
+				q.Fix("third", now.Add(time.Hour), true)
+				return &q
+			}(),
+			add:  "second",
+			when: now.Add(time.Minute),
+			next: []string{"first", "second", "third"},
+		},
+		{
+			name: "reduce",
+			q: func() *Queue {
+				var q Queue
+				q.Init(log, []string{"first-now-second", "second-now-first"}, now)
+				q.Fix("second-now-first", now.Add(time.Hour), true)
+				return &q
+			}(),
+			add:  "second-now-first",
+			when: now.Add(-time.Minute),
+			next: []string{"second-now-first", "first-now-second"},
+		},
+		{
+			name: "ignore later",
+			q: func() *Queue {
+				var q Queue
+				q.Init(log, []string{"first", "second"}, now)
+				q.Fix("second", now.Add(time.Hour), true)
+				return &q
+			}(),
+			add:  "first",
+			when: now.Add(2 * time.Hour),
+			next: []string{"first", "second"},
+		},
+		{
+			name: "later",
+			q: func() *Queue {
+				var q Queue
+				q.Init(log, []string{"first-now-second", "second-now-first"}, now)
+				q.Fix("second-now-first", now.Add(time.Hour), true)
+				return &q
+			}(),
+			add:   "first-now-second",
+			when:  now.Add(2 * time.Hour),
+			later: true,
+			next:  []string{"second-now-first", "first-now-second"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.q.Add(tc.add, tc.when, tc.later)
+			if n := len(tc.q.items); n != len(tc.next) {
+				t.Errorf("Add() got %d items, wanted %d", n, len(tc.next))
+			}
+			var got []string
+			for range tc.next {
+				got = append(got, heap.Pop(&tc.q.queue).(*item).name)
+			}
+			if diff := cmp.Diff(tc.next, got); diff != "" {
+				t.Errorf("Add() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	now := time.Now()
+	log := logrus.WithField("test", "TestRemove")
+	cases := []struct {
+		name   string
+		q      *Queue
+		remove string
+
+		next []string
+		err  bool
+	}{
+		{
+			name:   "missing",
+			q:      &Queue{},
+			remove: "missing",
+			err:    true,
+		},
+		{
+			name: "head",
+			q: func() *Queue {
+				var q Queue
+				q.Init(log, []string{"head", "second", "third"}, now)
+				q.Fix("head", now.Add(-time.Minute), false)
+				q.Fix("third", now.Add(time.Minute), true)
+				return &q
+			}(),
+			remove: "head",
+			next:   []string{"second", "third"},
+		},
+		{
+			name: "middle",
+			q: func() *Queue {
+				var q Queue
+				q.Init(log, []string{"first", "second", "third"}, now)
+				q.Fix("first", now.Add(-time.Minute), false)
+				q.Fix("third", now.Add(time.Minute), true)
+				return &q
+			}(),
+			remove: "second",
+			next:   []string{"first", "third"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.q.Remove(tc.remove); (err != nil) != tc.err {
+				t.Errorf("Remove() got unexpected error %v, wanted err=%t", err, tc.err)
+			}
+			if n := len(tc.q.items); n != len(tc.next) {
+				t.Errorf("Remove() got %d items, wanted %d", n, len(tc.next))
+			}
+			var got []string
+			for range tc.next {
+				got = append(got, heap.Pop(&tc.q.queue).(*item).name)
+			}
+			if diff := cmp.Diff(tc.next, got); diff != "" {
+				t.Errorf("Remove() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestFixAll(t *testing.T) {
 	log := logrus.WithField("test", "TestFixAll")
 	now := time.Now()
@@ -265,257 +423,750 @@ func TestFix(t *testing.T) {
 	}
 }
 
-func TestStatus(t *testing.T) {
-	log := logrus.WithField("test", "TestStatus")
-	pstr := func(s string) *string { return &s }
+func TestPoke(t *testing.T) {
 	now := time.Now()
+	log := logrus.WithField("test", "TestPoke")
 	cases := []struct {
 		name string
 		q    *Queue
+		poke string
 
-		depth int
-		next  *string
-		when  time.Time
+		next []string
+		err  bool
 	}{
 		{
-			name: "empty",
+			name: "missing",
 			q:    &Queue{},
+			poke: "missing",
+			err:  true,
 		},
 		{
-			name: "single",
+			name: "basic",
 			q: func() *Queue {
 				var q Queue
-				q.Init(log, []string{"hi"}, now)
+				q.Init(log, []string{"first", "poked"}, now.Add(time.Hour))
 				return &q
 			}(),
-			depth: 1,
-			next:  pstr("hi"),
-			when:  now,
+			poke: "poked",
+			next: []string{"poked", "first"},
 		},
 		{
-			name: "multi",
+			name: "already ready",
 			q: func() *Queue {
 				var q Queue
-				q.Init(log, []string{
-					"hi",
-					"middle",
-					"there",
-				}, now)
-				q.Fix("middle", now.Add(-time.Minute), true)
+				q.Init(log, []string{"first", "poked"}, now.Add(time.Hour))
+				q.Fix("first", now.Add(-2*time.Minute), false)
+				q.Fix("poked", now.Add(-time.Minute), false)
 				return &q
 			}(),
-			depth: 3,
-			next:  pstr("middle"),
-			when:  now.Add(-time.Minute),
+			poke: "poked",
+			next: []string{"first", "poked"},
 		},
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			depth, next, when := tc.q.Status()
-			if want, got := tc.depth, depth; want != got {
-				t.Errorf("Status() wanted depth %d, got %d", want, got)
+			if err := tc.q.Poke(tc.poke); (err != nil) != tc.err {
+				t.Errorf("Poke() got unexpected error %v, wanted err=%t", err, tc.err)
 			}
-			if diff := cmp.Diff(tc.next, next, protocmp.Transform()); diff != "" {
-				t.Errorf("Status() got unexpected next diff (-want +got):\n%s", diff)
+			var got []string
+			for range tc.next {
+				got = append(got, heap.Pop(&tc.q.queue).(*item).name)
 			}
-			if !when.Equal(tc.when) {
-				t.Errorf("Status() wanted when %v, got %v", tc.when, when)
+			if diff := cmp.Diff(tc.next, got); diff != "" {
+				t.Errorf("Poke() got unexpected diff (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
 
-func TestSend(t *testing.T) {
-	log := logrus.WithField("test", "TestSend")
+func TestSetFrequency(t *testing.T) {
+	now := time.Now()
+	log := logrus.WithField("test", "TestSetFrequency")
 	cases := []struct {
 		name      string
 		q         *Queue
-		receivers func(context.Context, *testing.T) (context.Context, chan<- string, func() []string)
-		freq      time.Duration
+		set       string
+		frequency time.Duration
 
 		want []string
+		err  bool
 	}{
 		{
-			name: "empty",
-			q:    &Queue{log: log},
-			receivers: func(ctx context.Context, t *testing.T) (context.Context, chan<- string, func() []string) {
-				ch := make(chan string)
-				go func() {
-					for {
-						select {
-						case name := <-ch:
-							t.Errorf("Send() receiver got unexpected group: %v", name)
-							return
-						case <-ctx.Done():
-							return
-						}
-					}
-				}()
-
-				return ctx, ch, func() []string { return nil }
-			},
-		},
-		{
-			name: "empty loop",
-			q:    &Queue{log: log},
-			receivers: func(ctx context.Context, t *testing.T) (context.Context, chan<- string, func() []string) {
-				ch := make(chan string)
-				ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
-				go func() {
-					for {
-						select {
-						case name := <-ch:
-							t.Errorf("Send() receiver got unexpected name: %q", name)
-							return
-						case <-ctx.Done():
-							cancel()
-							return
-						}
-					}
-				}()
-
-				return ctx, ch, func() []string { return nil }
-			},
-			freq: time.Microsecond,
+			name: "missing",
+			q:    &Queue{},
+			set:  "missing",
+			err:  true,
 		},
 		{
-			name: "single",
+			name: "override",
 			q: func() *Queue {
 				var q Queue
-				q.Init(log, []string{"hi"}, time.Now())
+				q.Init(log, []string{"slow", "fast"}, now)
 				return &q
 			}(),
-			receivers: func(ctx context.Context, t *testing.T) (context.Context, chan<- string, func() []string) {
-				ch := make(chan string)
-				var wg sync.WaitGroup
-				wg.Add(1)
-				var got []string
-				go func() {
-					defer wg.Done()
-					for {
-						select {
-						case name := <-ch:
-							got = append(got, name)
-							return
-						case <-ctx.Done():
-							return
-						}
-					}
-				}()
-
-				return ctx, ch, func() []string {
-					wg.Wait()
-					return got
-				}
-			},
-			want: []string{"hi"},
+			set:       "slow",
+			frequency: time.Hour,
+			want:      []string{"fast", "slow", "fast", "fast"},
 		},
 		{
-			name: "single loop",
+			name: "clear",
 			q: func() *Queue {
 				var q Queue
-				q.Init(log, []string{"hi"}, time.Now())
+				q.Init(log, []string{"slow", "fast"}, now)
+				q.SetFrequency("slow", time.Hour)
 				return &q
 			}(),
-			receivers: func(ctx context.Context, _ *testing.T) (context.Context, chan<- string, func() []string) {
-				ch := make(chan string)
-				var wg sync.WaitGroup
-				wg.Add(1)
-				var got []string
-				ctx, cancel := context.WithCancel(ctx)
-				go func() {
-					defer wg.Done()
-					for {
-						select {
-						case name := <-ch:
-							got = append(got, name)
-							if len(got) == 3 {
-								cancel()
-							}
-						case <-ctx.Done():
-							cancel()
-							return
-						}
-					}
-				}()
+			set:  "slow",
+			want: []string{"fast", "slow", "fast", "slow"},
+		},
+	}
 
-				return ctx, ch, func() []string {
-					wg.Wait()
-					return got
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.q.SetFrequency(tc.set, tc.frequency); (err != nil) != tc.err {
+				t.Errorf("SetFrequency() got unexpected error %v, wanted err=%t", err, tc.err)
+			}
+			if tc.err {
+				return
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan string)
+			var got []string
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for name := range ch {
+					got = append(got, name)
+					if len(got) == len(tc.want) {
+						cancel()
+						return
+					}
 				}
-			},
-			freq: time.Microsecond,
-			want: []string{
-				"hi",
-				"hi",
-				"hi",
-			},
-		},
+			}()
+			if err := tc.q.Send(ctx, ch, time.Microsecond); err != context.Canceled {
+				t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+			wg.Wait()
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCurrentWhileChanging(t *testing.T) {
+	log := logrus.WithField("test", "TestCurrentWhileChanging")
+	var q Queue
+	q.Init(log, []string{"hi"}, time.Now())
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if got := len(q.Current()); got < 1 || got > 2 {
+				t.Errorf("Current() got %d items, wanted 1 or 2", got)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		q.Add("extra", time.Now(), false)
+		if err := q.Remove("extra"); err != nil {
+			t.Errorf("Remove() got unexpected error: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestWhen(t *testing.T) {
+	now := time.Now()
+	var q Queue
+	q.Init(logrus.WithField("test", "TestWhen"), []string{"hi", "there"}, now)
+	q.Fix("there", now.Add(time.Hour), true)
+	cases := []struct {
+		name string
+		want time.Time
+		ok   bool
+	}{
+		{
+			name: "hi",
+			want: now,
+			ok:   true,
+		},
+		{
+			name: "there",
+			want: now.Add(time.Hour),
+			ok:   true,
+		},
+		{
+			name: "missing",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := q.When(tc.name)
+			if ok != tc.ok {
+				t.Errorf("When() got ok %t, wanted %t", ok, tc.ok)
+			}
+			if !got.Equal(tc.want) {
+				t.Errorf("When() got %v, wanted %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLen(t *testing.T) {
+	log := logrus.WithField("test", "TestLen")
+	now := time.Now()
+	var q Queue
+	check := func(action string, want int) {
+		t.Helper()
+		if n := q.Len(); n != want {
+			t.Errorf("Len() after %s got %d, wanted %d", action, n, want)
+		}
+		if empty := q.IsEmpty(); empty != (want == 0) {
+			t.Errorf("IsEmpty() after %s got %t, wanted %t", action, empty, want == 0)
+		}
+	}
+	check("nothing", 0)
+	q.Init(log, []string{"hi", "there"}, now)
+	check("Init", 2)
+	q.Add("again", now, false)
+	q.Add("hi", now, false)
+	check("Add", 3)
+	q.Remove("there")
+	check("Remove", 2)
+	q.Init(log, nil, now)
+	check("Init again", 0)
+}
+
+func TestTimeUntilNext(t *testing.T) {
+	now := time.Now()
+	log := logrus.WithField("test", "TestTimeUntilNext")
+	cases := []struct {
+		name  string
+		names []string
+		when  time.Time
+		want  time.Duration
+		ok    bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "ready",
+			names: []string{"hi"},
+			when:  now.Add(-time.Minute),
+			ok:    true,
+		},
+		{
+			name:  "future",
+			names: []string{"hi"},
+			when:  now.Add(time.Hour),
+			want:  time.Hour,
+			ok:    true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q Queue
+			q.SetClock(fake.NewClock(now))
+			q.Init(log, tc.names, tc.when)
+			got, ok := q.TimeUntilNext()
+			if got != tc.want || ok != tc.ok {
+				t.Errorf("TimeUntilNext() got %v, %t, wanted %v, %t", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestFIFO(t *testing.T) {
+	now := time.Now()
+	q := Queue{FIFO: true}
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestFIFO"), []string{"third", "first", "second"}, now.Add(time.Hour))
+	q.Add("fourth", now.Add(-time.Hour), false)
+	q.Add("first", now.Add(-2*time.Hour), false) // keeps its place
+
+	ch := make(chan string, 10)
+	if err := q.Send(context.Background(), ch, time.Hour); err != nil {
+		t.Fatalf("Send() got unexpected error: %v", err)
+	}
+	close(ch)
+	var got []string
+	for name := range ch {
+		got = append(got, name)
+	}
+	if diff := cmp.Diff([]string{"third", "first", "second", "fourth"}, got); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if n, _, _ := q.Status(); n != 0 {
+		t.Errorf("Send() left %d items, wanted none", n)
+	}
+
+	// Adding sent items puts them at the back again.
+	q.Add("second", now, false)
+	q.Add("first", now, false)
+	var sent []string
+	for i := 0; i < 2; i++ {
+		who, err := q.Next(context.Background(), time.Hour)
+		if err != nil {
+			t.Fatalf("Next() got unexpected error: %v", err)
+		}
+		sent = append(sent, who.Name)
+	}
+	if diff := cmp.Diff([]string{"second", "first"}, sent); diff != "" {
+		t.Errorf("Next() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestZeroFrequency(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name string
+		mode ZeroFrequencyMode
+		want []string
+		left int
+	}{
+		{
+			name: "pop",
+			mode: PopAtZero,
+			want: []string{"hi", "there"},
+		},
+		{
+			name: "repeat",
+			mode: RepeatAtZero,
+			want: []string{"hi", "there", "hi", "there", "hi"},
+			left: 2,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := Queue{ZeroFrequency: tc.mode}
+			q.SetClock(fake.NewClock(now))
+			q.Init(logrus.WithField("name", tc.name), []string{"there", "hi"}, now)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan string)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- q.Send(ctx, ch, 0)
+			}()
+			var got []string
+			for range tc.want {
+				got = append(got, <-ch)
+			}
+			if tc.mode == PopAtZero {
+				if err := <-errCh; err != nil {
+					t.Errorf("Send() got unexpected error: %v", err)
+				}
+			} else {
+				cancel()
+				if err := <-errCh; err != context.Canceled {
+					t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+				}
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+			}
+			if n, _, _ := q.Status(); n != tc.left {
+				t.Errorf("Send() left %d items, wanted %d", n, tc.left)
+			}
+		})
+	}
+}
+
+func TestAnchor(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name    string
+		anchor  AnchorMode
+		catchUp CatchUpMode
+		late    time.Duration
+		want    time.Time
+	}{
+		{
+			name: "sent",
+			late: 10 * time.Second,
+			want: now.Add(time.Minute),
+		},
+		{
+			name:   "scheduled",
+			anchor: AnchorScheduled,
+			late:   10 * time.Second,
+			want:   now.Add(50 * time.Second),
+		},
+		{
+			name:   "skip missed",
+			anchor: AnchorScheduled,
+			late:   90 * time.Second,
+			want:   now.Add(30 * time.Second),
+		},
+		{
+			name:    "burst missed",
+			anchor:  AnchorScheduled,
+			catchUp: BurstMissed,
+			late:    90 * time.Second,
+			want:    now.Add(-30 * time.Second),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := Queue{Anchor: tc.anchor, CatchUp: tc.catchUp}
+			q.SetClock(fake.NewClock(now))
+			// A slow send takes hi late after it was scheduled.
+			q.Init(logrus.WithField("name", tc.name), []string{"hi"}, now.Add(-tc.late))
+			s, err := q.Next(context.Background(), time.Minute)
+			if err != nil {
+				t.Fatalf("Next() got unexpected error: %v", err)
+			}
+			if !s.Next.Equal(tc.want) {
+				t.Errorf("Next() rescheduled hi at %v, wanted %v", s.Next, tc.want)
+			}
+		})
+	}
+}
+
+func TestOverdue(t *testing.T) {
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestOverdue"), []string{"ready", "now", "paused", "future"}, now)
+	q.FixAll(map[string]time.Time{
+		"ready":  now.Add(-time.Minute),
+		"paused": now.Add(-time.Minute),
+		"future": now.Add(time.Minute),
+	}, true)
+	q.SetPaused("paused", true)
+	if got := q.Overdue(); got != 2 {
+		t.Errorf("Overdue() got %d, wanted 2", got)
+	}
+}
+
+func TestReadyCount(t *testing.T) {
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestReadyCount"), nil, now)
+	if got := q.ReadyCount(); got != 0 {
+		t.Errorf("ReadyCount() of an empty queue got %d, wanted 0", got)
+	}
+	for i := 0; i < 10; i++ {
+		offset := time.Duration(i+1) * time.Minute
+		if i%2 == 0 {
+			offset = -offset
+		}
+		q.Add(fmt.Sprintf("item-%d", i), now.Add(offset), true)
+	}
+	q.SetPaused("item-0", true)
+	if got := q.ReadyCount(); got != 5 {
+		t.Errorf("ReadyCount() got %d, wanted 5", got)
+	}
+}
+
+func TestProjectedLoad(t *testing.T) {
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestProjectedLoad"), nil, now)
+	if got := q.ProjectedLoad(time.Hour); got != 0 {
+		t.Errorf("ProjectedLoad() of an empty queue got %d, wanted 0", got)
+	}
+	for name, when := range map[string]time.Time{
+		"fast":    now,
+		"overdue": now.Add(-time.Hour),
+		"slow":    now.Add(30 * time.Minute),
+		"once":    now.Add(10 * time.Minute),
+		"later":   now.Add(2 * time.Hour),
+		"paused":  now,
+	} {
+		q.Add(name, when, true)
+	}
+	for name, frequency := range map[string]time.Duration{
+		"fast":    10 * time.Minute, // now and six more times
+		"overdue": 15 * time.Minute, // now and four more times
+		"slow":    2 * time.Hour,
+		"paused":  time.Minute,
+	} {
+		if err := q.SetFrequency(name, frequency); err != nil {
+			t.Fatalf("SetFrequency(%q) got unexpected error: %v", name, err)
+		}
+	}
+	q.SetPaused("paused", true)
+	if got, want := q.ProjectedLoad(time.Hour), 7+5+1+1; got != want {
+		t.Errorf("ProjectedLoad() got %d, wanted %d", got, want)
+	}
+	q.SetDefaultFrequency(30 * time.Minute) // sends once again
+	if got, want := q.ProjectedLoad(time.Hour), 7+5+1+2; got != want {
+		t.Errorf("ProjectedLoad() with a default frequency got %d, wanted %d", got, want)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	log := logrus.WithField("test", "TestStatus")
+	pstr := func(s string) *string { return &s }
+	now := time.Now()
+	cases := []struct {
+		name string
+		q    *Queue
+
+		depth int
+		next  *string
+		when  time.Time
+	}{
+		{
+			name: "empty",
+			q:    &Queue{},
+		},
+		{
+			name: "single",
+			q: func() *Queue {
+				var q Queue
+				q.Init(log, []string{"hi"}, now)
+				return &q
+			}(),
+			depth: 1,
+			next:  pstr("hi"),
+			when:  now,
+		},
 		{
 			name: "multi",
 			q: func() *Queue {
 				var q Queue
 				q.Init(log, []string{
 					"hi",
+					"middle",
 					"there",
-				}, time.Now())
+				}, now)
+				q.Fix("middle", now.Add(-time.Minute), true)
 				return &q
 			}(),
-			receivers: func(ctx context.Context, _ *testing.T) (context.Context, chan<- string, func() []string) {
+			depth: 3,
+			next:  pstr("middle"),
+			when:  now.Add(-time.Minute),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			depth, next, when := tc.q.Status()
+			if want, got := tc.depth, depth; want != got {
+				t.Errorf("Status() wanted depth %d, got %d", want, got)
+			}
+			if diff := cmp.Diff(tc.next, next, protocmp.Transform()); diff != "" {
+				t.Errorf("Status() got unexpected next diff (-want +got):\n%s", diff)
+			}
+			if !when.Equal(tc.when) {
+				t.Errorf("Status() wanted when %v, got %v", tc.when, when)
+			}
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	log := logrus.WithField("test", "TestSend")
+	cases := []struct {
+		name      string
+		q         *Queue
+		receivers func(context.Context, *testing.T) (context.Context, chan<- string, func() []string)
+		freq      time.Duration
+
+		want []string
+	}{
+		{
+			name: "empty",
+			q:    &Queue{log: log},
+			receivers: func(ctx context.Context, t *testing.T) (context.Context, chan<- string, func() []string) {
 				ch := make(chan string)
-				var wg sync.WaitGroup
-				wg.Add(1)
-				var got []string
 				go func() {
-					defer wg.Done()
 					for {
 						select {
 						case name := <-ch:
-							got = append(got, name)
-							if len(got) == 2 {
-								return
-							}
+							t.Errorf("Send() receiver got unexpected group: %v", name)
+							return
 						case <-ctx.Done():
 							return
 						}
 					}
 				}()
 
-				return ctx, ch, func() []string {
-					wg.Wait()
-					return got
-				}
+				return ctx, ch, func() []string { return nil }
 			},
-			want: []string{
-				"hi",
-				"there",
+		},
+		{
+			name: "empty loop",
+			q:    &Queue{log: log},
+			receivers: func(ctx context.Context, t *testing.T) (context.Context, chan<- string, func() []string) {
+				ch := make(chan string)
+				ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+				go func() {
+					for {
+						select {
+						case name := <-ch:
+							t.Errorf("Send() receiver got unexpected name: %q", name)
+							return
+						case <-ctx.Done():
+							cancel()
+							return
+						}
+					}
+				}()
+
+				return ctx, ch, func() []string { return nil }
 			},
+			freq: time.Microsecond,
 		},
 		{
-			name: "multi loop",
+			name: "single",
 			q: func() *Queue {
 				var q Queue
-				q.Init(log, []string{"hi", "there"}, time.Now())
+				q.Init(log, []string{"hi"}, time.Now())
 				return &q
 			}(),
-			receivers: func(ctx context.Context, _ *testing.T) (context.Context, chan<- string, func() []string) {
+			receivers: func(ctx context.Context, t *testing.T) (context.Context, chan<- string, func() []string) {
 				ch := make(chan string)
 				var wg sync.WaitGroup
 				wg.Add(1)
 				var got []string
-				ctx, cancel := context.WithCancel(ctx)
 				go func() {
 					defer wg.Done()
 					for {
 						select {
 						case name := <-ch:
 							got = append(got, name)
-							if len(got) == 6 {
-								cancel()
-							}
+							return
 						case <-ctx.Done():
-							cancel()
+							return
+						}
+					}
+				}()
+
+				return ctx, ch, func() []string {
+					wg.Wait()
+					return got
+				}
+			},
+			want: []string{"hi"},
+		},
+		{
+			name: "single loop",
+			q: func() *Queue {
+				var q Queue
+				q.Init(log, []string{"hi"}, time.Now())
+				return &q
+			}(),
+			receivers: func(ctx context.Context, _ *testing.T) (context.Context, chan<- string, func() []string) {
+				ch := make(chan string)
+				var wg sync.WaitGroup
+				wg.Add(1)
+				var got []string
+				ctx, cancel := context.WithCancel(ctx)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case name := <-ch:
+							got = append(got, name)
+							if len(got) == 3 {
+								cancel()
+							}
+						case <-ctx.Done():
+							cancel()
+							return
+						}
+					}
+				}()
+
+				return ctx, ch, func() []string {
+					wg.Wait()
+					return got
+				}
+			},
+			freq: time.Microsecond,
+			want: []string{
+				"hi",
+				"hi",
+				"hi",
+			},
+		},
+		{
+			name: "multi",
+			q: func() *Queue {
+				var q Queue
+				q.Init(log, []string{
+					"hi",
+					"there",
+				}, time.Now())
+				return &q
+			}(),
+			receivers: func(ctx context.Context, _ *testing.T) (context.Context, chan<- string, func() []string) {
+				ch := make(chan string)
+				var wg sync.WaitGroup
+				wg.Add(1)
+				var got []string
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case name := <-ch:
+							got = append(got, name)
+							if len(got) == 2 {
+								return
+							}
+						case <-ctx.Done():
+							return
+						}
+					}
+				}()
+
+				return ctx, ch, func() []string {
+					wg.Wait()
+					return got
+				}
+			},
+			want: []string{
+				"hi",
+				"there",
+			},
+		},
+		{
+			name: "multi loop",
+			q: func() *Queue {
+				var q Queue
+				q.Init(log, []string{"hi", "there"}, time.Now())
+				return &q
+			}(),
+			receivers: func(ctx context.Context, _ *testing.T) (context.Context, chan<- string, func() []string) {
+				ch := make(chan string)
+				var wg sync.WaitGroup
+				wg.Add(1)
+				var got []string
+				ctx, cancel := context.WithCancel(ctx)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case name := <-ch:
+							got = append(got, name)
+							if len(got) == 6 {
+								cancel()
+							}
+						case <-ctx.Done():
+							cancel()
 							return
 						}
 					}
@@ -556,6 +1207,1528 @@ func TestSend(t *testing.T) {
 	}
 }
 
+func TestSendClock(t *testing.T) {
+	log := logrus.WithField("test", "TestSendClock")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q Queue
+	q.SetClock(clk)
+	q.Init(log, []string{"hi", "there"}, now)
+	q.Fix("there", now.Add(time.Second), true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan string)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Minute)
+	}()
+
+	expect := func(want string) {
+		t.Helper()
+		if got := <-ch; got != want {
+			t.Errorf("Send() got %q, wanted %q", got, want)
+		}
+	}
+
+	expect("hi")
+	clk.BlockUntil(1) // waiting for there
+	clk.Advance(time.Second)
+	expect("there")
+
+	clk.BlockUntil(1) // waiting for hi
+	clk.Advance(30 * time.Second)
+	select {
+	case got := <-ch:
+		t.Errorf("Send() got %q before anything was ready", got)
+	default:
+	}
+	clk.Advance(30 * time.Second)
+	expect("hi")
+	expect("there") // ready at the same time
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	current := q.Current()
+	if want := now.Add(61 * time.Second).Add(time.Minute); !current["hi"].Equal(want) {
+		t.Errorf("Send() rescheduled hi to %v, wanted %v", current["hi"], want)
+	}
+}
+
+func TestJumpTolerance(t *testing.T) {
+	log := logrus.WithField("test", "TestJumpTolerance")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q Queue
+	q.SetClock(clk)
+	q.JumpTolerance = time.Minute
+	q.Init(log, []string{"hi", "there", "world"}, now)
+	q.FixAll(map[string]time.Time{
+		"there": now.Add(time.Minute),
+		"world": now.Add(2 * time.Minute),
+	}, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan string)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+
+	if got := <-ch; got != "hi" {
+		t.Errorf("Send() got %q, wanted hi", got)
+	}
+	clk.BlockUntil(1) // waiting for there
+	clk.Advance(time.Minute + 5*time.Hour)
+	if got := <-ch; got != "there" {
+		t.Errorf("Send() after the clock jumped got %q, wanted there", got)
+	}
+	clk.BlockUntil(1) // waiting for world
+	select {
+	case got := <-ch:
+		t.Errorf("Send() got %q at once after the clock jumped", got)
+	default:
+	}
+	clk.Advance(time.Minute)
+	if got := <-ch; got != "world" {
+		t.Errorf("Send() got %q, wanted world", got)
+	}
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if want := now.Add(time.Hour + 5*time.Hour); !q.Current()["hi"].Equal(want) {
+		t.Errorf("Send() rescheduled hi to %v, wanted %v", q.Current()["hi"], want)
+	}
+}
+
+func TestSendWithJitter(t *testing.T) {
+	log := logrus.WithField("test", "TestSendWithJitter")
+	now := time.Now()
+
+	// sendOnce sends the only item and returns when it is next scheduled.
+	sendOnce := func(t *testing.T, seed *int64, jitter time.Duration) time.Time {
+		t.Helper()
+		var q Queue
+		q.SetClock(fake.NewClock(now))
+		q.Init(log, []string{"hi"}, now)
+		if seed != nil {
+			q.Seed(*seed)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ch := make(chan string)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- q.SendWithJitter(ctx, ch, time.Hour, jitter)
+		}()
+		<-ch
+		cancel()
+		if err := <-errCh; err != context.Canceled {
+			t.Errorf("SendWithJitter() returned unexpected error: want %v, got %v", context.Canceled, err)
+		}
+		return q.Current()["hi"]
+	}
+
+	t.Run("zero", func(t *testing.T) {
+		if got, want := sendOnce(t, nil, 0), now.Add(time.Hour); !got.Equal(want) {
+			t.Errorf("SendWithJitter() rescheduled to %v, wanted %v", got, want)
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		got := sendOnce(t, nil, time.Hour)
+		if min := now.Add(time.Hour); got.Before(min) {
+			t.Errorf("SendWithJitter() rescheduled to %v, wanted at least %v", got, min)
+		}
+		if max := now.Add(2 * time.Hour); !got.Before(max) {
+			t.Errorf("SendWithJitter() rescheduled to %v, wanted before %v", got, max)
+		}
+	})
+
+	t.Run("seeded", func(t *testing.T) {
+		seed := int64(7)
+		first := sendOnce(t, &seed, time.Hour)
+		second := sendOnce(t, &seed, time.Hour)
+		if !first.Equal(second) {
+			t.Errorf("SendWithJitter() with the same seed rescheduled to %v and %v", first, second)
+		}
+		if first.Equal(now.Add(time.Hour)) {
+			t.Errorf("SendWithJitter() failed to jitter the rescheduled item")
+		}
+	})
+}
+
+func TestSendScheduled(t *testing.T) {
+	log := logrus.WithField("test", "TestSendScheduled")
+	now := time.Now()
+	var q Queue
+	q.Init(log, []string{"hi", "there"}, now)
+	q.Fix("there", now.Add(-time.Minute), false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan Scheduled)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendScheduled(ctx, ch, time.Hour, 0)
+	}()
+	got := []Scheduled{<-ch, <-ch}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendScheduled() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	want := []Scheduled{
+		{Name: "there", When: now.Add(-time.Minute), Depth: 2, Trigger: TriggerImmediate},
+		{Name: "hi", When: now, Depth: 2, Trigger: TriggerImmediate},
+	}
+	for i := range got {
+		if got[i].Next.IsZero() {
+			t.Errorf("SendScheduled() failed to set when %q is next sent", got[i].Name)
+		}
+		if got[i].Taken.Before(got[i].When) {
+			t.Errorf("SendScheduled() took %q at %v, before it was ready at %v", got[i].Name, got[i].Taken, got[i].When)
+		}
+		got[i].Next = time.Time{}
+		got[i].Taken = time.Time{}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("SendScheduled() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSendHolding(t *testing.T) {
+	log := logrus.WithField("test", "TestSendHolding")
+	now := time.Now()
+	var q Queue
+	q.Init(log, []string{"hi", "there"}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan Scheduled)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendHolding(ctx, ch)
+	}()
+	<-ch
+	<-ch
+	if n, _, _ := q.Status(); n != 0 {
+		t.Errorf("Status() got depth %d while holding, wanted 0", n)
+	}
+	if err := q.Fix("hi", now, false); err != nil {
+		t.Errorf("Fix() of held item got unexpected error: %v", err)
+	}
+	if err := q.Release("hi", now); err != nil {
+		t.Errorf("Release() got unexpected error: %v", err)
+	}
+	if err := q.Release("hi", now); err == nil {
+		t.Error("Release() of released item failed to return an error")
+	}
+	if err := q.Release("missing", now); err == nil {
+		t.Error("Release() of missing item failed to return an error")
+	}
+	if got := <-ch; got.Name != "hi" {
+		t.Errorf("SendHolding() after Release() got %q, wanted %q", got.Name, "hi")
+	}
+	q.Init(log, nil, now) // removes held items
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendHolding() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestAlign(t *testing.T) {
+	log := logrus.WithField("test", "TestAlign")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clk := fake.NewClock(now)
+	var q Queue
+	q.SetClock(clk)
+	q.Align = time.Minute
+	q.Init(log, []string{"hi", "there", "world"}, now)
+	q.FixAll(map[string]time.Time{
+		"hi":    now.Add(10 * time.Second),
+		"there": now.Add(40 * time.Second),
+		"world": now.Add(80 * time.Second),
+	}, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan []Scheduled)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendBatch(ctx, ch, time.Hour, 0)
+	}()
+	names := func(batch []Scheduled) []string {
+		var got []string
+		for _, s := range batch {
+			got = append(got, s.Name)
+		}
+		return got
+	}
+
+	clk.BlockUntil(1)
+	clk.Advance(45 * time.Second) // both hi and there are ready mid-interval
+	clk.BlockUntil(1)
+	select {
+	case batch := <-ch:
+		t.Fatalf("SendBatch() sent %v before the boundary", names(batch))
+	default:
+	}
+	clk.Advance(15 * time.Second)
+	if diff := cmp.Diff([]string{"hi", "there"}, names(<-ch)); diff != "" {
+		t.Errorf("SendBatch() at the boundary got unexpected diff (-want +got):\n%s", diff)
+	}
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	if diff := cmp.Diff([]string{"world"}, names(<-ch)); diff != "" {
+		t.Errorf("SendBatch() at the next boundary got unexpected diff (-want +got):\n%s", diff)
+	}
+
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendBatch() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	log := logrus.WithField("test", "TestSendBatch")
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(log, []string{"hi", "there", "world"}, now)
+	q.Fix("world", now.Add(time.Minute), true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan []Scheduled)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendBatch(ctx, ch, 0, 0)
+	}()
+	var got []string
+	for _, s := range <-ch {
+		got = append(got, s.Name)
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"hi", "there"}, got); diff != "" {
+		t.Errorf("SendBatch() got unexpected diff (-want +got):\n%s", diff)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendBatch() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSendBatchRepeatAtZero(t *testing.T) {
+	log := logrus.WithField("test", "TestSendBatchRepeatAtZero")
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.ZeroFrequency = RepeatAtZero
+	q.Init(log, []string{"hi", "there"}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan []Scheduled)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendBatch(ctx, ch, 0, 0)
+	}()
+	// Each item is ready again at once, but is sent once per batch.
+	for i := 0; i < 2; i++ {
+		var got []string
+		for _, s := range <-ch {
+			got = append(got, s.Name)
+		}
+		sort.Strings(got)
+		if diff := cmp.Diff([]string{"hi", "there"}, got); diff != "" {
+			t.Errorf("%d: SendBatch() got unexpected diff (-want +got):\n%s", i, diff)
+		}
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendBatch() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestNext(t *testing.T) {
+	log := logrus.WithField("test", "TestNext")
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(log, []string{"hi", "there"}, now)
+	q.Fix("there", now.Add(-time.Minute), false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var got []Scheduled
+	for i := 0; i < 2; i++ {
+		s, err := q.Next(ctx, time.Hour)
+		if err != nil {
+			t.Fatalf("Next() got unexpected error: %v", err)
+		}
+		got = append(got, *s)
+	}
+	want := []Scheduled{
+		{Name: "there", When: now.Add(-time.Minute), Depth: 2, Next: now.Add(time.Hour), Taken: now, Trigger: TriggerImmediate},
+		{Name: "hi", When: now, Depth: 2, Next: now.Add(time.Hour), Taken: now, Trigger: TriggerImmediate},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Next() got unexpected diff (-want +got):\n%s", diff)
+	}
+	cancel()
+	if _, err := q.Next(ctx, time.Hour); err != context.Canceled {
+		t.Errorf("Next() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestTryNext(t *testing.T) {
+	log := logrus.WithField("test", "TestTryNext")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q Queue
+	q.SetClock(clk)
+	q.Init(log, []string{"hi"}, now.Add(time.Minute))
+	if s, ok := q.TryNext(time.Hour); ok {
+		t.Errorf("TryNext() of a future queue got %v, wanted nothing", s)
+	}
+	clk.Advance(time.Minute)
+	s, ok := q.TryNext(time.Hour)
+	if !ok {
+		t.Fatal("TryNext() of a ready queue got nothing")
+	}
+	want := Scheduled{Name: "hi", When: now.Add(time.Minute), Depth: 1, Next: clk.Now().Add(time.Hour), Taken: clk.Now()}
+	if diff := cmp.Diff(want, *s); diff != "" {
+		t.Errorf("TryNext() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if s, ok := q.TryNext(time.Hour); ok {
+		t.Errorf("TryNext() after taking the ready item got %v, wanted nothing", s)
+	}
+}
+
+func TestRamp(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	r := NewRamp(clk, 1, 10, 10*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	allowed := make(chan time.Time)
+	go func() {
+		for r.Wait(ctx) == nil {
+			allowed <- clk.Now()
+		}
+		close(allowed)
+	}()
+	var got []time.Time
+	go func() {
+		for i := 0; i < 300; i++ {
+			clk.BlockUntil(1)
+			clk.Advance(50 * time.Millisecond)
+		}
+		clk.BlockUntil(1)
+		cancel()
+	}()
+	for when := range allowed {
+		got = append(got, when)
+	}
+
+	// Count the sends allowed in each second.
+	counts := make([]int, 15)
+	for _, when := range got {
+		if sec := int(when.Sub(now) / time.Second); sec < len(counts) {
+			counts[sec]++
+		}
+	}
+	for i := 1; i < 10; i++ {
+		if counts[i] < counts[i-1] {
+			t.Errorf("Wait() allowed %d sends in second %d of the ramp, fewer than %d before: %v", counts[i], i, counts[i-1], counts)
+		}
+	}
+	if counts[0] >= counts[9] {
+		t.Errorf("Wait() allowed %d sends in the first second of the ramp, wanted fewer than %d in the last: %v", counts[0], counts[9], counts)
+	}
+	for i := 10; i < len(counts); i++ {
+		if counts[i] < 9 || counts[i] > 11 {
+			t.Errorf("Wait() allowed %d sends in second %d after the ramp, wanted about 10: %v", counts[i], i, counts)
+		}
+	}
+}
+
+func TestSweepDeps(t *testing.T) {
+	log := logrus.WithField("test", "TestSweepDeps")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q Queue
+	q.SetClock(clk)
+	q.Init(log, []string{"a", "b", "c", "d"}, now)
+	for name, deps := range map[string][]string{"a": {"c"}, "c": {"d"}} {
+		if err := q.SetDeps(name, deps); err != nil {
+			t.Fatalf("SetDeps(%q) got unexpected error: %v", name, err)
+		}
+	}
+	if err := q.SweepDeps(); err != nil {
+		t.Fatalf("SweepDeps() got unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	var got []string
+	for i := 0; i < 4; i++ {
+		s, err := q.Next(ctx, time.Hour)
+		if err != nil {
+			t.Fatalf("Next() got unexpected error: %v", err)
+		}
+		got = append(got, s.Name)
+	}
+	if diff := cmp.Diff([]string{"d", "c", "a", "b"}, got); diff != "" {
+		t.Errorf("Next() got unexpected diff in the sweep (-want +got):\n%s", diff)
+	}
+	if len(q.sweep) != 0 {
+		t.Errorf("Next() left %v to sweep", q.sweep)
+	}
+
+	q.Fix("b", now.Add(time.Minute), true)
+	for _, name := range []string{"a", "c", "d"} {
+		q.Fix(name, now, true)
+	}
+	if err := q.SweepDeps(); err != nil {
+		t.Fatalf("SweepDeps() got unexpected error: %v", err)
+	}
+	if s, _ := q.TryNext(time.Hour); s == nil || s.Name != "d" {
+		t.Errorf("TryNext() got %v, wanted d to start the sweep", s)
+	}
+	q.items["d"].deps = []string{"a"}
+	if err := q.SweepDeps(); err == nil || !strings.Contains(err.Error(), "a -> c -> d -> a") {
+		t.Errorf("SweepDeps() of a cycle got %v, wanted an error naming it", err)
+	}
+}
+
+func TestNextBatch(t *testing.T) {
+	log := logrus.WithField("test", "TestNextBatch")
+	now := time.Now()
+	cases := []struct {
+		name string
+		n    int
+		zero ZeroFrequencyMode
+		want []string
+	}{
+		{
+			name: "ready",
+			n:    5,
+			want: []string{"hi", "there"},
+		},
+		{
+			name: "limit",
+			n:    1,
+			want: []string{"hi"},
+		},
+		{
+			name: "not positive",
+			want: []string{"hi"},
+		},
+		{
+			name: "distinct",
+			n:    5,
+			zero: RepeatAtZero,
+			want: []string{"hi", "there"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q Queue
+			q.SetClock(fake.NewClock(now))
+			q.ZeroFrequency = tc.zero
+			q.Init(log, []string{"hi", "there", "later"}, now)
+			q.Fix("hi", now.Add(-time.Minute), false)
+			q.Fix("later", now.Add(time.Hour), true)
+			frequency := time.Hour
+			if tc.zero == RepeatAtZero {
+				frequency = 0
+			}
+			batch, err := q.NextBatch(context.Background(), frequency, tc.n)
+			if err != nil {
+				t.Fatalf("NextBatch() got unexpected error: %v", err)
+			}
+			var got []string
+			for _, s := range batch {
+				got = append(got, s.Name)
+				// NextBatch leaves each item as it was when added to the batch.
+				if trigger, ok := q.LastTrigger(s.Name); !ok || trigger != s.Trigger {
+					t.Errorf("LastTrigger(%s) got %v, %t, wanted %v, true", s.Name, trigger, ok, s.Trigger)
+				}
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("NextBatch() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSetDefaultFrequency(t *testing.T) {
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSetDefaultFrequency"), []string{"hi", "there", "world"}, now)
+	if err := q.SetFrequency("world", 10*time.Minute); err != nil {
+		t.Fatalf("SetFrequency() got unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	next := func() Scheduled {
+		t.Helper()
+		s, err := q.Next(ctx, time.Hour)
+		if err != nil {
+			t.Fatalf("Next() got unexpected error: %v", err)
+		}
+		return *s
+	}
+	if s := next(); s.Name != "hi" || !s.Next.Equal(now.Add(time.Hour)) {
+		t.Errorf("Next() got %s at %v, wanted hi at %v", s.Name, s.Next, now.Add(time.Hour))
+	}
+	q.SetDefaultFrequency(time.Minute)
+	if s := next(); s.Name != "there" || !s.Next.Equal(now.Add(time.Minute)) {
+		t.Errorf("Next() got %s at %v, wanted there at %v", s.Name, s.Next, now.Add(time.Minute))
+	}
+	// Keeps the frequency of an item with its own.
+	if s := next(); s.Name != "world" || !s.Next.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("Next() got %s at %v, wanted world at %v", s.Name, s.Next, now.Add(10*time.Minute))
+	}
+	// Keeps when hi is next sent.
+	if when, ok := q.When("hi"); !ok || !when.Equal(now.Add(time.Hour)) {
+		t.Errorf("When(hi) got %v, %t, wanted %v, true", when, ok, now.Add(time.Hour))
+	}
+	if got := q.Frequency("hi", time.Hour); got != time.Minute {
+		t.Errorf("Frequency(hi) got %v, wanted %v", got, time.Minute)
+	}
+}
+
+type fakeLimiter struct {
+	allow int // number of waits to allow before failing
+	waits int
+}
+
+func (l *fakeLimiter) Wait(ctx context.Context) error {
+	l.waits++
+	if l.waits > l.allow {
+		return errors.New("limited")
+	}
+	return nil
+}
+
+func TestSetLimiter(t *testing.T) {
+	log := logrus.WithField("test", "TestSetLimiter")
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(log, []string{"hi", "there"}, now)
+	q.Fix("hi", now.Add(-time.Minute), false)
+	limiter := fakeLimiter{allow: 1}
+	q.SetLimiter(&limiter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan Scheduled)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendScheduled(ctx, ch, time.Hour, 0)
+	}()
+	if got := <-ch; got.Name != "hi" {
+		t.Errorf("SendScheduled() got %q, wanted hi", got.Name)
+	}
+	if err := <-errCh; err == nil || err.Error() != "limited" {
+		t.Errorf("SendScheduled() got error %v, wanted limited", err)
+	}
+	want := map[string]time.Time{
+		"hi":    now.Add(time.Hour),
+		"there": now, // not rescheduled while limited
+	}
+	if diff := cmp.Diff(want, q.Current()); diff != "" {
+		t.Errorf("Current() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if limiter.waits != 2 {
+		t.Errorf("Wait() got %d calls, wanted 2", limiter.waits)
+	}
+}
+
+func TestFrequency(t *testing.T) {
+	var q Queue
+	q.Init(logrus.WithField("test", "TestFrequency"), []string{"hi", "there"}, time.Now())
+	q.SetFrequency("hi", time.Minute)
+	if got := q.Frequency("hi", time.Hour); got != time.Minute {
+		t.Errorf("Frequency(hi) got %v, wanted %v", got, time.Minute)
+	}
+	if got := q.Frequency("there", time.Hour); got != time.Hour {
+		t.Errorf("Frequency(there) got %v, wanted %v", got, time.Hour)
+	}
+	if got := q.Frequency("missing", time.Hour); got != time.Hour {
+		t.Errorf("Frequency(missing) got %v, wanted %v", got, time.Hour)
+	}
+}
+
+type everyHour struct{}
+
+func (everyHour) Next(t time.Time) time.Time {
+	return t.Truncate(time.Hour).Add(time.Hour)
+}
+
+func TestSetSchedule(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 20, 0, 0, time.UTC)
+	var q Queue
+	q.Init(logrus.WithField("test", "TestSetSchedule"), []string{"hi", "there"}, now)
+	if err := q.SetSchedule("missing", everyHour{}); err == nil {
+		t.Error("SetSchedule() of a missing item failed to return an error")
+	}
+	if err := q.SetSchedule("hi", everyHour{}); err != nil {
+		t.Fatalf("SetSchedule() got unexpected error: %v", err)
+	}
+	cases := []struct {
+		name string
+		want time.Time
+	}{
+		{
+			name: "hi",
+			want: now.Add(40 * time.Minute),
+		},
+		{
+			name: "there",
+			want: now.Add(time.Minute),
+		},
+		{
+			name: "missing",
+			want: now.Add(time.Minute),
+		},
+	}
+	for _, tc := range cases {
+		if got := q.NextAfter(tc.name, now, time.Minute); !got.Equal(tc.want) {
+			t.Errorf("NextAfter(%q) got %v, wanted %v", tc.name, got, tc.want)
+		}
+	}
+	q.SetSchedule("hi", nil)
+	if got, want := q.NextAfter("hi", now, time.Minute), now.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("NextAfter() without a schedule got %v, wanted %v", got, want)
+	}
+}
+
+func TestSetWeight(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q Queue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSetWeight"), []string{"heavy", "light", "medium"}, now)
+	if err := q.SetWeight("missing", 2); err == nil {
+		t.Error("SetWeight(missing) failed to return an error")
+	}
+	if err := q.SetWeight("heavy", 0); err == nil {
+		t.Error("SetWeight(0) failed to return an error")
+	}
+	for name, weight := range map[string]int{
+		"heavy":  6,
+		"medium": 3,
+	} {
+		if err := q.SetWeight(name, weight); err != nil {
+			t.Fatalf("SetWeight(%q) got unexpected error: %v", name, err)
+		}
+	}
+
+	// Every item stays ready, since each one is sent at most once a minute.
+	ctx := context.Background()
+	got := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		clk.Advance(time.Minute)
+		who, err := q.Next(ctx, time.Minute)
+		if err != nil {
+			t.Fatalf("Next() got unexpected error: %v", err)
+		}
+		got[who.Name]++
+	}
+	for name, want := range map[string]int{
+		"heavy":  600,
+		"medium": 300,
+		"light":  100,
+	} {
+		if n := got[name]; n < want-want/10 || n > want+want/10 {
+			t.Errorf("Next() sent %q %d times, wanted about %d", name, n, want)
+		}
+	}
+}
+
+func TestSetClass(t *testing.T) {
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	names := []string{"none", "small-0", "small-1"}
+	for i := 0; i < 10; i++ {
+		names = append(names, fmt.Sprintf("big-%d", i))
+	}
+	q.Init(logrus.WithField("test", "TestSetClass"), names, now)
+	if err := q.SetClass("missing", "big"); err == nil {
+		t.Error("SetClass(missing) failed to return an error")
+	}
+	for _, name := range names {
+		class := strings.Split(name, "-")[0]
+		if class == "none" {
+			continue
+		}
+		if err := q.SetClass(name, class); err != nil {
+			t.Fatalf("SetClass(%q) got unexpected error: %v", name, err)
+		}
+	}
+
+	ctx := context.Background()
+	var got []string
+	for range names {
+		who, err := q.Next(ctx, time.Hour)
+		if err != nil {
+			t.Fatalf("Next() got unexpected error: %v", err)
+		}
+		got = append(got, who.Name)
+	}
+	want := []string{"big-0", "none", "small-0", "big-1", "small-1"}
+	for i := 2; i < 10; i++ {
+		want = append(want, fmt.Sprintf("big-%d", i))
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Next() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSetReadyLess(t *testing.T) {
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSetReadyLess"), []string{"a", "b", "c", "z"}, now)
+	q.Fix("a", now.Add(-time.Minute), false)
+	q.Fix("z", now.Add(time.Minute), true)
+	q.SetReadyLess(func(a, b string) bool { return a > b })
+
+	ctx := context.Background()
+	var got []string
+	for i := 0; i < 3; i++ {
+		who, err := q.Next(ctx, time.Hour)
+		if err != nil {
+			t.Fatalf("Next() got unexpected error: %v", err)
+		}
+		got = append(got, who.Name)
+	}
+	// Sends z last, since it is not yet ready, however much less it is.
+	if diff := cmp.Diff([]string{"c", "b", "a"}, got); diff != "" {
+		t.Errorf("Next() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestOnEmpty(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q Queue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestOnEmpty"), []string{"hi", "there"}, now)
+	events := make(chan string, 10)
+	q.OnEmpty = func() { events <- "empty" }
+	q.OnNonEmpty = func() { events <- "non-empty" }
+	q.EmptyDebounce = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan string)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	<-ch
+	<-ch
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	clk.BlockUntil(1)
+	select {
+	case got := <-events:
+		t.Fatalf("Send() got %s before the debounce", got)
+	default:
+	}
+	clk.Advance(time.Minute)
+	if got := <-events; got != "empty" {
+		t.Fatalf("Send() got %s, wanted empty", got)
+	}
+
+	if err := q.Poke("hi"); err != nil {
+		t.Fatalf("Poke() got unexpected error: %v", err)
+	}
+	if got := <-ch; got != "hi" {
+		t.Errorf("Send() sent %q, wanted hi", got)
+	}
+	if got := <-events; got != "non-empty" {
+		t.Fatalf("Send() got %s, wanted non-empty", got)
+	}
+	clk.BlockUntil(1)
+	select {
+	case got := <-events:
+		t.Errorf("Send() got unexpected %s", got)
+	default:
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestSetDeps(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q Queue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSetDeps"), []string{"summary", "source", "other"}, now)
+	q.FixAll(map[string]time.Time{
+		"summary": now.Add(-time.Hour),
+		"source":  now.Add(time.Minute),
+		"other":   now.Add(-time.Minute),
+	}, true)
+
+	if err := q.SetDeps("missing", []string{"source"}); err == nil {
+		t.Error("SetDeps(missing) failed to return an error")
+	}
+	if err := q.SetDeps("summary", []string{"missing"}); err == nil {
+		t.Error("SetDeps() of a missing dependency failed to return an error")
+	}
+	if err := q.SetDeps("summary", []string{"source"}); err != nil {
+		t.Fatalf("SetDeps() got unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	next := func() string {
+		who, err := q.Next(ctx, time.Hour)
+		if err != nil {
+			t.Fatalf("Next() got unexpected error: %v", err)
+		}
+		return who.Name
+	}
+	// The summary is the most overdue, but waits for its source.
+	if got := next(); got != "other" {
+		t.Errorf("Next() got %q, wanted other", got)
+	}
+	clk.Advance(time.Minute)
+	if got := next(); got != "source" {
+		t.Errorf("Next() got %q, wanted source", got)
+	}
+	if got := next(); got != "summary" {
+		t.Errorf("Next() got %q, wanted summary", got)
+	}
+
+	// Both are ready in the next cycle, but the summary waits for its source again.
+	q.FixAll(map[string]time.Time{
+		"summary": now,
+		"source":  now.Add(time.Minute),
+	}, false)
+	if got := next(); got != "source" {
+		t.Errorf("Next() got %q in the next cycle, wanted source", got)
+	}
+	if got := next(); got != "summary" {
+		t.Errorf("Next() got %q in the next cycle, wanted summary", got)
+	}
+}
+
+func TestSetDepsCycle(t *testing.T) {
+	var q Queue
+	q.Init(logrus.WithField("test", "TestSetDepsCycle"), []string{"a", "b", "c"}, time.Now())
+	if err := q.SetDeps("a", []string{"a"}); err == nil {
+		t.Error("SetDeps() of itself failed to return an error")
+	}
+	if err := q.SetDeps("a", []string{"b"}); err != nil {
+		t.Fatalf("SetDeps(a) got unexpected error: %v", err)
+	}
+	if err := q.SetDeps("b", []string{"c"}); err != nil {
+		t.Fatalf("SetDeps(b) got unexpected error: %v", err)
+	}
+	err := q.SetDeps("c", []string{"a"})
+	if err == nil {
+		t.Fatal("SetDeps() of a cycle failed to return an error")
+	}
+	if got, want := err.Error(), "dependency cycle: c -> a -> b -> c"; got != want {
+		t.Errorf("SetDeps() got error %q, wanted %q", got, want)
+	}
+	if err := q.SetDeps("a", nil); err != nil {
+		t.Fatalf("SetDeps() clearing dependencies got unexpected error: %v", err)
+	}
+	if err := q.SetDeps("c", []string{"a"}); err != nil {
+		t.Errorf("SetDeps() after clearing the cycle got unexpected error: %v", err)
+	}
+}
+
+func TestSameTimeOrder(t *testing.T) {
+	now := time.Now()
+	names := []string{"charlie", "alpha", "delta", "bravo"}
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSameTimeOrder"), names, now)
+	want := []string{"alpha", "bravo", "charlie", "delta"}
+	if diff := cmp.Diff(want, q.Peek(len(names))); diff != "" {
+		t.Errorf("Peek() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if _, who, _ := q.Status(); who == nil || *who != "alpha" {
+		t.Errorf("Status() got %v, wanted alpha", who)
+	}
+	ctx := context.Background()
+	var got []string
+	for range names {
+		who, err := q.Next(ctx, 0)
+		if err != nil {
+			t.Fatalf("Next() got unexpected error: %v", err)
+		}
+		got = append(got, who.Name)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Next() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSendGraceful(t *testing.T) {
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestSendGraceful"), []string{"hi"}, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		// Nothing receives hi.
+		errCh <- q.SendGraceful(ctx, make(chan Scheduled), time.Hour, 0)
+	}()
+	for {
+		if _, _, when := q.Status(); when.After(now) {
+			break // taken off the queue
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendGraceful() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	if _, _, when := q.Status(); !when.Equal(now) {
+		t.Errorf("SendGraceful() left hi at %v, wanted %v", when, now)
+	}
+}
+
+func TestSetMinInterval(t *testing.T) {
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q Queue
+	q.SetClock(clk)
+	q.Init(logrus.WithField("test", "TestSetMinInterval"), []string{"hi"}, now)
+	if err := q.SetMinInterval("missing", time.Minute); err == nil {
+		t.Error("SetMinInterval(missing) failed to return an error")
+	}
+	if err := q.SetMinInterval("hi", 10*time.Minute); err != nil {
+		t.Fatalf("SetMinInterval() got unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	var sent []time.Time
+	for i := 0; i < 60; i++ {
+		if err := q.Poke("hi"); err != nil {
+			t.Fatalf("Poke() got unexpected error: %v", err)
+		}
+		q.lock.Lock()
+		ready := q.hasReady(false)
+		q.lock.Unlock()
+		if ready {
+			if _, err := q.Next(ctx, time.Hour); err != nil {
+				t.Fatalf("Next() got unexpected error: %v", err)
+			}
+			sent = append(sent, clk.Now())
+		}
+		clk.Advance(time.Minute)
+	}
+	if len(sent) != 6 {
+		t.Errorf("Poke() every minute for an hour sent %d times, wanted 6", len(sent))
+	}
+	for i := 1; i < len(sent); i++ {
+		if gap := sent[i].Sub(sent[i-1]); gap < 10*time.Minute {
+			t.Errorf("Send() sent %s after the last time, wanted at least 10m", gap)
+		}
+	}
+}
+
+func TestSetLane(t *testing.T) {
+	for _, fair := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fair=%t", fair), func(t *testing.T) {
+			log := logrus.WithField("test", "TestSetLane")
+			now := time.Now()
+			var q Queue
+			q.SetClock(fake.NewClock(now))
+			q.Init(log, []string{"fast", "faster", "slow", "slower"}, now)
+			q.FixAll(map[string]time.Time{
+				"fast":   now.Add(-time.Minute),
+				"faster": now.Add(-time.Second),
+				"slow":   now.Add(-time.Hour),
+				"slower": now.Add(-2 * time.Hour),
+			}, true)
+			for name, lane := range map[string]int{"slow": 1, "slower": 2} {
+				if err := q.SetLane(name, lane); err != nil {
+					t.Fatalf("SetLane(%q) got unexpected error: %v", name, err)
+				}
+			}
+			if err := q.SetPriority("slow", 10); err != nil {
+				t.Fatalf("SetPriority() got unexpected error: %v", err)
+			}
+			if err := q.SetLane("missing", 1); err == nil {
+				t.Error("SetLane(missing) failed to return an error")
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ch := make(chan Scheduled)
+			errCh := make(chan error, 1)
+			go func() {
+				if fair {
+					errCh <- q.SendFair(ctx, ch, time.Hour, 0)
+					return
+				}
+				errCh <- q.SendScheduled(ctx, ch, time.Hour, 0)
+			}()
+			var got []string
+			for i := 0; i < 4; i++ {
+				got = append(got, (<-ch).Name)
+			}
+			cancel()
+			if err := <-errCh; err != context.Canceled {
+				t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+			}
+			want := []string{"fast", "faster", "slow", "slower"}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPinNext(t *testing.T) {
+	log := logrus.WithField("test", "TestPinNext")
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(log, []string{"hi", "there", "world", "later"}, now.Add(-time.Minute))
+	q.Fix("later", now.Add(time.Hour), true)
+	if err := q.SetPriority("hi", 10); err != nil {
+		t.Fatalf("SetPriority() got unexpected error: %v", err)
+	}
+	if err := q.PinNext("later"); err != nil {
+		t.Fatalf("PinNext() got unexpected error: %v", err)
+	}
+	if err := q.PinNext("missing"); err == nil {
+		t.Error("PinNext(missing) failed to return an error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan string)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, time.Hour)
+	}()
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, <-ch)
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+	want := []string{"later", "hi", "there", "world"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestPinNextPaused(t *testing.T) {
+	now := time.Now()
+	var q Queue
+	q.SetClock(fake.NewClock(now))
+	q.Init(logrus.WithField("test", "TestPinNextPaused"), []string{"hi", "there"}, now.Add(-time.Minute))
+	if err := q.SetPaused("there", true); err != nil {
+		t.Fatalf("SetPaused() got unexpected error: %v", err)
+	}
+	if err := q.PinNext("there"); err != nil {
+		t.Fatalf("PinNext() got unexpected error: %v", err)
+	}
+	if s, ok := q.TryNext(time.Hour); !ok || s.Name != "hi" {
+		t.Errorf("TryNext() got %v, %t, wanted hi", s, ok)
+	}
+	if s, ok := q.TryNext(time.Hour); ok {
+		t.Errorf("TryNext() of a paused pinned item got %s, wanted nothing", s.Name)
+	}
+
+	// Sends it next once resumed.
+	q.Fix("hi", now.Add(-time.Hour), false)
+	if err := q.SetPaused("there", false); err != nil {
+		t.Fatalf("SetPaused() got unexpected error: %v", err)
+	}
+	if s, ok := q.TryNext(time.Hour); !ok || s.Name != "there" || s.Trigger != TriggerPinned {
+		t.Errorf("TryNext() after resuming got %v, %t, wanted there pinned", s, ok)
+	}
+}
+
+func TestSetShuffle(t *testing.T) {
+	log := logrus.WithField("test", "TestSetShuffle")
+	now := time.Now()
+	names := []string{"a", "b", "c", "d", "e"}
+	cycle := func(q *Queue) []string {
+		t.Helper()
+		q.RescheduleAll(q.timeNow())
+		var got []string
+		for range names {
+			s, err := q.Next(context.Background(), time.Hour)
+			if err != nil {
+				t.Fatalf("Next() got unexpected error: %v", err)
+			}
+			got = append(got, s.Name)
+		}
+		return got
+	}
+	shuffled := func() *Queue {
+		var q Queue
+		q.SetClock(fake.NewClock(now))
+		q.Seed(7)
+		q.Init(log, names, now)
+		q.SetShuffle(true)
+		return &q
+	}
+
+	q, same := shuffled(), shuffled()
+	first := cycle(q)
+	if diff := cmp.Diff(cycle(same), first); diff != "" {
+		t.Errorf("SetShuffle() with the same seed got unexpected diff (-want +got):\n%s", diff)
+	}
+	if want := []string{"b", "c", "e", "d", "a"}; !cmp.Equal(want, first) {
+		t.Errorf("SetShuffle() got %v, wanted %v", first, want)
+	}
+	leads := map[string]int{first[0]: 1}
+	const cycles = 500
+	for i := 1; i < cycles; i++ {
+		leads[cycle(q)[0]]++
+	}
+	for _, name := range names {
+		if n := leads[name]; n < cycles/len(names)/2 || n > 2*cycles/len(names) {
+			t.Errorf("SetShuffle() sent %q first in %d of %d cycles, wanted about %d", name, n, cycles, cycles/len(names))
+		}
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	log := logrus.WithField("test", "TestSetPriority")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q Queue
+	q.SetClock(clk)
+	q.Init(log, []string{"low", "old", "high", "higher", "future", "default"}, now)
+	q.FixAll(map[string]time.Time{
+		"low":     now.Add(-time.Minute),
+		"old":     now.Add(-time.Hour),
+		"high":    now.Add(-time.Second),
+		"higher":  now,
+		"future":  now.Add(time.Second),
+		"default": now.Add(-2 * time.Hour),
+	}, true)
+	for name, priority := range map[string]int{
+		"low":    1,
+		"old":    1,
+		"high":   5,
+		"higher": 10,
+		"future": 100,
+	} {
+		if err := q.SetPriority(name, priority); err != nil {
+			t.Fatalf("SetPriority(%q) got unexpected error: %v", name, err)
+		}
+	}
+	if err := q.SetPriority("missing", 1); err == nil {
+		t.Error("SetPriority(missing) failed to return an error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan string)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, 0)
+	}()
+	var got []string
+	for i := 0; i < 5; i++ {
+		got = append(got, <-ch)
+	}
+	clk.BlockUntil(1) // future is not ready
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+
+	want := []string{"higher", "high", "old", "low", "default"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Send() got unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSetPaused(t *testing.T) {
+	log := logrus.WithField("test", "TestSetPaused")
+	now := time.Now()
+	clk := fake.NewClock(now)
+	var q Queue
+	q.SetClock(clk)
+	q.Init(log, []string{"hi", "there"}, now)
+	q.Fix("there", now.Add(time.Minute), true)
+	if err := q.SetPaused("hi", true); err != nil {
+		t.Fatalf("SetPaused() got unexpected error: %v", err)
+	}
+	if err := q.SetPaused("missing", true); err == nil {
+		t.Error("SetPaused(missing) failed to return an error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan string)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Send(ctx, ch, 0)
+	}()
+
+	clk.BlockUntil(1) // skips the paused head
+	clk.Advance(time.Minute)
+	if got := <-ch; got != "there" {
+		t.Errorf("Send() got %q, wanted %q", got, "there")
+	}
+	clk.BlockUntil(1) // every item is paused
+	if n, who, _ := q.Status(); n != 1 || *who != "hi" {
+		t.Errorf("Status() got %d, %q, wanted 1, %q", n, *who, "hi")
+	}
+	q.SetPaused("hi", false)
+	if got := <-ch; got != "hi" {
+		t.Errorf("Send() after unpausing got %q, wanted %q", got, "hi")
+	}
+
+	cancel()
+	if err := <-errCh; err != nil && err != context.Canceled {
+		t.Errorf("Send() returned unexpected error: %v", err)
+	}
+}
+
+func TestResumeAll(t *testing.T) {
+	cases := []struct {
+		name    string
+		catchUp bool
+		want    map[string]time.Duration
+	}{
+		{
+			name: "delay",
+			want: map[string]time.Duration{
+				"hi":    time.Hour,
+				"there": time.Hour + time.Minute,
+			},
+		},
+		{
+			name:    "catch up",
+			catchUp: true,
+			want: map[string]time.Duration{
+				"hi":    0,
+				"there": time.Minute,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			clk := fake.NewClock(now)
+			var q Queue
+			q.SetClock(clk)
+			q.Init(logrus.WithField("name", tc.name), []string{"hi", "there"}, now)
+			q.Fix("there", now.Add(time.Minute), true)
+
+			q.ResumeAll(tc.catchUp) // not paused
+			q.PauseAll()
+			clk.Advance(time.Hour)
+			q.PauseAll() // already paused
+			q.ResumeAll(tc.catchUp)
+
+			want := map[string]time.Time{}
+			for name, d := range tc.want {
+				want[name] = now.Add(d)
+			}
+			if diff := cmp.Diff(want, q.Current()); diff != "" {
+				t.Errorf("ResumeAll() got unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPeek(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name  string
+		whens map[string]time.Time
+		n     int
+		want  []string
+	}{
+		{
+			name: "empty",
+			n:    3,
+		},
+		{
+			name: "zero",
+			whens: map[string]time.Time{
+				"hi": now,
+			},
+		},
+		{
+			name: "ordered",
+			whens: map[string]time.Time{
+				"a": now.Add(time.Minute),
+				"b": now.Add(-time.Minute),
+				"c": now,
+				"d": now.Add(time.Hour),
+			},
+			n:    3,
+			want: []string{"b", "c", "a"},
+		},
+		{
+			name: "ties",
+			whens: map[string]time.Time{
+				"b": now,
+				"c": now,
+				"a": now,
+			},
+			n:    3,
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "fewer",
+			whens: map[string]time.Time{
+				"b": now,
+				"a": now.Add(time.Minute),
+			},
+			n:    5,
+			want: []string{"b", "a"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var q Queue
+			var names []string
+			for name := range tc.whens {
+				names = append(names, name)
+			}
+			q.Init(logrus.WithField("name", tc.name), names, now)
+			q.FixAll(tc.whens, true)
+			before := q.Current()
+			got := q.Peek(tc.n)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Peek() got unexpected diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(before, q.Current()); diff != "" {
+				t.Errorf("Peek() changed the queue (-before +after):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestShiftAll(t *testing.T) {
+	now := time.Now()
+	whens := map[string]time.Time{
+		"a": now.Add(-time.Minute),
+		"b": now,
+		"c": now.Add(time.Hour),
+	}
+	for _, offset := range []time.Duration{0, time.Hour, -2 * time.Hour} {
+		t.Run(offset.String(), func(t *testing.T) {
+			var q Queue
+			q.Init(logrus.WithField("offset", offset), []string{"a", "b", "c"}, now)
+			q.FixAll(whens, true)
+			before := q.Peek(3)
+
+			q.ShiftAll(offset)
+
+			want := map[string]time.Time{}
+			for name, when := range whens {
+				want[name] = when.Add(offset)
+			}
+			if diff := cmp.Diff(want, q.Current()); diff != "" {
+				t.Errorf("ShiftAll() got unexpected diff (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(before, q.Peek(3)); diff != "" {
+				t.Errorf("ShiftAll() changed the order (-before +after):\n%s", diff)
+			}
+			if _, who, _ := q.Status(); *who != "a" {
+				t.Errorf("Status() got %q, wanted %q", *who, "a")
+			}
+		})
+	}
+}
+
+func TestJitterAll(t *testing.T) {
+	now := time.Now()
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	var q Queue
+	q.Seed(1)
+	q.Init(logrus.WithField("test", "TestJitterAll"), names, now)
+	q.JitterAll(time.Minute)
+	current := q.Current()
+	delayed := map[time.Time]bool{}
+	for name, when := range current {
+		if when.Before(now) || !when.Before(now.Add(time.Minute)) {
+			t.Errorf("JitterAll() moved %s to %v, wanted within a minute after %v", name, when, now)
+		}
+		delayed[when] = true
+	}
+	if len(delayed) < 2 {
+		t.Errorf("JitterAll() moved every item to the same time: %v", current)
+	}
+}
+
+func TestRescheduleAll(t *testing.T) {
+	now := time.Now()
+	var q Queue
+	q.Init(logrus.WithField("test", "TestRescheduleAll"), []string{"a", "b", "c"}, now)
+	q.FixAll(map[string]time.Time{
+		"a": now.Add(-time.Minute),
+		"c": now.Add(time.Hour),
+	}, true)
+
+	when := now.Add(time.Minute)
+	q.RescheduleAll(when)
+
+	want := map[string]time.Time{
+		"a": when,
+		"b": when,
+		"c": when,
+	}
+	if diff := cmp.Diff(want, q.Current()); diff != "" {
+		t.Errorf("RescheduleAll() got unexpected diff (-want +got):\n%s", diff)
+	}
+	if n, _, got := q.Status(); n != 3 || !got.Equal(when) {
+		t.Errorf("Status() got %d, %v, wanted 3, %v", n, got, when)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	var first, second Queue
+	first.Seed(7)
+	second.Seed(7)
+	for i := 0; i < 10; i++ {
+		a, b := first.jitter(time.Hour), second.jitter(time.Hour)
+		if a != b {
+			t.Fatalf("%d: jitter() with the same seed got %v and %v", i, a, b)
+		}
+		if a < 0 || a >= time.Hour {
+			t.Errorf("%d: jitter() got %v, wanted [0, 1h)", i, a)
+		}
+	}
+	if got := first.jitter(0); got != 0 {
+		t.Errorf("jitter(0) got %v, wanted 0", got)
+	}
+}
+
 func TestPriorityQueue(t *testing.T) {
 	cases := []struct {
 		name  string
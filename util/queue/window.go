@@ -0,0 +1,119 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Window is a period of time during which the queue sends nothing, such as a maintenance window.
+type Window interface {
+	// Until returns when the window containing t ends, or false when t is outside the window.
+	Until(t time.Time) (time.Time, bool)
+}
+
+// Interval is a Window from Start until End.
+type Interval struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Until returns End when t is in [Start, End).
+func (i Interval) Until(t time.Time) (time.Time, bool) {
+	if t.Before(i.Start) || !t.Before(i.End) {
+		return time.Time{}, false
+	}
+	return i.End, true
+}
+
+// Daily is a Window recurring each day, such as 02:00-02:30 for a nightly backup.
+type Daily struct {
+	// Start of the window, after midnight.
+	Start time.Duration
+	// Duration of the window, which may extend past midnight.
+	Duration time.Duration
+	// Location tells what time of day it is, defaulting to UTC.
+	Location *time.Location
+}
+
+// Until returns when the window ends when t is during that day's or the previous day's window.
+func (d Daily) Until(t time.Time) (time.Time, bool) {
+	loc := d.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	local := t.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	for _, day := range []int{0, -1} {
+		start := midnight.AddDate(0, 0, day).Add(d.Start)
+		end := start.Add(d.Duration)
+		if !t.Before(start) && t.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// SetWindows stops sends from sending anything during any of the windows.
+//
+// Items stay at their current time during a window. Once it ends, items
+// which became ready during it are spread randomly over the next spread,
+// rather than all being sent at once. Replaces any previous windows.
+func (q *Queue) SetWindows(spread time.Duration, windows ...Window) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.rouse()
+	q.windows = windows
+	q.spread = spread
+}
+
+// window returns when the window containing now ends, or false when no window contains it.
+//
+// Caller must hold the lock.
+func (q *Queue) window(now time.Time) (time.Time, bool) {
+	var until time.Time
+	for _, w := range q.windows {
+		if end, ok := w.Until(now); ok && end.After(until) {
+			until = end
+		}
+	}
+	return until, !until.IsZero()
+}
+
+// closeWindow spreads items which became ready during a window once it ends.
+//
+// Caller must hold the lock.
+func (q *Queue) closeWindow(now time.Time) {
+	if q.windowEnd.IsZero() {
+		return
+	}
+	q.windowEnd = time.Time{}
+	if q.spread <= 0 {
+		return
+	}
+	var n int
+	for _, it := range q.queue {
+		if it.when.After(now) {
+			continue
+		}
+		it.when = now.Add(q.jitter(q.spread))
+		n++
+	}
+	heap.Init(&q.queue)
+	q.log.WithField("names", n).WithField("spread", q.spread).Info("Spread names after window")
+}
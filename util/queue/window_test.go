@@ -0,0 +1,167 @@
+/*
+Copyright 2022 The TestGrid Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/testgrid/util/clock/fake"
+	"github.com/sirupsen/logrus"
+)
+
+func TestWindowUntil(t *testing.T) {
+	day := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	pacific, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatalf("LoadLocation() got unexpected error: %v", err)
+	}
+	backup := Daily{Start: 2 * time.Hour, Duration: 30 * time.Minute}
+	cases := []struct {
+		name   string
+		window Window
+		at     time.Time
+		want   time.Time
+	}{
+		{
+			name:   "interval before",
+			window: Interval{Start: day, End: day.Add(time.Hour)},
+			at:     day.Add(-time.Second),
+		},
+		{
+			name:   "interval start",
+			window: Interval{Start: day, End: day.Add(time.Hour)},
+			at:     day,
+			want:   day.Add(time.Hour),
+		},
+		{
+			name:   "interval end",
+			window: Interval{Start: day, End: day.Add(time.Hour)},
+			at:     day.Add(time.Hour),
+		},
+		{
+			name:   "daily before",
+			window: backup,
+			at:     day.Add(119 * time.Minute),
+		},
+		{
+			name:   "daily during",
+			window: backup,
+			at:     day.Add(2*time.Hour + time.Minute),
+			want:   day.Add(150 * time.Minute),
+		},
+		{
+			name:   "daily next day",
+			window: backup,
+			at:     day.AddDate(0, 0, 1).Add(2 * time.Hour),
+			want:   day.AddDate(0, 0, 1).Add(150 * time.Minute),
+		},
+		{
+			name:   "daily after",
+			window: backup,
+			at:     day.Add(150 * time.Minute),
+		},
+		{
+			name:   "past midnight",
+			window: Daily{Start: 23 * time.Hour, Duration: 2 * time.Hour},
+			at:     day.Add(30 * time.Minute),
+			want:   day.Add(time.Hour),
+		},
+		{
+			name:   "location",
+			window: Daily{Start: 2 * time.Hour, Duration: 30 * time.Minute, Location: pacific},
+			at:     time.Date(2022, 6, 1, 9, 15, 0, 0, time.UTC), // 02:15 PDT
+			want:   time.Date(2022, 6, 1, 9, 30, 0, 0, time.UTC),
+		},
+		{
+			name:   "other location",
+			window: Daily{Start: 2 * time.Hour, Duration: 30 * time.Minute, Location: pacific},
+			at:     day.Add(2*time.Hour + 15*time.Minute),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := tc.window.Until(tc.at)
+			if ok != !tc.want.IsZero() || !got.Equal(tc.want) {
+				t.Errorf("Until(%v) got %v, %t, wanted %v", tc.at, got, ok, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetWindows(t *testing.T) {
+	day := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	start, end := day.Add(2*time.Hour), day.Add(150*time.Minute)
+	const spread = 10 * time.Minute
+	clk := fake.NewClock(start.Add(-time.Minute))
+	var q Queue
+	q.SetClock(clk)
+	q.Seed(7)
+	q.Init(logrus.WithField("test", "TestSetWindows"), []string{"before", "a", "b", "c"}, start.Add(10*time.Minute))
+	q.Fix("before", start.Add(-time.Minute), false)
+	q.SetWindows(spread, Daily{Start: 2 * time.Hour, Duration: 30 * time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan Scheduled)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.SendScheduled(ctx, ch, time.Hour, 0)
+	}()
+	if got := <-ch; got.Name != "before" {
+		t.Errorf("SendScheduled() got %q before the window, wanted before", got.Name)
+	}
+
+	// Step into the window, past when a, b and c were ready.
+	clk.BlockUntil(1)
+	clk.Set(start.Add(20 * time.Minute))
+	clk.BlockUntil(1)
+	for name, when := range q.Current() {
+		if name != "before" && !when.Equal(start.Add(10*time.Minute)) {
+			t.Errorf("Current() got %s at %v during the window, wanted it unchanged", name, when)
+		}
+	}
+
+	// Step out of the window, which spreads a, b and c.
+	clk.Set(end)
+	clk.BlockUntil(1)
+	seen := map[time.Time]bool{}
+	for name, when := range q.Current() {
+		if name == "before" {
+			continue
+		}
+		if when.Before(end) || !when.Before(end.Add(spread)) {
+			t.Errorf("Current() got %s at %v, wanted within %v of %v", name, when, spread, end)
+		}
+		if seen[when] {
+			t.Errorf("Current() got %s at %v, which another name shares", name, when)
+		}
+		seen[when] = true
+	}
+	clk.Advance(spread)
+	for i := 0; i < 3; i++ {
+		if got := <-ch; got.Name == "before" {
+			t.Errorf("SendScheduled() got %q after the window, wanted a, b or c", got.Name)
+		}
+	}
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("SendScheduled() returned unexpected error: want %v, got %v", context.Canceled, err)
+	}
+}